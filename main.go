@@ -14,6 +14,7 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/urfave/cli/v2"
+	"github.com/vshn/billing-collector-cloudservices/pkg/billing"
 	"github.com/vshn/billing-collector-cloudservices/pkg/cmd"
 	"github.com/vshn/billing-collector-cloudservices/pkg/log"
 )
@@ -27,10 +28,13 @@ var (
 	appName     = "billing-collector-cloudservices"
 	appLongName = "Metrics collector which gathers metrics information for cloud services"
 
-	odooFailed = promauto.NewCounter(prometheus.CounterOpts{
+	odooFailedByReason = promauto.NewCounterVec(prometheus.CounterOpts{
 		Name: "billing_cloud_collector_http_requests_odoo_failed_total",
-		Help: "Total number of failed HTTP requests to Odoo",
-	})
+		Help: "Total number of failed HTTP requests to Odoo, by reason (api or auth)",
+	}, []string{"reason"})
+	odooFailed     = odooFailedByReason.WithLabelValues("api")
+	odooAuthFailed = odooFailedByReason.WithLabelValues("auth")
+
 	odooSucceeded = promauto.NewCounter(prometheus.CounterOpts{
 		Name: "billing_cloud_collector_http_requests_odoo_succeeded_total",
 		Help: "Total number of successful HTTP requests to Odoo",
@@ -52,8 +56,9 @@ var (
 	}
 
 	odooMetrics = map[string]prometheus.Counter{
-		"odooFailed":    odooFailed,
-		"odooSucceeded": odooSucceeded,
+		"odooFailed":     odooFailed,
+		"odooAuthFailed": odooAuthFailed,
+		"odooSucceeded":  odooSucceeded,
 	}
 
 	allMetrics = map[string]map[string]prometheus.Counter{
@@ -92,7 +97,7 @@ func main() {
 	// If required flags aren't set, it will return with error before we could set up logging
 	if err != nil {
 		_, _ = fmt.Fprintf(os.Stderr, "%v\n", err)
-		os.Exit(1)
+		os.Exit(cmd.ExitCode(err))
 	}
 
 }
@@ -128,6 +133,44 @@ func newApp() (context.Context, context.CancelFunc, *cli.App) {
 				DefaultText: "console",
 				Destination: &logFormat,
 			},
+			&cli.BoolFlag{
+				Name:    "dry-run",
+				EnvVars: []string{"DRY_RUN"},
+				Usage:   "Collect and aggregate as usual, but only render the billing records to stdout instead of sending them",
+			},
+			&cli.StringFlag{
+				Name:    "dry-run-format",
+				EnvVars: []string{"DRY_RUN_FORMAT"},
+				Usage:   "Output format of a dry run (values: [table, json, csv])",
+				Value:   "table",
+			},
+			&cli.StringFlag{
+				Name:    "config",
+				EnvVars: []string{"CONFIG"},
+				Usage:   "Path to a YAML or JSON config file, whose values flags and environment variables override",
+			},
+			&cli.StringFlag{
+				Name:    "billing-timezone",
+				EnvVars: []string{"BILLING_TIMEZONE"},
+				Usage:   "Time zone billing periods start and end in, e.g. days at midnight",
+				Value:   billing.DefaultTimezone,
+			},
+			&cli.StringFlag{
+				Name:    "product-catalog",
+				EnvVars: []string{"PRODUCT_CATALOG"},
+				Usage:   "Path to a YAML or JSON product catalog, whose products replace the built-in ones of the same name",
+			},
+			&cli.StringFlag{
+				Name:    "sales-order-rules",
+				EnvVars: []string{"SALES_ORDER_RULES"},
+				Usage:   "Path to YAML or JSON rules which bill namespaces or organizations to specific sales orders or not at all",
+			},
+			&cli.DurationFlag{
+				Name:    "secret-reload-interval",
+				EnvVars: []string{"SECRET_RELOAD_INTERVAL"},
+				Usage:   "How often the files of secrets given with the -file flags are checked for changes",
+				Value:   time.Minute,
+			},
 			&cli.IntFlag{
 				Name:  "collectInterval",
 				Usage: "Interval in which the exporter checks the cloud resources",
@@ -170,7 +213,7 @@ func newApp() (context.Context, context.CancelFunc, *cli.App) {
 				"uid", os.Getuid(),
 				"gid", os.Getgid(),
 			).Info("Starting up " + appName)
-			return nil
+			return cmd.ApplyConfig(c)
 		},
 		Action: func(c *cli.Context) error {
 			if true {
@@ -182,12 +225,16 @@ func newApp() (context.Context, context.CancelFunc, *cli.App) {
 		Commands: []*cli.Command{
 			cmd.ExoscaleCmds(allMetrics),
 			cmd.CloudscaleCmds(allMetrics),
-			cmd.SpksCMD(allMetrics, ctx),
+			cmd.SpksCMD(allMetrics),
+			cmd.RunCmd(allMetrics),
+			cmd.OdooMockCmd(),
+			cmd.AuditCmds(),
+			cmd.ConfigCmds(),
 		},
 		ExitErrHandler: func(c *cli.Context, err error) {
 			if err != nil {
 				log.Logger(c.Context).Error(err, "fatal error")
-				cli.HandleExitCoder(cli.Exit("", 1))
+				cli.HandleExitCoder(cli.Exit("", cmd.ExitCode(err)))
 			}
 		},
 	}
@@ -0,0 +1,35 @@
+package billing
+
+import "errors"
+
+type partialError struct {
+	err   error
+	parts []string
+}
+
+func (e *partialError) Error() string { return e.err.Error() }
+func (e *partialError) Unwrap() error { return e.err }
+
+// Partial marks the error of a collection which returns only part of the records of a period, because some parts
+// of it, e.g. zones, were unavailable. The records returned are billed, the parts given are collected again on their own.
+func Partial(err error, parts ...string) error {
+	if err == nil {
+		return nil
+	}
+	return &partialError{err: err, parts: parts}
+}
+
+// IsPartial reports whether the error was marked with Partial.
+func IsPartial(err error) bool {
+	var partial *partialError
+	return errors.As(err, &partial)
+}
+
+// FailedParts returns the parts given to Partial, or nil if the error was not marked with it.
+func FailedParts(err error) []string {
+	var partial *partialError
+	if !errors.As(err, &partial) {
+		return nil
+	}
+	return partial.parts
+}
@@ -0,0 +1,125 @@
+// Package billing cuts time into the billing periods the collectors bill, in the billing time zone.
+package billing
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/vshn/billing-collector-cloudservices/pkg/odoo"
+)
+
+// DefaultTimezone is the time zone billing periods start and end in, unless configured otherwise.
+const DefaultTimezone = "Europe/Zurich"
+
+// Length is the length of billing periods.
+type Length int
+
+const (
+	Hour Length = iota + 1
+	Day
+	Month
+)
+
+func (l Length) String() string {
+	switch l {
+	case Hour:
+		return "hour"
+	case Day:
+		return "day"
+	case Month:
+		return "month"
+	}
+	return fmt.Sprintf("Length(%d)", int(l))
+}
+
+// In returns the periods of the length in the time zone of the location.
+func (l Length) In(location *time.Location) Period {
+	return Period{length: l, location: location}
+}
+
+// Period cuts time into billing periods of a length in a time zone.
+// Days and months start at midnight local time and are shorter or longer on DST transitions,
+// hours start at the full local hour and are always an hour long, except in time zones whose DST shift is not a full hour.
+type Period struct {
+	length   Length
+	location *time.Location
+}
+
+// LoadLocation loads the billing time zone, DefaultTimezone if name is empty.
+func LoadLocation(name string) (*time.Location, error) {
+	if name == "" {
+		name = DefaultTimezone
+	}
+	location, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, fmt.Errorf("billing timezone: %w", err)
+	}
+	return location, nil
+}
+
+func (p Period) Length() Length           { return p.length }
+func (p Period) Location() *time.Location { return p.location }
+
+// Start returns the start of the period t is in, in the billing time zone.
+func (p Period) Start(t time.Time) time.Time {
+	t = t.In(p.location)
+	switch p.length {
+	case Hour:
+		// not t.Truncate, which would be off in time zones with an offset of a fraction of an hour
+		return t.Add(-time.Duration(t.Minute())*time.Minute - time.Duration(t.Second())*time.Second - time.Duration(t.Nanosecond()))
+	case Month:
+		return startOfDay(t.Year(), t.Month(), 1, p.location)
+	default:
+		return startOfDay(t.Year(), t.Month(), t.Day(), p.location)
+	}
+}
+
+// Next returns the start of the period after the one t is in, in the billing time zone.
+func (p Period) Next(t time.Time) time.Time {
+	start := p.Start(t)
+	switch p.length {
+	case Hour:
+		return p.Start(start.Add(time.Hour))
+	case Month:
+		return startOfDay(start.Year(), start.Month()+1, 1, p.location)
+	default:
+		return startOfDay(start.Year(), start.Month(), start.Day()+1, p.location)
+	}
+}
+
+// Containing returns the billing period t is in, in UTC.
+func (p Period) Containing(t time.Time) odoo.TimeRange {
+	start := p.Start(t)
+	return odoo.TimeRange{From: start.In(time.UTC), To: p.Next(start).In(time.UTC)}
+}
+
+// Previous returns the last billing period which is over at t, in UTC.
+func (p Period) Previous(t time.Time) odoo.TimeRange {
+	return p.Containing(p.Start(t).Add(-time.Nanosecond))
+}
+
+// Between returns the billing periods which start at or after from and end at or before to, oldest first, in UTC.
+func (p Period) Between(from, to time.Time) []odoo.TimeRange {
+	var periods []odoo.TimeRange
+	start := p.Start(from)
+	if start.Before(from) {
+		start = p.Next(start)
+	}
+	for end := p.Next(start); !end.After(to); start, end = end, p.Next(end) {
+		periods = append(periods, odoo.TimeRange{From: start.In(time.UTC), To: end.In(time.UTC)})
+	}
+	return periods
+}
+
+// startOfDay returns the first instant of the day in the location. That is midnight,
+// except where a DST transition skips midnight and the day starts at the end of the transition.
+func startOfDay(year int, month time.Month, day int, location *time.Location) time.Time {
+	t := time.Date(year, month, day, 0, 0, 0, 0, location)
+	// time.Date normalizes the date, e.g. day 32, and a skipped midnight may end up as the hour before it, on the previous day
+	y, m, d := time.Date(year, month, day, 12, 0, 0, 0, location).Date()
+	for ty, tm, td := t.Date(); ty != y || tm != m || td != d; ty, tm, td = t.Date() {
+		t = t.Add(time.Hour)
+		t = t.Add(-time.Duration(t.Minute())*time.Minute - time.Duration(t.Second())*time.Second)
+	}
+	return t
+}
@@ -0,0 +1,143 @@
+package billing
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vshn/billing-collector-cloudservices/pkg/odoo"
+)
+
+func mustLoad(t *testing.T, name string) *time.Location {
+	location, err := LoadLocation(name)
+	require.NoError(t, err)
+	return location
+}
+
+func utc(s string) time.Time {
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		panic(err)
+	}
+	return t.UTC()
+}
+
+func TestPeriod_Containing(t *testing.T) {
+	zurich := mustLoad(t, "Europe/Zurich")
+	santiago := mustLoad(t, "America/Santiago")
+	kolkata := mustLoad(t, "Asia/Kolkata")
+
+	tests := map[string]struct {
+		period   Period
+		t        time.Time
+		expected odoo.TimeRange
+	}{
+		"given an hour, we should get the full hour": {
+			period:   Hour.In(zurich),
+			t:        utc("2024-03-01T13:25:00Z"),
+			expected: odoo.TimeRange{From: utc("2024-03-01T13:00:00Z"), To: utc("2024-03-01T14:00:00Z")},
+		},
+		"given an hour in a time zone with a half hour offset, we should get the full local hour": {
+			period:   Hour.In(kolkata),
+			t:        utc("2024-03-01T13:25:00Z"),
+			expected: odoo.TimeRange{From: utc("2024-03-01T12:30:00Z"), To: utc("2024-03-01T13:30:00Z")},
+		},
+		"given the repeated hour at the end of DST, we should get the second one": {
+			period:   Hour.In(zurich),
+			t:        utc("2024-10-27T01:10:00Z"),
+			expected: odoo.TimeRange{From: utc("2024-10-27T01:00:00Z"), To: utc("2024-10-27T02:00:00Z")},
+		},
+		"given a day, we should get it from local midnight to midnight": {
+			period:   Day.In(zurich),
+			t:        utc("2024-03-01T23:30:00Z"),
+			expected: odoo.TimeRange{From: utc("2024-03-01T23:00:00Z"), To: utc("2024-03-02T23:00:00Z")},
+		},
+		"given the day DST starts, we should get 23 hours": {
+			period:   Day.In(zurich),
+			t:        utc("2024-03-31T12:00:00Z"),
+			expected: odoo.TimeRange{From: utc("2024-03-30T23:00:00Z"), To: utc("2024-03-31T22:00:00Z")},
+		},
+		"given the day DST ends, we should get 25 hours": {
+			period:   Day.In(zurich),
+			t:        utc("2024-10-27T12:00:00Z"),
+			expected: odoo.TimeRange{From: utc("2024-10-26T22:00:00Z"), To: utc("2024-10-27T23:00:00Z")},
+		},
+		"given a day whose midnight DST skips, we should get it from the end of the transition": {
+			period:   Day.In(santiago),
+			t:        utc("2022-09-11T12:00:00Z"),
+			expected: odoo.TimeRange{From: utc("2022-09-11T04:00:00Z"), To: utc("2022-09-12T03:00:00Z")},
+		},
+		"given the day before a skipped midnight, we should get it up to the end of the transition": {
+			period:   Day.In(santiago),
+			t:        utc("2022-09-10T12:00:00Z"),
+			expected: odoo.TimeRange{From: utc("2022-09-10T04:00:00Z"), To: utc("2022-09-11T04:00:00Z")},
+		},
+		"given a month, we should get it from the first to the first of the next month": {
+			period:   Month.In(zurich),
+			t:        utc("2024-03-15T12:00:00Z"),
+			expected: odoo.TimeRange{From: utc("2024-02-29T23:00:00Z"), To: utc("2024-03-31T22:00:00Z")},
+		},
+		"given December, we should get it up to the next year": {
+			period:   Month.In(zurich),
+			t:        utc("2024-12-31T22:59:00Z"),
+			expected: odoo.TimeRange{From: utc("2024-11-30T23:00:00Z"), To: utc("2024-12-31T23:00:00Z")},
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			actual := tc.period.Containing(tc.t)
+			assert.True(t, tc.expected.From.Equal(actual.From), "from: expected %s, got %s", tc.expected.From, actual.From)
+			assert.True(t, tc.expected.To.Equal(actual.To), "to: expected %s, got %s", tc.expected.To, actual.To)
+			assert.Equal(t, time.UTC, actual.From.Location())
+		})
+	}
+}
+
+func TestPeriod_Previous(t *testing.T) {
+	zurich := mustLoad(t, "Europe/Zurich")
+
+	previous := Day.In(zurich).Previous(utc("2024-03-02T05:00:00Z"))
+	assert.Equal(t, odoo.TimeRange{From: utc("2024-02-29T23:00:00Z"), To: utc("2024-03-01T23:00:00Z")}, previous)
+
+	previous = Hour.In(zurich).Previous(utc("2024-03-02T05:00:00Z"))
+	assert.Equal(t, odoo.TimeRange{From: utc("2024-03-02T04:00:00Z"), To: utc("2024-03-02T05:00:00Z")}, previous)
+}
+
+func TestPeriod_Between(t *testing.T) {
+	zurich := mustLoad(t, "Europe/Zurich")
+
+	tests := map[string]struct {
+		period   Period
+		from, to time.Time
+		expected int
+	}{
+		"given whole days, we should get every day": {
+			period: Day.In(zurich), from: utc("2024-03-01T23:00:00Z"), to: utc("2024-03-04T23:00:00Z"), expected: 3,
+		},
+		"given partial days at both ends, we should only get the complete days": {
+			period: Day.In(zurich), from: utc("2024-03-02T05:00:00Z"), to: utc("2024-03-04T12:00:00Z"), expected: 1,
+		},
+		"given the night DST ends, we should get every real hour once": {
+			period: Hour.In(zurich), from: utc("2024-10-26T22:00:00Z"), to: utc("2024-10-27T23:00:00Z"), expected: 25,
+		},
+		"given the night DST starts, we should get 23 hours": {
+			period: Hour.In(zurich), from: utc("2024-03-30T23:00:00Z"), to: utc("2024-03-31T22:00:00Z"), expected: 23,
+		},
+		"given a year, we should get every month": {
+			period: Month.In(zurich), from: utc("2023-12-31T23:00:00Z"), to: utc("2024-12-31T23:00:00Z"), expected: 12,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			periods := tc.period.Between(tc.from, tc.to)
+			require.Len(t, periods, tc.expected)
+			for i, p := range periods {
+				assert.True(t, p.From.Before(p.To))
+				if i > 0 {
+					assert.Equal(t, periods[i-1].To, p.From, "periods should be contiguous")
+				}
+			}
+		})
+	}
+}
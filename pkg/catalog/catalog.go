@@ -0,0 +1,156 @@
+// Package catalog resolves the product IDs of the billing records. Every product is a template over fields like provider, service and plan,
+// which is valid for a period, so that products can be renamed in Odoo without a release.
+package catalog
+
+import (
+	_ "embed"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"sigs.k8s.io/yaml"
+)
+
+//go:embed products.yaml
+var defaultProducts []byte
+
+// Fields are what the template of a product ID can use, e.g. "appcat-{{.Provider}}-v2-{{.Service}}-{{.Plan}}".
+type Fields struct {
+	// Provider is the cloud provider, e.g. "exoscale"
+	Provider string
+	// Service is the type of service, e.g. "pg" or "objectstorage"
+	Service string
+	Plan    string
+	Tier    string
+	Zone    string
+}
+
+// Product is an entry of the catalog.
+type Product struct {
+	// Name is the product a collector bills, e.g. "exoscale-dbaas". A name can have several entries with different validity periods.
+	Name string `json:"name"`
+	// ID is the template of the product ID in Odoo.
+	ID string `json:"id"`
+	// ValidFrom and ValidTo limit the billing periods the entry is used for. ValidFrom is inclusive, ValidTo exclusive, unlimited if unset.
+	ValidFrom *time.Time `json:"validFrom,omitempty"`
+	ValidTo   *time.Time `json:"validTo,omitempty"`
+
+	template *template.Template
+}
+
+func (p Product) validAt(t time.Time) bool {
+	return (p.ValidFrom == nil || !t.Before(*p.ValidFrom)) && (p.ValidTo == nil || t.Before(*p.ValidTo))
+}
+
+// Catalog is the list of products.
+type Catalog struct {
+	products map[string][]Product
+}
+
+type document struct {
+	Products []Product `json:"products"`
+}
+
+// Default returns the built-in catalog.
+func Default() *Catalog {
+	c, err := Parse(defaultProducts)
+	if err != nil {
+		panic(fmt.Errorf("built-in product catalog: %w", err))
+	}
+	return c
+}
+
+// Load returns the built-in catalog, with the products in the YAML or JSON file at the path, if any, replacing the products of the same name.
+func Load(path string) (*Catalog, error) {
+	c := Default()
+	if path == "" {
+		return c, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read product catalog: %w", err)
+	}
+	file, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("product catalog %s: %w", path, err)
+	}
+	for name, products := range file.products {
+		c.products[name] = products
+	}
+	return c, nil
+}
+
+// Parse parses a catalog from YAML or JSON. Every template must be valid and use known fields only,
+// and the validity periods of the entries of a product must not overlap.
+func Parse(data []byte) (*Catalog, error) {
+	doc := document{}
+	if err := yaml.UnmarshalStrict(data, &doc); err != nil {
+		return nil, err
+	}
+	c := &Catalog{products: map[string][]Product{}}
+	for i, p := range doc.Products {
+		if p.Name == "" {
+			return nil, fmt.Errorf("products[%d]: name is required", i)
+		}
+		if p.ID == "" {
+			return nil, fmt.Errorf("product %s: id is required", p.Name)
+		}
+		if p.ValidFrom != nil && p.ValidTo != nil && !p.ValidFrom.Before(*p.ValidTo) {
+			return nil, fmt.Errorf("product %s: validFrom %s must be before validTo %s", p.Name, p.ValidFrom.Format(time.RFC3339), p.ValidTo.Format(time.RFC3339))
+		}
+		tmpl, err := template.New(p.Name).Option("missingkey=error").Parse(p.ID)
+		if err != nil {
+			return nil, fmt.Errorf("product %s: %w", p.Name, err)
+		}
+		p.template = tmpl
+		// rendering with empty fields reports unknown fields right away instead of when billing
+		if _, err := p.render(Fields{}); err != nil {
+			return nil, fmt.Errorf("product %s: %w", p.Name, err)
+		}
+		c.products[p.Name] = append(c.products[p.Name], p)
+	}
+	for name, products := range c.products {
+		sort.Slice(products, func(i, j int) bool {
+			a, b := products[i].ValidFrom, products[j].ValidFrom
+			return b != nil && (a == nil || a.Before(*b))
+		})
+		for i := 1; i < len(products); i++ {
+			if products[i-1].ValidTo == nil || products[i].ValidFrom == nil || products[i].ValidFrom.Before(*products[i-1].ValidTo) {
+				return nil, fmt.Errorf("product %s: validity periods overlap", name)
+			}
+		}
+	}
+	return c, nil
+}
+
+// ProductID returns the ID of the product valid at the time, usually the start of the billing period, rendered with the fields.
+func (c *Catalog) ProductID(name string, at time.Time, fields Fields) (string, error) {
+	products, ok := c.products[name]
+	if !ok {
+		return "", fmt.Errorf("product %s not in catalog", name)
+	}
+	for _, p := range products {
+		if p.validAt(at) {
+			id, err := p.render(fields)
+			if err != nil {
+				return "", fmt.Errorf("product %s: %w", name, err)
+			}
+			if id == "" {
+				return "", fmt.Errorf("product %s: empty product ID for %+v", name, fields)
+			}
+			return id, nil
+		}
+	}
+	return "", fmt.Errorf("product %s: no entry valid at %s", name, at.Format(time.RFC3339))
+}
+
+func (p Product) render(fields Fields) (string, error) {
+	var id strings.Builder
+	if err := p.template.Execute(&id, fields); err != nil {
+		return "", err
+	}
+	return id.String(), nil
+}
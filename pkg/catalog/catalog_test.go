@@ -0,0 +1,165 @@
+package catalog
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDefault(t *testing.T) {
+	now := time.Now()
+	tests := map[string]struct {
+		name     string
+		fields   Fields
+		expected string
+	}{
+		"given exoscale DBaaS, we should get the product of type and plan": {
+			name:     "exoscale-dbaas",
+			fields:   Fields{Provider: "exoscale", Service: "pg", Plan: "hobbyist-2"},
+			expected: "appcat-exoscale-v2-pg-hobbyist-2",
+		},
+		"given exoscale object storage, we should get the product of the tier": {
+			name:     "exoscale-objectstorage",
+			fields:   Fields{Provider: "exoscale", Service: "objectstorage", Tier: "2"},
+			expected: "appcat-exoscale-objectstorage-storage-tier-2",
+		},
+		"given cloudscale requests, we should get the requests product": {
+			name:     "cloudscale-objectstorage-requests",
+			fields:   Fields{Provider: "cloudscale", Service: "objectstorage"},
+			expected: "appcat-cloudscale-objectstorage-requests",
+		},
+		"given SPKS, we should get the product of service and plan": {
+			name:     "spks",
+			fields:   Fields{Provider: "spks", Service: "mariadb", Plan: "premium"},
+			expected: "appcat-spks-mariadb-premium",
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			id, err := Default().ProductID(tc.name, now, tc.fields)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, id)
+		})
+	}
+}
+
+func TestLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "catalog.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(`
+products:
+  - name: exoscale-dbaas
+    id: appcat-{{.Provider}}-v2-{{.Service}}-{{.Plan}}
+    validTo: 2024-04-01T00:00:00+02:00
+  - name: exoscale-dbaas
+    id: appcat-{{.Provider}}-dbaas-{{.Service}}-{{.Plan}}-{{.Zone}}
+    validFrom: 2024-04-01T00:00:00+02:00
+`), 0o600))
+
+	c, err := Load(path)
+	require.NoError(t, err)
+	fields := Fields{Provider: "exoscale", Service: "pg", Plan: "hobbyist-2", Zone: "ch-gva-2"}
+
+	id, err := c.ProductID("exoscale-dbaas", time.Date(2024, 3, 31, 21, 0, 0, 0, time.UTC), fields)
+	require.NoError(t, err)
+	assert.Equal(t, "appcat-exoscale-v2-pg-hobbyist-2", id, "the previous entry should be valid until validTo")
+
+	id, err = c.ProductID("exoscale-dbaas", time.Date(2024, 3, 31, 22, 0, 0, 0, time.UTC), fields)
+	require.NoError(t, err)
+	assert.Equal(t, "appcat-exoscale-dbaas-pg-hobbyist-2-ch-gva-2", id, "the new entry should be valid from validFrom")
+
+	id, err = c.ProductID("spks", time.Now(), Fields{Provider: "spks", Service: "redis", Plan: "standard"})
+	require.NoError(t, err)
+	assert.Equal(t, "appcat-spks-redis-standard", id, "products not in the file should be built in")
+}
+
+func TestParse(t *testing.T) {
+	tests := map[string]struct {
+		catalog       string
+		expectedError string
+	}{
+		"given an unknown field, we should get an error": {
+			catalog: `
+products:
+  - name: spks
+    id: appcat-{{.Flavor}}
+`,
+			expectedError: "product spks: template: spks:1:9: executing \"spks\" at <.Flavor>: can't evaluate field Flavor",
+		},
+		"given an invalid template, we should get an error": {
+			catalog: `
+products:
+  - name: spks
+    id: appcat-{{.Plan
+`,
+			expectedError: "product spks: template: spks:1: unclosed action",
+		},
+		"given overlapping validity periods, we should get an error": {
+			catalog: `
+products:
+  - name: spks
+    id: appcat-spks-{{.Plan}}
+    validTo: 2024-06-01T00:00:00Z
+  - name: spks
+    id: appcat-{{.Provider}}-{{.Plan}}
+    validFrom: 2024-05-01T00:00:00Z
+`,
+			expectedError: "product spks: validity periods overlap",
+		},
+		"given two entries valid forever, we should get an error": {
+			catalog: `
+products:
+  - name: spks
+    id: appcat-spks-{{.Plan}}
+  - name: spks
+    id: appcat-{{.Provider}}-{{.Plan}}
+`,
+			expectedError: "product spks: validity periods overlap",
+		},
+		"given validFrom after validTo, we should get an error": {
+			catalog: `
+products:
+  - name: spks
+    id: appcat-spks-{{.Plan}}
+    validFrom: 2024-06-01T00:00:00Z
+    validTo: 2024-05-01T00:00:00Z
+`,
+			expectedError: "product spks: validFrom 2024-06-01T00:00:00Z must be before validTo 2024-05-01T00:00:00Z",
+		},
+		"given an unknown key, we should get an error": {
+			catalog: `
+products:
+  - name: spks
+    id: appcat-spks-{{.Plan}}
+    validUntil: 2024-05-01T00:00:00Z
+`,
+			expectedError: `unknown field "validUntil"`,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := Parse([]byte(tc.catalog))
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tc.expectedError)
+		})
+	}
+}
+
+func TestCatalog_ProductID(t *testing.T) {
+	c, err := Parse([]byte(`
+products:
+  - name: spks
+    id: appcat-{{.Provider}}-{{.Service}}-{{.Plan}}
+    validFrom: 2024-05-01T00:00:00Z
+`))
+	require.NoError(t, err)
+
+	_, err = c.ProductID("spks", time.Date(2024, 4, 30, 0, 0, 0, 0, time.UTC), Fields{})
+	assert.EqualError(t, err, "product spks: no entry valid at 2024-04-30T00:00:00Z")
+
+	_, err = c.ProductID("exoscale-dbaas", time.Now(), Fields{})
+	assert.EqualError(t, err, "product exoscale-dbaas not in catalog")
+}
@@ -2,12 +2,13 @@ package cloudscale
 
 import "github.com/vshn/billing-collector-cloudservices/pkg/odoo"
 
+// Names of the products in the catalog, and the provider and service their IDs are rendered with.
 const (
-	// source format: 'query:zone:tenant:namespace' or 'query:zone:tenant:namespace:class'
-	// We do not have real (prometheus) queries here, just random hardcoded strings.
-	productIdStorage       = "appcat-cloudscale-objectstorage-storage"
-	productIdTrafficOut    = "appcat-cloudscale-objectstorage-trafficout"
-	productIdQueryRequests = "appcat-cloudscale-objectstorage-requests"
+	productStorage       = "cloudscale-objectstorage-storage"
+	productTrafficOut    = "cloudscale-objectstorage-trafficout"
+	productQueryRequests = "cloudscale-objectstorage-requests"
+	provider             = "cloudscale"
+	service              = "objectstorage"
 )
 
 var (
@@ -17,7 +18,7 @@ var (
 )
 
 var units = map[string]string{
-	productIdStorage:       odoo.GBDay,
-	productIdTrafficOut:    odoo.GB,
-	productIdQueryRequests: odoo.KReq,
+	productStorage:       odoo.GBDay,
+	productTrafficOut:    odoo.GB,
+	productQueryRequests: odoo.KReq,
 }
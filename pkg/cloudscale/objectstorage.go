@@ -8,10 +8,13 @@ import (
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/vshn/billing-collector-cloudservices/pkg/controlAPI"
+	"github.com/vshn/billing-collector-cloudservices/pkg/catalog"
 	"github.com/vshn/billing-collector-cloudservices/pkg/kubernetes"
 	"github.com/vshn/billing-collector-cloudservices/pkg/log"
 	"github.com/vshn/billing-collector-cloudservices/pkg/odoo"
+	"github.com/vshn/billing-collector-cloudservices/pkg/salesorder"
+	"github.com/vshn/billing-collector-cloudservices/pkg/secret"
+	"github.com/vshn/billing-collector-cloudservices/pkg/uom"
 	cloudscalev1 "github.com/vshn/provider-cloudscale/apis/cloudscale/v1"
 
 	"github.com/cloudscale-ch/cloudscale-go-sdk/v2"
@@ -25,14 +28,14 @@ type BucketDetail struct {
 }
 
 type ObjectStorage struct {
-	client           *cloudscale.Client
-	k8sClient        k8s.Client
-	controlApiClient k8s.Client
-	salesOrder       string
-	clusterId        string
-	cloudZone        string
-	uomMapping       map[string]string
-	providerMetrics  map[string]prometheus.Counter
+	client          *secret.Client[cloudscale.Client]
+	k8sClient       k8s.Client
+	salesOrders     *salesorder.Resolver
+	clusterId       string
+	cloudZone       string
+	uomMapping      *uom.Mapping
+	products        *catalog.Catalog
+	providerMetrics map[string]prometheus.Counter
 }
 
 const (
@@ -45,26 +48,28 @@ type ObjectStorageData struct {
 	Organization string
 }
 
-func NewObjectStorage(client *cloudscale.Client, k8sClient k8s.Client, controlApiClient k8s.Client, salesOrder, clusterId string, cloudZone string, uomMapping map[string]string, providerMetrics map[string]prometheus.Counter) (*ObjectStorage, error) {
+func NewObjectStorage(client *secret.Client[cloudscale.Client], k8sClient k8s.Client, salesOrders *salesorder.Resolver, clusterId string, cloudZone string, uomMapping *uom.Mapping, products *catalog.Catalog, providerMetrics map[string]prometheus.Counter) (*ObjectStorage, error) {
 	return &ObjectStorage{
-		client:           client,
-		k8sClient:        k8sClient,
-		controlApiClient: controlApiClient,
-		salesOrder:       salesOrder,
-		clusterId:        clusterId,
-		cloudZone:        cloudZone,
-		uomMapping:       uomMapping,
-		providerMetrics:  providerMetrics,
+		client:          client,
+		k8sClient:       k8sClient,
+		salesOrders:     salesOrders,
+		clusterId:       clusterId,
+		cloudZone:       cloudZone,
+		uomMapping:      uomMapping,
+		products:        products,
+		providerMetrics: providerMetrics,
 	}, nil
 }
 
-func (o *ObjectStorage) GetMetrics(ctx context.Context, billingDate time.Time) ([]odoo.OdooMeteredBillingRecord, error) {
+// GetMetrics bills the bucket usage cloudscale reports for the day the billing period starts on in the location.
+func (o *ObjectStorage) GetMetrics(ctx context.Context, period odoo.TimeRange, location *time.Location) ([]odoo.OdooMeteredBillingRecord, error) {
 	logger := log.Logger(ctx)
+	billingDate := period.From.In(location)
 
 	logger.V(1).Info("fetching bucket metrics from cloudscale", "date", billingDate)
 
 	bucketMetricsRequest := cloudscale.BucketMetricsRequest{Start: billingDate, End: billingDate}
-	bucketMetrics, err := o.client.Metrics.GetBucketMetrics(ctx, &bucketMetricsRequest)
+	bucketMetrics, err := o.client.Get().Metrics.GetBucketMetrics(ctx, &bucketMetricsRequest)
 	if err != nil {
 		o.providerMetrics["providerFailed"].Inc()
 		return nil, err
@@ -84,7 +89,7 @@ func (o *ObjectStorage) GetMetrics(ctx context.Context, billingDate time.Time) (
 	for key, bucket := range bucketMap {
 		// fetch bucket user by id
 		logger.Info("fetching user details", "userID", bucket.Subject.ObjectsUserID)
-		userDetails, err := o.client.ObjectsUsers.Get(ctx, bucket.Subject.ObjectsUserID)
+		userDetails, err := o.client.Get().ObjectsUsers.Get(ctx, bucket.Subject.ObjectsUserID)
 		if err != nil {
 			o.providerMetrics["providerFailed"].Inc()
 			logger.Error(err, "unknown userID, something broke here fatally", "userID", bucket.Subject.ObjectsUserID, "bucket", bucket)
@@ -95,10 +100,10 @@ func (o *ObjectStorage) GetMetrics(ctx context.Context, billingDate time.Time) (
 		bucket.BucketDetail.Namespace = strings.Split(userDetails.DisplayName, ".")[0]
 	}
 
-	// Fetch organisations in case salesOrder is missing
+	// Fetch organisations in case salesOrder is missing or rules match organizations
 	var nsTenants map[string]string
-	if o.salesOrder == "" {
-		logger.V(1).Info("Sales order id is missing, fetching namespaces to get the associated org id")
+	if o.salesOrders.NeedsOrganizations() {
+		logger.V(1).Info("Fetching namespaces to get the associated org id")
 		nsTenants, err = kubernetes.FetchNamespaceWithOrganizationMap(ctx, o.k8sClient)
 		if err != nil {
 			o.providerMetrics["providerFailed"].Inc()
@@ -125,25 +130,29 @@ func (o *ObjectStorage) GetMetrics(ctx context.Context, billingDate time.Time) (
 		}
 	}
 
+	salesOrders, err := o.salesOrders.Lookup(ctx)
+	if err != nil {
+		o.providerMetrics["providerFailed"].Inc()
+		return nil, err
+	}
+
 	allRecords := make([]odoo.OdooMeteredBillingRecord, 0)
 	for _, bucket := range bucketMap {
-
-		appuioManaged := true
-		salesOrder := o.salesOrder
-		if salesOrder == "" {
-			appuioManaged = false
-			if bucket.Organization == "" {
-				// in cases that our VSHN services are using buckets, then Organization is not set, we must default it to "vshn"
-				// we can't set it in cluster as for customers as then we might run into scheduling issues
-				bucket.Organization = "vshn"
-			}
-			salesOrder, err = controlAPI.GetSalesOrder(ctx, o.controlApiClient, bucket.Organization)
-			if err != nil {
-				logger.Error(err, "unable to sync bucket", "namespace", bucket, "reason", err)
-				continue
-			}
+		if bucket.Organization == "" && nsTenants != nil {
+			// in cases that our VSHN services are using buckets, then Organization is not set, we must default it to "vshn"
+			// we can't set it in cluster as for customers as then we might run into scheduling issues
+			bucket.Organization = "vshn"
+		}
+		salesOrder, billable, err := salesOrders.SalesOrder(ctx, bucket.Namespace, bucket.Organization)
+		if err != nil {
+			logger.Error(err, "unable to sync bucket", "namespace", bucket, "reason", err)
+			continue
+		}
+		if !billable {
+			logger.V(1).Info("Namespace is not billable, skipping", "namespace", bucket.Namespace)
+			continue
 		}
-		records, err := o.createOdooRecord(bucket.BucketMetricsData, bucket.BucketDetail, appuioManaged, salesOrder, billingDate)
+		records, err := o.createOdooRecord(bucket.BucketMetricsData, bucket.BucketDetail, o.salesOrders.Managed(), salesOrder, period)
 		if err != nil {
 			logger.Error(err, "unable to create Odoo Record", "namespace", bucket.Namespace)
 			continue
@@ -155,20 +164,20 @@ func (o *ObjectStorage) GetMetrics(ctx context.Context, billingDate time.Time) (
 	return allRecords, nil
 }
 
-func (o *ObjectStorage) createOdooRecord(bucketMetricsData cloudscale.BucketMetricsData, b BucketDetail, appuioManaged bool, salesOrder string, billingDate time.Time) ([]odoo.OdooMeteredBillingRecord, error) {
+func (o *ObjectStorage) createOdooRecord(bucketMetricsData cloudscale.BucketMetricsData, b BucketDetail, appuioManaged bool, salesOrder string, period odoo.TimeRange) ([]odoo.OdooMeteredBillingRecord, error) {
 	if len(bucketMetricsData.TimeSeries) != 1 {
 		return nil, fmt.Errorf("there must be exactly one metrics data point, found %d", len(bucketMetricsData.TimeSeries))
 	}
 
-	storageBytesValue, err := convertUnit(units[productIdStorage], uint64(bucketMetricsData.TimeSeries[0].Usage.StorageBytes))
+	storageBytesValue, err := convertUnit(units[productStorage], uint64(bucketMetricsData.TimeSeries[0].Usage.StorageBytes))
 	if err != nil {
 		return nil, err
 	}
-	trafficOutValue, err := convertUnit(units[productIdTrafficOut], uint64(bucketMetricsData.TimeSeries[0].Usage.SentBytes))
+	trafficOutValue, err := convertUnit(units[productTrafficOut], uint64(bucketMetricsData.TimeSeries[0].Usage.SentBytes))
 	if err != nil {
 		return nil, err
 	}
-	queryRequestsValue, err := convertUnit(units[productIdQueryRequests], uint64(bucketMetricsData.TimeSeries[0].Usage.Requests))
+	queryRequestsValue, err := convertUnit(units[productQueryRequests], uint64(bucketMetricsData.TimeSeries[0].Usage.Requests))
 	if err != nil {
 		return nil, err
 	}
@@ -182,48 +191,44 @@ func (o *ObjectStorage) createOdooRecord(bucketMetricsData cloudscale.BucketMetr
 
 	instanceId := fmt.Sprintf("%s/%s", b.Zone, bucketMetricsData.Subject.BucketName)
 
-	billingStart := time.Date(billingDate.Year(), billingDate.Month(), billingDate.Day(), 0, 0, 0, 0, time.UTC)
-	billingEnd := time.Date(billingDate.Year(), billingDate.Month(), billingDate.Day()+1, 0, 0, 0, 0, time.UTC)
+	fields := catalog.Fields{Provider: provider, Service: service, Zone: b.Zone}
+	productIDs := map[string]string{}
+	for _, product := range []string{productStorage, productTrafficOut, productQueryRequests} {
+		if productIDs[product], err = o.products.ProductID(product, period.From, fields); err != nil {
+			return nil, err
+		}
+	}
 
 	return []odoo.OdooMeteredBillingRecord{
 		{
-			ProductID:            productIdStorage,
+			ProductID:            productIDs[productStorage],
 			InstanceID:           instanceId + "/storage",
 			ItemDescription:      bucketMetricsData.Subject.BucketName,
 			ItemGroupDescription: itemGroup,
 			SalesOrder:           salesOrder,
-			UnitID:               o.uomMapping[units[productIdStorage]],
+			UnitID:               o.uomMapping.UnitID(units[productStorage]),
 			ConsumedUnits:        storageBytesValue,
-			TimeRange: odoo.TimeRange{
-				From: billingStart,
-				To:   billingEnd,
-			},
+			TimeRange:            period,
 		},
 		{
-			ProductID:            productIdTrafficOut,
+			ProductID:            productIDs[productTrafficOut],
 			InstanceID:           instanceId + "/trafficout",
 			ItemDescription:      bucketMetricsData.Subject.BucketName,
 			ItemGroupDescription: itemGroup,
 			SalesOrder:           salesOrder,
-			UnitID:               o.uomMapping[units[productIdTrafficOut]],
+			UnitID:               o.uomMapping.UnitID(units[productTrafficOut]),
 			ConsumedUnits:        trafficOutValue,
-			TimeRange: odoo.TimeRange{
-				From: billingStart,
-				To:   billingEnd,
-			},
+			TimeRange:            period,
 		},
 		{
-			ProductID:            productIdQueryRequests,
+			ProductID:            productIDs[productQueryRequests],
 			InstanceID:           instanceId + "/requests",
 			ItemDescription:      bucketMetricsData.Subject.BucketName,
 			ItemGroupDescription: itemGroup,
 			SalesOrder:           salesOrder,
-			UnitID:               o.uomMapping[units[productIdQueryRequests]],
+			UnitID:               o.uomMapping.UnitID(units[productQueryRequests]),
 			ConsumedUnits:        queryRequestsValue,
-			TimeRange: odoo.TimeRange{
-				From: billingStart,
-				To:   billingEnd,
-			},
+			TimeRange:            period,
 		},
 	}, nil
 }
@@ -245,12 +250,8 @@ func fetchBuckets(ctx context.Context, k8sclient client.Client) (map[string]Buck
 	return bucketDetails, nil
 }
 
-func CheckUnitExistence(mapping map[string]string) error {
-	if mapping[odoo.GB] == "" || mapping[odoo.GBDay] == "" || mapping[odoo.KReq] == "" {
-		return fmt.Errorf("missing UOM mapping %s, %s or %s", odoo.GB, odoo.GBDay, odoo.KReq)
-	}
-	return nil
-}
+// Units are the units of measure the object storage collector needs in the UOM mapping.
+var Units = []string{odoo.GB, odoo.GBDay, odoo.KReq}
 
 func convertUnit(unit string, value uint64) (float64, error) {
 	if unit == "GB" || unit == "GBDay" {
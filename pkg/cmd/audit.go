@@ -0,0 +1,108 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/urfave/cli/v2"
+	"github.com/vshn/billing-collector-cloudservices/pkg/odoo"
+)
+
+// AuditCmds inspects the audit log written by the Odoo client.
+func AuditCmds() *cli.Command {
+	var (
+		dir    string
+		filter odoo.AuditFilter
+		from   string
+		to     string
+		output string
+	)
+	return &cli.Command{
+		Name:  "audit",
+		Usage: "Inspect the audit log of everything sent to Odoo",
+		Subcommands: []*cli.Command{
+			{
+				Name:   "query",
+				Usage:  "Verify the audit log and print the records sent to Odoo, optionally filtered",
+				Before: addCommandName,
+				Flags: []cli.Flag{
+					&cli.StringFlag{Name: "audit-dir", Usage: "Directory of the audit log",
+						EnvVars: []string{"AUDIT_DIR"}, Destination: &dir, Required: true, DefaultText: defaultTextForRequiredFlags},
+					&cli.StringFlag{Name: "sales-order", Usage: "Only show records of this sales order",
+						Destination: &filter.SalesOrder, DefaultText: defaultTextForOptionalFlags},
+					&cli.StringFlag{Name: "instance-id", Usage: "Only show records of this instance",
+						Destination: &filter.InstanceID, DefaultText: defaultTextForOptionalFlags},
+					&cli.StringFlag{Name: "product-id", Usage: "Only show records of this product",
+						Destination: &filter.ProductID, DefaultText: defaultTextForOptionalFlags},
+					&cli.StringFlag{Name: "from", Usage: "Only show records whose billing period ends after this date or time (RFC3339 or YYYY-MM-DD, UTC)",
+						Destination: &from, DefaultText: defaultTextForOptionalFlags},
+					&cli.StringFlag{Name: "to", Usage: "Only show records whose billing period starts before this date or time (RFC3339 or YYYY-MM-DD, UTC)",
+						Destination: &to, DefaultText: defaultTextForOptionalFlags},
+					&cli.StringFlag{Name: "output", Usage: "Output format (values: [table, json])",
+						Destination: &output, Value: "table"},
+				},
+				Action: func(c *cli.Context) error {
+					var err error
+					if filter.From, err = parseDateFlag("from", from, time.UTC); err != nil {
+						return err
+					}
+					if filter.To, err = parseDateFlag("to", to, time.UTC); err != nil {
+						return err
+					}
+
+					entries, queryErr := odoo.QueryAuditLog(dir, filter)
+					switch output {
+					case "json":
+						enc := json.NewEncoder(os.Stdout)
+						for _, e := range entries {
+							if err := enc.Encode(e); err != nil {
+								return err
+							}
+						}
+					case "table":
+						if err := printAuditTable(entries); err != nil {
+							return err
+						}
+					default:
+						return fmt.Errorf("unknown output format %q, must be table or json", output)
+					}
+					return queryErr
+				},
+			},
+		},
+	}
+}
+
+// parseDateFlag parses an RFC3339 time, or a date with an optional time of day in the given location.
+func parseDateFlag(name, value string, loc *time.Location) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	for _, layout := range []string{time.RFC3339, "2006-01-02T15:04", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, value, loc); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("flag %s: cannot parse %q as RFC3339, YYYY-MM-DDTHH:MM or YYYY-MM-DD", name, value)
+}
+
+func printAuditTable(entries []odoo.AuditEntry) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SENT\tCOLLECTOR\tSTATUS\tSALES ORDER\tPRODUCT\tINSTANCE\tUNITS\tFROM\tTO")
+	for _, e := range entries {
+		status := strconv.Itoa(e.Status)
+		if e.Error != "" {
+			status = "error"
+		}
+		for _, r := range e.Records {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%g\t%s\t%s\n",
+				e.Time.Format(time.RFC3339), e.Collector, status, r.SalesOrder, r.ProductID, r.InstanceID, r.ConsumedUnits,
+				r.TimeRange.From.Format(time.RFC3339), r.TimeRange.To.Format(time.RFC3339))
+		}
+	}
+	return w.Flush()
+}
@@ -0,0 +1,161 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/urfave/cli/v2"
+	"github.com/vshn/billing-collector-cloudservices/pkg/billing"
+	"github.com/vshn/billing-collector-cloudservices/pkg/catalog"
+	"github.com/vshn/billing-collector-cloudservices/pkg/odoo"
+	"github.com/vshn/billing-collector-cloudservices/pkg/salesorder"
+	"github.com/vshn/billing-collector-cloudservices/pkg/scheduler"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// billingLocation loads the time zone of the billing periods, set with the global billing-timezone flag.
+func billingLocation(c *cli.Context) (*time.Location, error) {
+	return billing.LoadLocation(c.String("billing-timezone"))
+}
+
+// productCatalog loads the product catalog given with the global product-catalog flag, the built-in one if none is given.
+func productCatalog(c *cli.Context) (*catalog.Catalog, error) {
+	return catalog.Load(c.String("product-catalog"))
+}
+
+// salesOrderResolver loads the sales order rules given with the global sales-order-rules flag, if any,
+// falling back to the sales order of the cluster or the Control API.
+func salesOrderResolver(c *cli.Context, salesOrder string, k8sClient, controlApiClient client.Client) (*salesorder.Resolver, error) {
+	rules, err := salesorder.Load(c.String("sales-order-rules"))
+	if err != nil {
+		return nil, err
+	}
+	return salesorder.NewResolver(rules, salesOrder, k8sClient, controlApiClient), nil
+}
+
+// collectFunc collects the billing records of one billing period.
+type collectFunc func(ctx context.Context, period odoo.TimeRange) ([]odoo.OdooMeteredBillingRecord, error)
+
+// collectPartsFunc collects the billing records of the given parts of one billing period, e.g. of some zones.
+type collectPartsFunc func(ctx context.Context, period odoo.TimeRange, parts []string) ([]odoo.OdooMeteredBillingRecord, error)
+
+// backfillOptions holds the flags of the backfill commands.
+type backfillOptions struct {
+	from       string
+	to         string
+	namespace  string
+	salesOrder string
+	// billCurrentUsage allows a backfill of a provider which only reports the usage at the time of the collection.
+	billCurrentUsage bool
+}
+
+// flags returns the flags of the date range, and if filters is set, of the namespace and sales order filters.
+func (o *backfillOptions) flags(filters bool) []cli.Flag {
+	flags := []cli.Flag{
+		&cli.StringFlag{Name: "from", Usage: "Bill the periods starting at or after this date or time (RFC3339 or YYYY-MM-DD in the billing time zone)",
+			Destination: &o.from, Required: true, DefaultText: defaultTextForRequiredFlags},
+		&cli.StringFlag{Name: "to", Usage: "Bill the periods ending at or before this date or time (RFC3339 or YYYY-MM-DD in the billing time zone), defaults to the end of the last complete period",
+			Destination: &o.to, DefaultText: defaultTextForOptionalFlags},
+	}
+	if filters {
+		flags = append(flags,
+			&cli.StringFlag{Name: "namespace", Usage: "Only bill the records of this namespace",
+				Destination: &o.namespace, DefaultText: defaultTextForOptionalFlags},
+			&cli.StringFlag{Name: "sales-order", Usage: "Only bill the records of this sales order",
+				Destination: &o.salesOrder, DefaultText: defaultTextForOptionalFlags},
+		)
+	}
+	return flags
+}
+
+// currentUsageFlag returns the flag which allows a backfill of a provider which only reports current usage.
+func (o *backfillOptions) currentUsageFlag() cli.Flag {
+	return &cli.BoolFlag{Name: "bill-current-usage", Usage: "Bill the current usage for every past period, as the provider reports no usage of the past",
+		Destination: &o.billCurrentUsage}
+}
+
+// checkCurrentUsage refuses the backfill of a provider which only reports current usage, unless the bill-current-usage flag is set,
+// as that usage is billed for every past period instead of the usage of the time.
+func (o *backfillOptions) checkCurrentUsage(provider string) error {
+	if !o.billCurrentUsage {
+		return fmt.Errorf("%s only reports the current usage, which would be billed for every past period, set --bill-current-usage to bill it anyway", provider)
+	}
+	return nil
+}
+
+// periods returns the billing periods between the from and to flags. Periods which are not over at now are never included.
+func (o *backfillOptions) periods(period billing.Period, now time.Time) ([]odoo.TimeRange, error) {
+	from, err := parseDateFlag("from", o.from, period.Location())
+	if err != nil {
+		return nil, err
+	}
+	latest := period.Start(now)
+	to := latest
+	if o.to != "" {
+		if to, err = parseDateFlag("to", o.to, period.Location()); err != nil {
+			return nil, err
+		}
+		if to.After(latest) {
+			return nil, fmt.Errorf("flag to: %s is after the end of the last complete %s %s", to, period.Length(), latest)
+		}
+	}
+	if !from.Before(to) {
+		return nil, fmt.Errorf("flag from: %s is not before %s", from, to)
+	}
+	return period.Between(from, to), nil
+}
+
+// keep reports whether the record passes the namespace and sales order filters.
+func (o *backfillOptions) keep(record odoo.OdooMeteredBillingRecord) bool {
+	if o.namespace != "" && namespaceOf(record.ItemGroupDescription) != o.namespace {
+		return false
+	}
+	return o.salesOrder == "" || record.SalesOrder == o.salesOrder
+}
+
+// run collects and sends one period after the other, oldest first, through the same sink as the scheduled collector,
+// so that records which were already accepted are skipped by the ledger.
+// A period which cannot be collected or sent does not stop the backfill, its error is returned once all other periods are done.
+func (o *backfillOptions) run(ctx context.Context, logger logr.Logger, job string, sink odoo.Sink, periods []odoo.TimeRange, collect collectFunc) error {
+	logger.Info("Backfilling", "periods", len(periods), "namespace", o.namespace, "salesOrder", o.salesOrder)
+
+	var errs []error
+	for _, period := range periods {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		logger := logger.WithValues("from", period.From, "to", period.To)
+		records, err := collect(ctx, period)
+		if err != nil {
+			logger.Error(err, "cannot collect period")
+			errs = append(errs, collectionError(fmt.Errorf("period %s/%s: %w", period.From.Format(time.RFC3339), period.To.Format(time.RFC3339), err)))
+			if !billing.IsPartial(err) {
+				continue
+			}
+		}
+
+		kept := make([]odoo.OdooMeteredBillingRecord, 0, len(records))
+		for _, r := range records {
+			if o.keep(r) {
+				kept = append(kept, r)
+			}
+		}
+		if len(kept) == 0 {
+			logger.Info("No data to export to odoo")
+			continue
+		}
+		if err := send(ctx, logger, job, sink, kept); scheduler.IsFatal(err) {
+			return err
+		} else if err != nil {
+			logger.Error(err, "cannot send period")
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("cannot bill %d of %d periods: %w", len(errs), len(periods), errors.Join(errs...))
+	}
+	return nil
+}
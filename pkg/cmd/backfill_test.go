@@ -0,0 +1,35 @@
+package cmd
+
+import (
+	"context"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/assert"
+	"github.com/urfave/cli/v2"
+	"github.com/vshn/billing-collector-cloudservices/pkg/log"
+)
+
+func TestExoscaleBackfill_currentUsage(t *testing.T) {
+	tests := map[string]struct {
+		args []string
+	}{
+		"given an objectstorage backfill without --bill-current-usage, we should refuse it": {
+			args: []string{"backfill", "objectstorage", "--from", "2024-03-01"},
+		},
+		"given a dbaas backfill without --bill-current-usage, we should refuse it": {
+			args: []string{"backfill", "dbaas", "--from", "2024-03-01"},
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			app := &cli.App{Name: "billing-collector-cloudservices", Commands: []*cli.Command{ExoscaleCmds(nil)}}
+			args := append([]string{app.Name, "exoscale", "--exoscale-access-key", "key", "--exoscale-secret", "secret",
+				"--collect-interval", "1", "--cluster-id", "cluster"}, tc.args...)
+
+			err := app.RunContext(log.NewLoggingContext(context.Background(), logr.Discard()), args)
+			assert.EqualError(t, err, "exoscale only reports the current usage, which would be billed for every past period, set --bill-current-usage to bill it anyway")
+			assert.Equal(t, ExitCodeConfig, ExitCode(err))
+		})
+	}
+}
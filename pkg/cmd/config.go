@@ -0,0 +1,273 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/urfave/cli/v2"
+	"github.com/vshn/billing-collector-cloudservices/pkg/config"
+	"sigs.k8s.io/yaml"
+)
+
+const defaultTextForConfigFlags = "<from config file>"
+
+// configField maps a flag to the field of the config file which sets it.
+type configField struct {
+	// command is the name of the command which has the flag, any command if empty
+	command string
+	flag    string
+	// path is the dotted path of the field, e.g. "odoo.url"
+	path string
+}
+
+// configFields lists the flags which can be set in the config file.
+var configFields = []configField{
+	{flag: "billing-timezone", path: "billingTimezone"},
+	{flag: "product-catalog", path: "productCatalog"},
+	{flag: "sales-order-rules", path: "salesOrderRules"},
+
+	{flag: "sink", path: "odoo.sinks"},
+	{flag: "sink-file", path: "odoo.sinkFile"},
+	{flag: "odoo-url", path: "odoo.url"},
+	{flag: "odoo-oauth-token-url", path: "odoo.oauthTokenURL"},
+	{flag: "odoo-oauth-client-id", path: "odoo.clientID"},
+	{flag: "odoo-oauth-client-secret", path: "odoo.clientSecret"},
+	{flag: "odoo-oauth-client-secret-file", path: "odoo.clientSecretFile"},
+	{flag: "outbox-dir", path: "odoo.outboxDir"},
+	{flag: "odoo-max-retries", path: "odoo.maxRetries"},
+	{flag: "odoo-retry-backoff", path: "odoo.retryBackoff"},
+	{flag: "odoo-retry-max-backoff", path: "odoo.retryMaxBackoff"},
+	{flag: "odoo-batch-size", path: "odoo.batchSize"},
+	{flag: "ledger-file", path: "odoo.ledgerFile"},
+	{flag: "quarantine-file", path: "odoo.quarantineFile"},
+	{flag: "audit-dir", path: "odoo.auditDir"},
+	{flag: "audit-max-size", path: "odoo.auditMaxSize"},
+
+	{flag: "kubeconfig", path: "kubernetes.kubeconfig"},
+	{flag: "control-api-url", path: "controlAPI.url"},
+	{flag: "control-api-token", path: "controlAPI.token"},
+	{flag: "control-api-token-file", path: "controlAPI.tokenFile"},
+	{flag: "cluster-id", path: "cluster.id"},
+	{flag: "cluster-zone", path: "cluster.zone"},
+	{flag: "appuio-managed-sales-order", path: "cluster.salesOrder"},
+	{flag: "uom", path: "uom"},
+	{flag: "uom-file", path: "uomFile"},
+	{flag: "uom-configmap", path: "uomConfigMap"},
+	{flag: "uom-reload-interval", path: "uomReloadInterval"},
+	{flag: "secret-reload-interval", path: "secretReloadInterval"},
+
+	{flag: "timezone", path: "schedule.timezone"},
+	{flag: "shutdown-grace-period", path: "schedule.shutdownGracePeriod"},
+	{flag: "watermark-file", path: "schedule.watermarkFile"},
+	{flag: "watermark-configmap", path: "schedule.watermarkConfigMap"},
+	{flag: "max-catch-up", path: "schedule.maxCatchUp"},
+	{flag: "leader-election-lease", path: "schedule.leaderElectionLease"},
+	{flag: "leader-election-lease-duration", path: "schedule.leaderElectionLeaseDuration"},
+
+	{flag: "exoscale-access-key", path: "collectors.exoscale.accessKey"},
+	{flag: "exoscale-secret", path: "collectors.exoscale.secret"},
+	{flag: "exoscale-access-key-file", path: "collectors.exoscale.accessKeyFile"},
+	{flag: "exoscale-secret-file", path: "collectors.exoscale.secretFile"},
+	{flag: "cloudscale-api-token", path: "collectors.cloudscale.apiToken"},
+	{flag: "cloudscale-api-token-file", path: "collectors.cloudscale.apiTokenFile"},
+	{command: "cloudscale", flag: "days", path: "collectors.cloudscale.days"},
+	{command: "spks", flag: "prometheus-url", path: "collectors.spks.prometheusURL"},
+	{command: "spks", flag: "sales-order", path: "collectors.spks.salesOrder"},
+	{command: "spks", flag: "unit-id", path: "collectors.spks.unitID"},
+}
+
+// intervalFlags only derive the schedules of the commands, they are not required if the config file sets all schedules.
+var intervalFlags = map[string][]string{
+	"exoscale":   {"collectors.exoscale.objectStorage.schedule", "collectors.exoscale.dbaas.schedule"},
+	"cloudscale": {"collectors.cloudscale.objectStorage.schedule"},
+}
+
+func configFieldOf(command, flag string) (configField, bool) {
+	for _, field := range configFields {
+		if field.flag == flag && (field.command == "" || field.command == command) {
+			return field, true
+		}
+	}
+	return configField{}, false
+}
+
+type configKey struct{}
+
+// ApplyConfig loads the config file given with the global config flag, if any, and makes its values the defaults of the flags of all commands.
+// Flags given on the command line or as environment variables take precedence over the config file.
+// It must run before the commands parse their flags, in the Before of the app.
+func ApplyConfig(c *cli.Context) error {
+	path := c.String("config")
+	if path == "" {
+		return nil
+	}
+	cfg, err := config.Load(path)
+	if err != nil {
+		return configError(err)
+	}
+	values, err := cfg.Values()
+	if err != nil {
+		return configError(fmt.Errorf("config %s: %w", path, err))
+	}
+
+	for _, flag := range c.App.Flags {
+		name := flag.Names()[0]
+		if field, ok := configFieldOf("", name); ok && !c.IsSet(name) {
+			if value, ok := values[field.path]; ok {
+				if err := c.Set(name, value); err != nil {
+					return configError(fmt.Errorf("config %s: %s: %w", path, field.path, err))
+				}
+			}
+		}
+	}
+	err = walkCommands(c.App.Commands, func(cmd *cli.Command) error {
+		for _, flag := range cmd.Flags {
+			name := flag.Names()[0]
+			if field, ok := configFieldOf(cmd.Name, name); ok {
+				if value, ok := values[field.path]; ok {
+					if err := setDefault(flag, value); err != nil {
+						return fmt.Errorf("%s: %w", field.path, err)
+					}
+				}
+			}
+		}
+		if schedules, ok := intervalFlags[cmd.Name]; ok && allSet(values, schedules) {
+			for _, flag := range cmd.Flags {
+				if f, ok := flag.(*cli.IntFlag); ok && (f.Name == "collect-interval" || f.Name == "billing-hour") {
+					f.Required, f.DefaultText = false, defaultTextForOptionalFlags
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return configError(fmt.Errorf("config %s: %w", path, err))
+	}
+
+	c.Context = context.WithValue(c.Context, configKey{}, cfg)
+	return nil
+}
+
+// configFrom returns the config file loaded by ApplyConfig, an empty config if there is none.
+func configFrom(ctx context.Context) *config.Config {
+	if cfg, ok := ctx.Value(configKey{}).(*config.Config); ok {
+		return cfg
+	}
+	return &config.Config{}
+}
+
+// effectiveConfig returns the config overridden by the environment variables of the flags the config file can set.
+func effectiveConfig(c *cli.Context, cfg *config.Config) (*config.Config, error) {
+	values := map[string]string{}
+	for _, flag := range c.App.Flags {
+		name := flag.Names()[0]
+		if field, ok := configFieldOf("", name); ok && c.IsSet(name) {
+			values[field.path] = c.String(name)
+		}
+	}
+	err := walkCommands(c.App.Commands, func(cmd *cli.Command) error {
+		for _, flag := range cmd.Flags {
+			field, ok := configFieldOf(cmd.Name, flag.Names()[0])
+			if !ok {
+				continue
+			}
+			if _, done := values[field.path]; done {
+				continue
+			}
+			envFlag, ok := flag.(interface{ GetEnvVars() []string })
+			if !ok {
+				continue
+			}
+			for _, env := range envFlag.GetEnvVars() {
+				if value, ok := os.LookupEnv(env); ok {
+					values[field.path] = value
+					break
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return cfg.Merge(values)
+}
+
+func walkCommands(cmds []*cli.Command, f func(cmd *cli.Command) error) error {
+	for _, cmd := range cmds {
+		if err := f(cmd); err != nil {
+			return err
+		}
+		if err := walkCommands(cmd.Subcommands, f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setDefault makes the value from the config file the default of the flag, which then is no longer required.
+func setDefault(flag cli.Flag, value string) error {
+	var err error
+	switch f := flag.(type) {
+	case *cli.StringFlag:
+		f.Value, f.Required, f.DefaultText = value, false, defaultTextForConfigFlags
+	case *cli.IntFlag:
+		f.Value, err = strconv.Atoi(value)
+		f.Required, f.DefaultText = false, defaultTextForConfigFlags
+	case *cli.Int64Flag:
+		f.Value, err = strconv.ParseInt(value, 10, 64)
+		f.Required, f.DefaultText = false, defaultTextForConfigFlags
+	case *cli.DurationFlag:
+		f.Value, err = time.ParseDuration(value)
+		f.Required, f.DefaultText = false, defaultTextForConfigFlags
+	default:
+		return fmt.Errorf("flag %s cannot be set from the config file", flag.Names()[0])
+	}
+	return err
+}
+
+func allSet(values map[string]string, paths []string) bool {
+	for _, path := range paths {
+		if _, ok := values[path]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// ConfigCmds inspects the configuration.
+func ConfigCmds() *cli.Command {
+	return &cli.Command{
+		Name:  "config",
+		Usage: "Inspect the configuration",
+		Subcommands: []*cli.Command{
+			{
+				Name:  "dump",
+				Usage: "Print the effective configuration, the config file overridden by environment variables, with secrets redacted",
+				Action: func(c *cli.Context) error {
+					cfg, err := effectiveConfig(c, configFrom(c.Context))
+					if err != nil {
+						return configError(err)
+					}
+					out, err := yaml.Marshal(cfg.Redacted())
+					if err != nil {
+						return err
+					}
+					_, err = c.App.Writer.Write(out)
+					return err
+				},
+			},
+			{
+				Name:  "schema",
+				Usage: "Print the JSON schema of the config file",
+				Action: func(c *cli.Context) error {
+					_, err := c.App.Writer.Write(config.Schema())
+					return err
+				},
+			},
+		},
+	}
+}
@@ -0,0 +1,97 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/go-logr/logr"
+	"github.com/urfave/cli/v2"
+	"github.com/vshn/billing-collector-cloudservices/pkg/odoo"
+	"github.com/vshn/billing-collector-cloudservices/pkg/scheduler"
+)
+
+// Exit codes of the application. Transient errors of a scheduled collector never end the process,
+// the collector logs them and tries again at its next run.
+const (
+	// ExitCodeError is used for fatal errors which fit no other exit code.
+	ExitCodeError = 1
+	// ExitCodeConfig means the configuration is invalid, e.g. a missing flag or credentials.
+	ExitCodeConfig = 2
+	// ExitCodeCollection means metrics could not be collected from the cloud provider or Kubernetes.
+	ExitCodeCollection = 3
+	// ExitCodeDelivery means records could not be delivered to a sink, e.g. because Odoo rejected the credentials.
+	ExitCodeDelivery = 4
+	// ExitCodeMapping means the collected usage could not be mapped to billing records Odoo accepts,
+	// e.g. because of a missing UOM mapping, invalid records or records Odoo refused.
+	ExitCodeMapping = 5
+)
+
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string { return e.err.Error() }
+func (e *exitError) Unwrap() error { return e.err }
+
+// withExitCode sets the exit code of the error, unless it already has one.
+func withExitCode(code int, err error) error {
+	var e *exitError
+	if err == nil || errors.As(err, &e) {
+		return err
+	}
+	return &exitError{code: code, err: err}
+}
+
+func configError(err error) error     { return withExitCode(ExitCodeConfig, err) }
+func collectionError(err error) error { return withExitCode(ExitCodeCollection, err) }
+func deliveryError(err error) error   { return withExitCode(ExitCodeDelivery, err) }
+func mappingError(err error) error    { return withExitCode(ExitCodeMapping, err) }
+
+// isMappingError reports whether the error is a mapping error, which sending the records again cannot fix.
+func isMappingError(err error) bool {
+	var e *exitError
+	return errors.As(err, &e) && e.code == ExitCodeMapping
+}
+
+// ExitCode returns the exit code for an error returned by a command.
+func ExitCode(err error) int {
+	var e *exitError
+	if errors.As(err, &e) {
+		return e.code
+	}
+	var coder cli.ExitCoder
+	if errors.As(err, &coder) {
+		return coder.ExitCode()
+	}
+	return ExitCodeError
+}
+
+// send passes the records to the sink and reports the records which were not accepted.
+// A failed delivery is returned as delivery error, so that the period is not taken as billed. It is fatal only
+// if retrying cannot fix it, like credentials Odoo rejects.
+// Records which were delivered but held back as invalid or refused by Odoo are returned as mapping error.
+func send(ctx context.Context, logger logr.Logger, job string, sink odoo.Sink, records []odoo.OdooMeteredBillingRecord) error {
+	logger.Info("Exporting data", "numberOfRecords", len(records))
+	result, err := sink.SendData(ctx, records)
+	reportFailures(logger, job, result)
+
+	chunkFailed := false
+	for _, chunk := range result.Chunks {
+		chunkFailed = chunkFailed || chunk.Err != nil
+	}
+	failures := len(result.Failures())
+	switch {
+	case err != nil && (chunkFailed || failures == 0):
+		err = deliveryError(fmt.Errorf("cannot export metrics, %d of %d records accepted: %w", len(result.Accepted()), len(records), err))
+		var authErr *odoo.AuthError
+		if errors.As(err, &authErr) && !authErr.Temporary() {
+			return scheduler.Fatal(err)
+		}
+		return err
+	case failures > 0 || len(result.Quarantined) > 0:
+		return mappingError(fmt.Errorf("%d records refused by Odoo and %d invalid records held back", failures, len(result.Quarantined)))
+	}
+	return nil
+}
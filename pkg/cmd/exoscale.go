@@ -2,14 +2,13 @@ package cmd
 
 import (
 	"fmt"
-	"os"
-	"sync"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/vshn/billing-collector-cloudservices/pkg/odoo"
 
 	"github.com/urfave/cli/v2"
+	"github.com/vshn/billing-collector-cloudservices/pkg/billing"
 	"github.com/vshn/billing-collector-cloudservices/pkg/exoscale"
 	"github.com/vshn/billing-collector-cloudservices/pkg/kubernetes"
 	"github.com/vshn/billing-collector-cloudservices/pkg/log"
@@ -22,47 +21,143 @@ func addCommandName(c *cli.Context) error {
 
 func ExoscaleCmds(allMetrics map[string]map[string]prometheus.Counter) *cli.Command {
 	var (
-		secret            string
-		accessKey         string
-		kubeconfig        string
-		controlApiUrl     string
-		controlApiToken   string
-		odooURL           string
-		odooOauthTokenURL string
-		odooClientId      string
-		odooClientSecret  string
-		salesOrder        string
-		clusterId         string
-		cloudZone         string
-		uom               string
+		secretKey       secretOption
+		accessKey       secretOption
+		kubeconfig      string
+		controlApiUrl   string
+		controlApiToken secretOption
+		odooOpts        odooOptions
+		schedOpts       scheduleOptions
+		salesOrder      string
+		clusterId       string
+		cloudZone       string
+		uomOpts         uomOptions
 		// For dbaas in minutes
 		// For objectstorage in hours
 		// TODO: Fix this mess
 		collectInterval int
 		billingHour     int
+
+		objectStorageBackfill backfillOptions
+		dbaasBackfill         backfillOptions
 	)
+
+	newObjectStorage := func(c *cli.Context) (*exoscale.ObjectStorage, odoo.Sink, error) {
+		logger := log.Logger(c.Context)
+
+		logger.Info("Creating Exoscale client")
+		exoscaleClient, err := newExoscaleClient(c.Context, logger, &accessKey, &secretKey, c.Duration("secret-reload-interval"))
+		if err != nil {
+			return nil, nil, fmt.Errorf("exoscale client: %w", err)
+		}
+
+		logger.Info("Creating k8s client")
+		k8sClient, err := kubernetes.NewClient(kubeconfig, "", "")
+		if err != nil {
+			return nil, nil, fmt.Errorf("k8s client: %w", err)
+		}
+
+		mapping, err := uomOpts.load(c.Context, logger, k8sClient, exoscale.ObjectStorageUnits...)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		k8sControlClient, err := newControlAPIClient(controlApiUrl, &controlApiToken)
+		if err != nil {
+			return nil, nil, fmt.Errorf("k8s control client: %w", err)
+		}
+
+		sink, err := odooOpts.newSink(c, logger, allMetrics["odooMetrics"])
+		if err != nil {
+			return nil, nil, err
+		}
+
+		products, err := productCatalog(c)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		salesOrders, err := salesOrderResolver(c, salesOrder, k8sClient, k8sControlClient)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		o, err := exoscale.NewObjectStorage(exoscaleClient, k8sClient, salesOrders, clusterId, cloudZone, mapping, products, allMetrics["providerMetrics"])
+		if err != nil {
+			return nil, nil, fmt.Errorf("objectbucket service: %w", err)
+		}
+		return o, sink, nil
+	}
+
+	newDBaaS := func(c *cli.Context) (*exoscale.DBaaS, odoo.Sink, error) {
+		logger := log.Logger(c.Context)
+
+		logger.Info("Creating Exoscale client")
+		exoscaleClient, err := newExoscaleClient(c.Context, logger, &accessKey, &secretKey, c.Duration("secret-reload-interval"))
+		if err != nil {
+			return nil, nil, fmt.Errorf("exoscale client: %w", err)
+		}
+
+		logger.Info("Creating k8s client")
+		k8sClient, err := kubernetes.NewClient(kubeconfig, "", "")
+		if err != nil {
+			return nil, nil, fmt.Errorf("k8s client: %w", err)
+		}
+
+		mapping, err := uomOpts.load(c.Context, logger, k8sClient, exoscale.DBaaSUnits...)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		k8sControlClient, err := newControlAPIClient(controlApiUrl, &controlApiToken)
+		if err != nil {
+			return nil, nil, fmt.Errorf("k8s control client: %w", err)
+		}
+
+		sink, err := odooOpts.newSink(c, logger, allMetrics["odooMetrics"])
+		if err != nil {
+			return nil, nil, err
+		}
+
+		products, err := productCatalog(c)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		salesOrders, err := salesOrderResolver(c, salesOrder, k8sClient, k8sControlClient)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if collectInterval < 1 || collectInterval > 24 {
+			// Set to run once a day after billingHour in case the collectInterval is out of boundaries
+			collectInterval = 1
+		}
+
+		d, err := exoscale.NewDBaaS(exoscaleClient, k8sClient, collectInterval, salesOrders, clusterId, cloudZone, mapping, products)
+		if err != nil {
+			return nil, nil, fmt.Errorf("dbaas service: %w", err)
+		}
+		return d, sink, nil
+	}
+
 	return &cli.Command{
 		Name:  "exoscale",
 		Usage: "Collect metrics from exoscale",
-		Flags: []cli.Flag{
-			&cli.StringFlag{Name: "exoscale-secret", Aliases: []string{"s"}, Usage: "The secret which has unrestricted SOS service access in an Exoscale organization",
-				EnvVars: []string{"EXOSCALE_API_SECRET"}, Destination: &secret, Required: true, DefaultText: defaultTextForRequiredFlags},
-			&cli.StringFlag{Name: "exoscale-access-key", Aliases: []string{"k"}, Usage: "A key which has unrestricted SOS service access in an Exoscale organization",
-				EnvVars: []string{"EXOSCALE_API_KEY"}, Destination: &accessKey, Required: true, DefaultText: defaultTextForRequiredFlags},
+		Flags: append([]cli.Flag{
+			secretKey.flag(&cli.StringFlag{Name: "exoscale-secret", Aliases: []string{"s"}, Usage: "The secret which has unrestricted SOS service access in an Exoscale organization",
+				EnvVars: []string{"EXOSCALE_API_SECRET"}}, true),
+			secretKey.fileFlag(),
+			accessKey.flag(&cli.StringFlag{Name: "exoscale-access-key", Aliases: []string{"k"}, Usage: "A key which has unrestricted SOS service access in an Exoscale organization",
+				EnvVars: []string{"EXOSCALE_API_KEY"}}, true),
+			accessKey.fileFlag(),
 			&cli.StringFlag{Name: "kubeconfig", Usage: "Path to a kubeconfig file which will be used instead of url/token flags if set",
 				EnvVars: []string{"KUBECONFIG"}, Destination: &kubeconfig, Required: false, DefaultText: defaultTextForOptionalFlags},
 			&cli.StringFlag{Name: "control-api-url", Usage: "URL of the APPUiO Cloud Control API",
 				EnvVars: []string{"CONTROL_API_URL"}, Destination: &controlApiUrl, Required: false, DefaultText: defaultTextForOptionalFlags},
-			&cli.StringFlag{Name: "control-api-token", Usage: "Token of the APPUiO Cloud Control API",
-				EnvVars: []string{"CONTROL_API_TOKEN"}, Destination: &controlApiToken, Required: false, DefaultText: defaultTextForOptionalFlags},
-			&cli.StringFlag{Name: "odoo-url", Usage: "URL of the Odoo Metered Billing API",
-				EnvVars: []string{"ODOO_URL"}, Destination: &odooURL, Value: "http://localhost:8080"},
-			&cli.StringFlag{Name: "odoo-oauth-token-url", Usage: "Oauth Token URL to authenticate with Odoo metered billing API",
-				EnvVars: []string{"ODOO_OAUTH_TOKEN_URL"}, Destination: &odooOauthTokenURL, Required: true, DefaultText: defaultTextForRequiredFlags},
-			&cli.StringFlag{Name: "odoo-oauth-client-id", Usage: "Client ID of the oauth client to interact with Odoo metered billing API",
-				EnvVars: []string{"ODOO_OAUTH_CLIENT_ID"}, Destination: &odooClientId, Required: true, DefaultText: defaultTextForRequiredFlags},
-			&cli.StringFlag{Name: "odoo-oauth-client-secret", Usage: "Client secret of the oauth client to interact with Odoo metered billing API",
-				EnvVars: []string{"ODOO_OAUTH_CLIENT_SECRET"}, Destination: &odooClientSecret, Required: true, DefaultText: defaultTextForRequiredFlags},
+			controlApiToken.flag(&cli.StringFlag{Name: "control-api-token", Usage: "Token of the APPUiO Cloud Control API",
+				EnvVars: []string{"CONTROL_API_TOKEN"}, DefaultText: defaultTextForOptionalFlags}, false),
+			controlApiToken.fileFlag(),
 			&cli.StringFlag{Name: "appuio-managed-sales-order", Usage: "Sales order for APPUiO Managed clusters",
 				EnvVars: []string{"APPUIO_MANAGED_SALES_ORDER"}, Destination: &salesOrder, Required: false, DefaultText: defaultTextForOptionalFlags},
 			&cli.IntFlag{Name: "collect-interval", Usage: "How often to collect the metrics from the Cloud Service in hours - 1-23",
@@ -73,9 +168,7 @@ func ExoscaleCmds(allMetrics map[string]map[string]prometheus.Counter) *cli.Comm
 				EnvVars: []string{"CLUSTER_ID"}, Destination: &clusterId, Required: true, DefaultText: defaultTextForRequiredFlags},
 			&cli.StringFlag{Name: "cluster-zone", Usage: "The cluster zone to save in the billing record",
 				EnvVars: []string{"CLOUD_ZONE"}, Destination: &cloudZone, Required: false, DefaultText: defaultTextForOptionalFlags},
-			&cli.StringFlag{Name: "uom", Usage: "Unit of measure mapping between cloud services and Odoo16 in json format",
-				EnvVars: []string{"UOM"}, Destination: &uom, Required: true, DefaultText: defaultTextForRequiredFlags},
-		},
+		}, append(append(uomOpts.flags(), schedOpts.flags()...), odooOpts.flags("http://localhost:8080")...)...),
 		Before: addCommandName,
 		Subcommands: []*cli.Command{
 			{
@@ -85,77 +178,28 @@ func ExoscaleCmds(allMetrics map[string]map[string]prometheus.Counter) *cli.Comm
 				Action: func(c *cli.Context) error {
 					logger := log.Logger(c.Context)
 
-					var wg sync.WaitGroup
-					logger.Info("Creating Exoscale client")
-					exoscaleClient, err := exoscale.NewClient(accessKey, secret)
-					if err != nil {
-						return fmt.Errorf("exoscale client: %w", err)
-					}
-
-					logger.Info("Checking UOM mappings")
-					mapping, err := odoo.LoadUOM(uom)
+					location, err := billingLocation(c)
 					if err != nil {
-						return err
+						return configError(err)
 					}
-					err = exoscale.CheckObjectStorageUOMExistence(mapping)
+					o, sink, err := newObjectStorage(c)
 					if err != nil {
-						return err
+						return configError(err)
 					}
-
-					logger.Info("Creating k8s client")
-					k8sClient, err := kubernetes.NewClient(kubeconfig, "", "")
-					if err != nil {
-						return fmt.Errorf("k8s client: %w", err)
-					}
-
-					k8sControlClient, err := kubernetes.NewClient("", controlApiUrl, controlApiToken)
-					if err != nil {
-						return fmt.Errorf("k8s control client: %w", err)
-					}
-
-					odooClient := odoo.NewOdooAPIClient(c.Context, odooURL, odooOauthTokenURL, odooClientId, odooClientSecret, logger, allMetrics["odooMetrics"])
-
 					if collectInterval < 1 || collectInterval > 23 {
 						// Set to run once a day after billingHour in case the collectInterval is out of boundaries
 						collectInterval = 23
 					}
 
-					o, err := exoscale.NewObjectStorage(exoscaleClient, k8sClient, k8sControlClient, salesOrder, clusterId, cloudZone, mapping, allMetrics["providerMetrics"])
-					if err != nil {
-						return fmt.Errorf("objectbucket service: %w", err)
-					}
-
-					wg.Add(1)
-					go func() {
-						for {
-							if time.Now().Hour() >= billingHour {
-
-								logger.Info("Collecting ObjectStorage metrics after", "hour", billingHour)
-
-								metrics, err := o.GetMetrics(c.Context)
-								if err != nil {
-									logger.Error(err, "cannot execute objectstorage collector")
-									wg.Done()
-								}
-								if len(metrics) == 0 {
-									logger.Info("No data to export to odoo")
-									time.Sleep(time.Hour)
-									continue
-								}
-								logger.Info("Exporting data to Odoo", "time", time.Now())
-								err = odooClient.SendData(metrics)
-								if err != nil {
-									logger.Error(err, "cannot export metrics")
-								}
-								time.Sleep(time.Hour * time.Duration(collectInterval))
-							}
-							time.Sleep(time.Hour)
-						}
-					}()
-
-					wg.Wait()
-					os.Exit(1)
-					return nil
+					schedOpts.dryRun = c.Bool("dry-run")
+					return schedOpts.run(c.Context, logger, kubeconfig, collectorJob{
+						name:     jobExoscaleObjectStorage,
+						period:   billing.Day.In(location),
+						target:   billing.Day.In(location).Previous,
+						collect:  o.GetMetrics,
+						sink:     sink,
+						schedule: scheduleOrDefault(configFrom(c.Context).Collectors.Exoscale.ObjectStorage, fmt.Sprintf("every %dh after %02d:00", collectInterval, billingHour)),
+					})
 				},
 			},
 			{
@@ -165,74 +209,84 @@ func ExoscaleCmds(allMetrics map[string]map[string]prometheus.Counter) *cli.Comm
 				Action: func(c *cli.Context) error {
 					logger := log.Logger(c.Context)
 
-					var wg sync.WaitGroup
-					logger.Info("Creating Exoscale client")
-					exoscaleClient, err := exoscale.NewClient(accessKey, secret)
-					if err != nil {
-						return fmt.Errorf("exoscale client: %w", err)
-					}
-
-					logger.Info("Checking UOM mappings")
-					mapping, err := odoo.LoadUOM(uom)
-					if err != nil {
-						return err
-					}
-					err = exoscale.CheckDBaaSUOMExistence(mapping)
-					if err != nil {
-						return err
-					}
-
-					logger.Info("Creating k8s client")
-					k8sClient, err := kubernetes.NewClient(kubeconfig, "", "")
+					location, err := billingLocation(c)
 					if err != nil {
-						return fmt.Errorf("k8s client: %w", err)
+						return configError(err)
 					}
-
-					k8sControlClient, err := kubernetes.NewClient("", controlApiUrl, controlApiToken)
+					d, sink, err := newDBaaS(c)
 					if err != nil {
-						return fmt.Errorf("k8s control client: %w", err)
-					}
-
-					odooClient := odoo.NewOdooAPIClient(c.Context, odooURL, odooOauthTokenURL, odooClientId, odooClientSecret, logger, allMetrics["odooMetrics"])
-
-					if collectInterval < 1 || collectInterval > 24 {
-						// Set to run once a day after billingHour in case the collectInterval is out of boundaries
-						collectInterval = 1
-					}
-
-					d, err := exoscale.NewDBaaS(exoscaleClient, k8sClient, k8sControlClient, collectInterval, salesOrder, clusterId, cloudZone, mapping)
-					if err != nil {
-						return fmt.Errorf("dbaas service: %w", err)
+						return configError(err)
 					}
+					schedOpts.dryRun = c.Bool("dry-run")
+					return schedOpts.run(c.Context, logger, kubeconfig, collectorJob{
+						name:         jobExoscaleDBaaS,
+						period:       billing.Hour.In(location),
+						target:       billing.Hour.In(location).Containing,
+						collect:      d.GetMetrics,
+						parts:        exoscale.Zones,
+						collectParts: d.GetZoneMetrics,
+						sink:         sink,
+						schedule:     scheduleOrDefault(configFrom(c.Context).Collectors.Exoscale.DBaaS, fmt.Sprintf("every %dm", collectInterval)),
+					})
+				},
+			},
+			{
+				Name:   "backfill",
+				Usage:  "Bill past periods, e.g. after an outage. Exoscale only reports current usage, which is only billed for every period with --bill-current-usage",
+				Before: addCommandName,
+				Subcommands: []*cli.Command{
+					{
+						Name:   "objectstorage",
+						Usage:  "Bill the current bucket sizes for every day from --from to --to",
+						Before: addCommandName,
+						Flags:  append(objectStorageBackfill.flags(true), objectStorageBackfill.currentUsageFlag()),
+						Action: func(c *cli.Context) error {
+							logger := log.Logger(c.Context)
 
-					wg.Add(1)
-					go func() {
-						for {
-							logger.Info("Collecting DBaaS metrics")
-							metrics, err := d.GetMetrics(c.Context)
+							if err := objectStorageBackfill.checkCurrentUsage("exoscale"); err != nil {
+								return configError(err)
+							}
+							location, err := billingLocation(c)
 							if err != nil {
-								logger.Error(err, "cannot execute dbaas collector")
-								wg.Done()
+								return configError(err)
 							}
-
-							if len(metrics) == 0 {
-								logger.Info("No data to export to odoo", "time", time.Now())
-								time.Sleep(time.Minute * time.Duration(collectInterval))
-								continue
+							periods, err := objectStorageBackfill.periods(billing.Day.In(location), time.Now())
+							if err != nil {
+								return configError(err)
 							}
-
-							logger.Info("Exporting data to Odoo", "time", time.Now())
-							err = odooClient.SendData(metrics)
+							o, sink, err := newObjectStorage(c)
 							if err != nil {
-								logger.Error(err, "cannot export metrics")
+								return configError(err)
 							}
-							time.Sleep(time.Minute * time.Duration(collectInterval))
-						}
-					}()
+							return objectStorageBackfill.run(c.Context, logger, jobExoscaleObjectStorage, sink, periods, o.GetMetrics)
+						},
+					},
+					{
+						Name:   "dbaas",
+						Usage:  "Bill the current DBaaS instances for every hour from --from to --to",
+						Before: addCommandName,
+						Flags:  append(dbaasBackfill.flags(true), dbaasBackfill.currentUsageFlag()),
+						Action: func(c *cli.Context) error {
+							logger := log.Logger(c.Context)
 
-					wg.Wait()
-					os.Exit(1)
-					return nil
+							if err := dbaasBackfill.checkCurrentUsage("exoscale"); err != nil {
+								return configError(err)
+							}
+							location, err := billingLocation(c)
+							if err != nil {
+								return configError(err)
+							}
+							periods, err := dbaasBackfill.periods(billing.Hour.In(location), time.Now())
+							if err != nil {
+								return configError(err)
+							}
+							d, sink, err := newDBaaS(c)
+							if err != nil {
+								return configError(err)
+							}
+							return dbaasBackfill.run(c.Context, logger, jobExoscaleDBaaS, sink, periods, d.GetMetrics)
+						},
+					},
 				},
 			},
 		},
@@ -0,0 +1,46 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/vshn/billing-collector-cloudservices/pkg/kubernetes"
+	"github.com/vshn/billing-collector-cloudservices/pkg/leader"
+	coordinationv1 "k8s.io/client-go/kubernetes/typed/coordination/v1"
+)
+
+// newElector creates the leader election from the leader election flags, or returns nil if it is disabled.
+// The replicas are told apart by their host name, which is the pod name in Kubernetes.
+// A new leader resumes from the watermark, so it must be in a ConfigMap all replicas share, a file would be local to the pod.
+func (o *scheduleOptions) newElector(logger logr.Logger, kubeconfig string) (*leader.Elector, error) {
+	if o.leaderElectionLease == "" {
+		return nil, nil
+	}
+	namespace, name, ok := strings.Cut(o.leaderElectionLease, "/")
+	if !ok || namespace == "" || name == "" {
+		return nil, fmt.Errorf("flag leader-election-lease: expected namespace/name, got %q", o.leaderElectionLease)
+	}
+	if o.watermarkConfigMap == "" {
+		return nil, fmt.Errorf("flag leader-election-lease: requires watermark-configmap, so that a new leader resumes from the watermark of the previous one")
+	}
+	if o.leaderElectionLeaseDuration < time.Second {
+		return nil, fmt.Errorf("flag leader-election-lease-duration: must be at least 1s, got %s", o.leaderElectionLeaseDuration)
+	}
+	identity, err := os.Hostname()
+	if err != nil {
+		return nil, fmt.Errorf("leader election identity: %w", err)
+	}
+
+	config, err := kubernetes.NewConfig(kubeconfig, "", "")
+	if err != nil {
+		return nil, fmt.Errorf("leader election k8s config: %w", err)
+	}
+	client, err := coordinationv1.NewForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("leader election k8s client: %w", err)
+	}
+	return leader.New(logger, client, namespace, name, identity, o.leaderElectionLeaseDuration), nil
+}
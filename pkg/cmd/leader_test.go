@@ -0,0 +1,43 @@
+package cmd
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScheduleOptions_newElector(t *testing.T) {
+	tests := map[string]struct {
+		options       scheduleOptions
+		expectedError string
+	}{
+		"given no lease, we should get no election": {
+			options: scheduleOptions{watermarkConfigMap: "billing/watermarks"},
+		},
+		"given a lease without watermark, we should get an error": {
+			options:       scheduleOptions{leaderElectionLease: "billing/leader", leaderElectionLeaseDuration: 15 * time.Second},
+			expectedError: "flag leader-election-lease: requires watermark-configmap, so that a new leader resumes from the watermark of the previous one",
+		},
+		"given a lease with a watermark file, we should get an error": {
+			options:       scheduleOptions{leaderElectionLease: "billing/leader", leaderElectionLeaseDuration: 15 * time.Second, watermarkFile: "/data/watermarks.json"},
+			expectedError: "flag leader-election-lease: requires watermark-configmap, so that a new leader resumes from the watermark of the previous one",
+		},
+		"given a lease without namespace, we should get an error": {
+			options:       scheduleOptions{leaderElectionLease: "leader", leaderElectionLeaseDuration: 15 * time.Second, watermarkConfigMap: "billing/watermarks"},
+			expectedError: `flag leader-election-lease: expected namespace/name, got "leader"`,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			elector, err := tc.options.newElector(logr.Discard(), "")
+			if tc.expectedError != "" {
+				assert.EqualError(t, err, tc.expectedError)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Nil(t, elector)
+		})
+	}
+}
@@ -0,0 +1,229 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/urfave/cli/v2"
+	"github.com/vshn/billing-collector-cloudservices/pkg/odoo"
+)
+
+const (
+	sinkOdoo   = "odoo"
+	sinkFile   = "file"
+	sinkStdout = "stdout"
+)
+
+// Defaults of the Odoo flags, also used for the values the config file leaves unset.
+const (
+	defaultSinkFile     = "billing-records.jsonl"
+	defaultBatchSize    = 500
+	defaultAuditMaxSize = 100 << 20
+)
+
+var rejectedRecords = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "billing_cloud_collector_records_rejected_total",
+	Help: "Total number of billing records which were not accepted by Odoo, by collector and product",
+}, []string{"collector", "product"})
+
+// odooOptions holds the flags every command needs to talk to the Odoo metered billing API and to choose where records are sent.
+type odooOptions struct {
+	sinks         string
+	sinkFile      string
+	url           string
+	oauthTokenURL string
+	clientId      string
+	clientSecret  secretOption
+	outboxDir     string
+	retry         odoo.RetryConfig
+	batchSize     int
+	ledgerFile    string
+	forceResend   bool
+	quarantine    string
+	auditDir      string
+	auditMaxSize  int64
+
+	// secretReloadInterval is how often the file of the client secret is re-read, the global secret-reload-interval flag if zero.
+	secretReloadInterval time.Duration
+
+	// client, if set, is shared by the sinks of all collectors instead of creating a client per sink.
+	client *odoo.OdooAPIClient
+}
+
+func (o *odooOptions) flags(defaultURL string) []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{Name: "sink", Usage: "Comma separated list of sinks to send the records to (values: [odoo, file, stdout])",
+			EnvVars: []string{"SINKS"}, Destination: &o.sinks, Value: sinkOdoo},
+		&cli.StringFlag{Name: "sink-file", Usage: "Path to the file the file sink appends records to as JSON lines",
+			EnvVars: []string{"SINK_FILE"}, Destination: &o.sinkFile, Value: defaultSinkFile},
+		&cli.StringFlag{Name: "odoo-url", Usage: "URL of the Odoo Metered Billing API",
+			EnvVars: []string{"ODOO_URL"}, Destination: &o.url, Value: defaultURL},
+		&cli.StringFlag{Name: "odoo-oauth-token-url", Usage: "Oauth Token URL to authenticate with Odoo metered billing API",
+			EnvVars: []string{"ODOO_OAUTH_TOKEN_URL"}, Destination: &o.oauthTokenURL, Required: false, DefaultText: defaultTextForRequiredOdooFlags},
+		&cli.StringFlag{Name: "odoo-oauth-client-id", Usage: "Client ID of the oauth client to interact with Odoo metered billing API",
+			EnvVars: []string{"ODOO_OAUTH_CLIENT_ID"}, Destination: &o.clientId, Required: false, DefaultText: defaultTextForRequiredOdooFlags},
+		o.clientSecret.flag(&cli.StringFlag{Name: "odoo-oauth-client-secret", Usage: "Client secret of the oauth client to interact with Odoo metered billing API",
+			EnvVars: []string{"ODOO_OAUTH_CLIENT_SECRET"}, DefaultText: defaultTextForRequiredOdooFlags}, false),
+		o.clientSecret.fileFlag(),
+		&cli.StringFlag{Name: "outbox-dir", Usage: "Directory where records are kept until Odoo has accepted them, disabled if empty",
+			EnvVars: []string{"OUTBOX_DIR"}, Destination: &o.outboxDir, Required: false, DefaultText: defaultTextForOptionalFlags},
+		&cli.IntFlag{Name: "odoo-max-retries", Usage: "How often to retry sending records to Odoo after rate limits, server or network errors",
+			EnvVars: []string{"ODOO_MAX_RETRIES"}, Destination: &o.retry.MaxRetries, Value: odoo.DefaultRetryConfig.MaxRetries},
+		&cli.DurationFlag{Name: "odoo-retry-backoff", Usage: "Wait time before the first retry, doubled for every further retry",
+			EnvVars: []string{"ODOO_RETRY_BACKOFF"}, Destination: &o.retry.InitialBackoff, Value: odoo.DefaultRetryConfig.InitialBackoff},
+		&cli.DurationFlag{Name: "odoo-retry-max-backoff", Usage: "Upper limit of the wait time between retries",
+			EnvVars: []string{"ODOO_RETRY_MAX_BACKOFF"}, Destination: &o.retry.MaxBackoff, Value: odoo.DefaultRetryConfig.MaxBackoff},
+		&cli.IntFlag{Name: "odoo-batch-size", Usage: "Maximum number of records sent to Odoo in a single request, 0 sends all records at once",
+			EnvVars: []string{"ODOO_BATCH_SIZE"}, Destination: &o.batchSize, Value: defaultBatchSize},
+		&cli.StringFlag{Name: "ledger-file", Usage: "File which remembers every record Odoo has accepted, so that no billing period is sent twice, disabled if empty. With leader election, it must be on a volume all replicas share",
+			EnvVars: []string{"LEDGER_FILE"}, Destination: &o.ledgerFile, Required: false, DefaultText: defaultTextForOptionalFlags},
+		&cli.BoolFlag{Name: "force-resend", Usage: "Send records even if the ledger says Odoo has already accepted them, e.g. for corrections",
+			EnvVars: []string{"FORCE_RESEND"}, Destination: &o.forceResend},
+		&cli.StringFlag{Name: "quarantine-file", Usage: "File where records failing validation are appended as JSON lines with the reasons, only logged if empty",
+			EnvVars: []string{"QUARANTINE_FILE"}, Destination: &o.quarantine, Required: false, DefaultText: defaultTextForOptionalFlags},
+		&cli.StringFlag{Name: "audit-dir", Usage: "Directory of the audit log of every request sent to Odoo, disabled if empty",
+			EnvVars: []string{"AUDIT_DIR"}, Destination: &o.auditDir, Required: false, DefaultText: defaultTextForOptionalFlags},
+		&cli.Int64Flag{Name: "audit-max-size", Usage: "Size in bytes after which the audit log is rotated, 0 disables rotation",
+			EnvVars: []string{"AUDIT_MAX_SIZE"}, Destination: &o.auditMaxSize, Value: defaultAuditMaxSize},
+	}
+}
+
+// newSink creates the sinks selected with the sink flag, behind validation which holds back invalid records.
+// If Odoo is one of the sinks, any records left over in the outbox from previous runs are sent right away.
+// In a dry run, the records are only rendered to stdout in the format given with the global dry-run-format flag,
+// and invalid records are logged but not added to the quarantine file.
+func (o *odooOptions) newSink(c *cli.Context, logger logr.Logger, odooMetrics map[string]prometheus.Counter) (odoo.Sink, error) {
+	return o.newCollectorSink(c, logger, odooMetrics, collectorName(c))
+}
+
+// newCollectorSink is newSink for a collector which is not named after the command, e.g. one of the collectors of the run command.
+func (o *odooOptions) newCollectorSink(c *cli.Context, logger logr.Logger, odooMetrics map[string]prometheus.Counter, collector string) (odoo.Sink, error) {
+	if c.Bool("dry-run") {
+		format, err := odoo.ParseFormat(c.String("dry-run-format"))
+		if err != nil {
+			return nil, fmt.Errorf("dry run: %w", err)
+		}
+		logger.Info("Dry run, records are rendered to stdout instead of being sent", "format", format)
+		return odoo.NewValidatingSink(odoo.NewWriterSink(os.Stdout, format), nil, logger), nil
+	}
+
+	if o.secretReloadInterval == 0 {
+		o.secretReloadInterval = c.Duration("secret-reload-interval")
+	}
+	sink, err := o.newSinks(c.Context, logger, odooMetrics, collector)
+	if err != nil {
+		return nil, err
+	}
+	var quarantine *odoo.Quarantine
+	if o.quarantine != "" {
+		quarantine = odoo.NewQuarantine(o.quarantine)
+	}
+	return odoo.NewValidatingSink(sink, quarantine, logger), nil
+}
+
+func (o *odooOptions) newSinks(ctx context.Context, logger logr.Logger, odooMetrics map[string]prometheus.Counter, collector string) (odoo.Sink, error) {
+	var sinks odoo.MultiSink
+	for _, name := range strings.Split(o.sinks, ",") {
+		switch strings.TrimSpace(name) {
+		case sinkOdoo:
+			if o.client != nil {
+				sinks = append(sinks, o.client.WithCollector(collector))
+				continue
+			}
+			odooClient, err := o.newClient(ctx, logger, odooMetrics, collector)
+			if err != nil {
+				return nil, err
+			}
+			sinks = append(sinks, odooClient)
+		case sinkFile:
+			sinks = append(sinks, odoo.NewFileSink(o.sinkFile))
+		case sinkStdout:
+			sinks = append(sinks, odoo.NewStdoutSink())
+		case "":
+		default:
+			return nil, fmt.Errorf("unknown sink %q, must be one of %s, %s or %s", name, sinkOdoo, sinkFile, sinkStdout)
+		}
+	}
+	switch len(sinks) {
+	case 0:
+		return nil, fmt.Errorf("no sink configured")
+	case 1:
+		return sinks[0], nil
+	}
+	return sinks, nil
+}
+
+// newClient creates the Odoo client and sends any records left over in the outbox from previous runs.
+// Requests are attributed to the collector in the audit log.
+func (o *odooOptions) newClient(ctx context.Context, logger logr.Logger, odooMetrics map[string]prometheus.Counter, collector string) (*odoo.OdooAPIClient, error) {
+	if o.oauthTokenURL == "" || o.clientId == "" || (o.clientSecret.value == "" && o.clientSecret.file == "") {
+		return nil, fmt.Errorf("flags odoo-oauth-token-url, odoo-oauth-client-id and odoo-oauth-client-secret or odoo-oauth-client-secret-file are required for the %s sink", sinkOdoo)
+	}
+	clientSecret, err := o.clientSecret.load(ctx, logger, o.secretReloadInterval)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := []odoo.OdooAPIClientOpt{odoo.WithRetry(o.retry), odoo.WithBatchSize(o.batchSize), odoo.WithClientSecret(clientSecret.Get)}
+	if o.outboxDir != "" {
+		outbox, err := odoo.NewOutbox(o.outboxDir)
+		if err != nil {
+			return nil, fmt.Errorf("odoo outbox: %w", err)
+		}
+		opts = append(opts, odoo.WithOutbox(outbox))
+	}
+	if o.ledgerFile != "" {
+		ledger, err := odoo.OpenLedger(o.ledgerFile)
+		if err != nil {
+			return nil, fmt.Errorf("odoo ledger: %w", err)
+		}
+		opts = append(opts, odoo.WithLedger(ledger), odoo.WithForceResend(o.forceResend))
+	}
+	if o.auditDir != "" {
+		audit, err := odoo.OpenAuditLog(o.auditDir, o.auditMaxSize)
+		if err != nil {
+			return nil, fmt.Errorf("odoo audit log: %w", err)
+		}
+		opts = append(opts, odoo.WithAuditLog(audit, collector))
+	}
+
+	odooClient := odoo.NewOdooAPIClient(ctx, o.url, o.oauthTokenURL, o.clientId, clientSecret.Get(), logger, odooMetrics, opts...)
+	if err := odooClient.FlushOutbox(ctx); err != nil {
+		logger.Error(err, "cannot send pending records from outbox, will retry with the next export")
+	}
+	return odooClient, nil
+}
+
+// reportFailures logs every record Odoo did not accept together with the namespace and the database or bucket
+// it was collected for, and counts it by collector and product.
+func reportFailures(logger logr.Logger, collector string, result *odoo.SendResult) {
+	for _, failure := range result.Failures() {
+		r := failure.Record
+		rejectedRecords.WithLabelValues(collector, r.ProductID).Inc()
+		logger.Info("Record not accepted by Odoo", "reason", failure.Reason, "namespace", namespaceOf(r.ItemGroupDescription),
+			"item", r.ItemDescription, "instance", r.InstanceID, "product", r.ProductID, "salesOrder", r.SalesOrder)
+	}
+}
+
+// collectorName returns the name of the command, e.g. "exoscale dbaas", without the name of the application.
+func collectorName(c *cli.Context) string {
+	var names []string
+	for _, ctx := range c.Lineage() {
+		if ctx.Command != nil && ctx.Command.Name != "" && ctx.Command.Name != c.App.Name {
+			names = append([]string{ctx.Command.Name}, names...)
+		}
+	}
+	return strings.Join(names, " ")
+}
+
+// namespaceOf extracts the namespace from an item group description like "APPUiO Cloud - Zone: ch-gva-2 / Namespace: my-ns".
+func namespaceOf(itemGroup string) string {
+	_, namespace, _ := strings.Cut(itemGroup, "Namespace: ")
+	return namespace
+}
@@ -0,0 +1,77 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/urfave/cli/v2"
+	"github.com/vshn/billing-collector-cloudservices/pkg/log"
+	"github.com/vshn/billing-collector-cloudservices/pkg/odoo/odootest"
+)
+
+// OdooMockCmd serves a local stand-in for the Odoo metered billing API, so that collectors can be run without Odoo.
+func OdooMockCmd() *cli.Command {
+	var (
+		listen       string
+		clientId     string
+		clientSecret string
+		storageFile  string
+		latency      time.Duration
+		errorRate    float64
+		errorStatus  int
+		rateLimit    float64
+	)
+	return &cli.Command{
+		Name:   "odoo-mock",
+		Usage:  "Serve a local stand-in for the Odoo metered billing API",
+		Before: addCommandName,
+		Flags: []cli.Flag{
+			&cli.StringFlag{Name: "listen", Usage: "Address to listen on",
+				EnvVars: []string{"ODOO_MOCK_LISTEN"}, Destination: &listen, Value: ":8080"},
+			&cli.StringFlag{Name: "client-id", Usage: "OAuth client ID the token endpoint accepts",
+				EnvVars: []string{"ODOO_MOCK_CLIENT_ID"}, Destination: &clientId, Value: odootest.DefaultClientID},
+			&cli.StringFlag{Name: "client-secret", Usage: "OAuth client secret the token endpoint accepts",
+				EnvVars: []string{"ODOO_MOCK_CLIENT_SECRET"}, Destination: &clientSecret, Value: odootest.DefaultClientSecret},
+			&cli.StringFlag{Name: "storage-file", Usage: "File to keep the received records in as JSON lines, kept in memory only if empty",
+				EnvVars: []string{"ODOO_MOCK_STORAGE_FILE"}, Destination: &storageFile, Required: false, DefaultText: defaultTextForOptionalFlags},
+			&cli.DurationFlag{Name: "latency", Usage: "Delay of every response",
+				EnvVars: []string{"ODOO_MOCK_LATENCY"}, Destination: &latency},
+			&cli.Float64Flag{Name: "error-rate", Usage: "Share of usage reports to fail on purpose, between 0 and 1",
+				EnvVars: []string{"ODOO_MOCK_ERROR_RATE"}, Destination: &errorRate},
+			&cli.IntFlag{Name: "error-status", Usage: "HTTP status of usage reports failed on purpose",
+				EnvVars: []string{"ODOO_MOCK_ERROR_STATUS"}, Destination: &errorStatus, Value: http.StatusInternalServerError},
+			&cli.Float64Flag{Name: "rate-limit", Usage: "Maximum number of usage reports per second, unlimited if 0",
+				EnvVars: []string{"ODOO_MOCK_RATE_LIMIT"}, Destination: &rateLimit},
+		},
+		Action: func(c *cli.Context) error {
+			logger := log.Logger(c.Context)
+
+			srv, err := odootest.NewServer(
+				odootest.WithClientCredentials(clientId, clientSecret),
+				odootest.WithStorageFile(storageFile),
+				odootest.WithLatency(latency),
+				odootest.WithErrorRate(errorRate, errorStatus),
+				odootest.WithRateLimit(rateLimit),
+			)
+			if err != nil {
+				return err
+			}
+
+			httpSrv := &http.Server{Addr: listen, Handler: srv}
+			go func() {
+				<-c.Context.Done()
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+				_ = httpSrv.Shutdown(ctx)
+			}()
+
+			logger.Info("Serving Odoo stand-in", "listen", listen, "tokenPath", odootest.TokenPath, "usagePath", odootest.UsagePath, "recordsPath", odootest.RecordsPath)
+			if err := httpSrv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				return err
+			}
+			return nil
+		},
+	}
+}
@@ -0,0 +1,361 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/urfave/cli/v2"
+	"github.com/vshn/billing-collector-cloudservices/pkg/billing"
+	"github.com/vshn/billing-collector-cloudservices/pkg/catalog"
+	cs "github.com/vshn/billing-collector-cloudservices/pkg/cloudscale"
+	"github.com/vshn/billing-collector-cloudservices/pkg/config"
+	"github.com/vshn/billing-collector-cloudservices/pkg/exoscale"
+	"github.com/vshn/billing-collector-cloudservices/pkg/kubernetes"
+	"github.com/vshn/billing-collector-cloudservices/pkg/leader"
+	"github.com/vshn/billing-collector-cloudservices/pkg/log"
+	"github.com/vshn/billing-collector-cloudservices/pkg/odoo"
+	"github.com/vshn/billing-collector-cloudservices/pkg/salesorder"
+	"github.com/vshn/billing-collector-cloudservices/pkg/uom"
+	k8s "sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// Default schedules of the collectors of the run command, if the config sets none.
+const (
+	defaultExoscaleObjectStorageSchedule   = "every 24h after 06:00"
+	defaultExoscaleDBaaSSchedule           = "every 15m"
+	defaultCloudscaleObjectStorageSchedule = "every 24h after 06:00"
+)
+
+func RunCmd(allMetrics map[string]map[string]prometheus.Counter) *cli.Command {
+	var (
+		configFile string
+		schedOpts  scheduleOptions
+	)
+
+	return &cli.Command{
+		Name:   "run",
+		Usage:  "Run the collectors enabled in the config file concurrently, sharing the Odoo and Kubernetes clients",
+		Before: addCommandName,
+		Flags: []cli.Flag{
+			&cli.StringFlag{Name: "config", Usage: "Path to the YAML or JSON config file listing the collectors to run, the global config file if empty",
+				EnvVars: []string{"CONFIG"}, Destination: &configFile, Required: false, DefaultText: defaultTextForOptionalFlags},
+			&cli.BoolFlag{Name: "once", Usage: "Bill one period of every collector, flush the outbox and exit instead of running on the schedules",
+				EnvVars: []string{"ONCE"}, Destination: &schedOpts.once},
+			&cli.StringFlag{Name: "period", Usage: "Bill the period containing this date or time (RFC3339, YYYY-MM-DDTHH:MM or YYYY-MM-DD in the billing time zone) for every collector and exit, implies --once",
+				EnvVars: []string{"PERIOD"}, Destination: &schedOpts.period, Required: false, DefaultText: defaultTextForOptionalFlags},
+		},
+		Action: func(c *cli.Context) error {
+			logger := log.Logger(c.Context)
+
+			cfg := configFrom(c.Context)
+			if configFile != "" {
+				var err error
+				if cfg, err = config.Load(configFile); err != nil {
+					return configError(err)
+				}
+			}
+			cfg, err := effectiveConfig(c, cfg)
+			if err != nil {
+				return configError(err)
+			}
+			if err := cfg.Validate(); err != nil {
+				return configError(err)
+			}
+			logger.Info("Starting collectors", "collectors", cfg.Enabled())
+
+			r := &runner{cfg: cfg, allMetrics: allMetrics, schedOpts: &schedOpts, odooOpts: odooOptionsFromConfig(cfg.Odoo)}
+			r.odooOpts.secretReloadInterval = r.secretReloadInterval()
+			jobs, err := r.jobs(c, logger)
+			if err != nil {
+				return configError(err)
+			}
+			schedOpts.dryRun = c.Bool("dry-run")
+			return schedOpts.run(c.Context, logger, cfg.Kubernetes.Kubeconfig, jobs...)
+		},
+	}
+}
+
+// runner creates the jobs of the collectors enabled in the config, with the clients they share.
+type runner struct {
+	cfg        *config.Config
+	allMetrics map[string]map[string]prometheus.Counter
+	schedOpts  *scheduleOptions
+	odooOpts   *odooOptions
+
+	k8sClient        k8s.Client
+	k8sControlClient k8s.Client
+}
+
+// jobs creates the shared clients and a job per enabled collector.
+func (r *runner) jobs(c *cli.Context, logger logr.Logger) ([]collectorJob, error) {
+	cfg := r.cfg
+	r.schedOpts.applyConfig(cfg.Schedule)
+
+	if !c.Bool("dry-run") && slices.Contains(strings.Split(r.odooOpts.sinks, ","), sinkOdoo) {
+		client, err := r.odooOpts.newClient(c.Context, logger, r.allMetrics["odooMetrics"], c.Command.Name)
+		if err != nil {
+			return nil, err
+		}
+		r.odooOpts.client = client
+	}
+
+	exo, cloudscaleCfg, spks := cfg.Collectors.Exoscale, cfg.Collectors.Cloudscale, cfg.Collectors.SPKS
+	if exo.ObjectStorage.Enabled || exo.DBaaS.Enabled || cloudscaleCfg.ObjectStorage.Enabled || cfg.Schedule.WatermarkConfigMap != "" {
+		logger.Info("Creating k8s client")
+		var err error
+		if r.k8sClient, err = kubernetes.NewClient(cfg.Kubernetes.Kubeconfig, "", ""); err != nil {
+			return nil, fmt.Errorf("k8s client: %w", err)
+		}
+		r.schedOpts.kubeClient = r.k8sClient
+	}
+	if exo.ObjectStorage.Enabled || exo.DBaaS.Enabled || cloudscaleCfg.ObjectStorage.Enabled {
+		var err error
+		token := &secretOption{name: "controlAPI.token", fileName: "controlAPI.tokenFile", value: cfg.ControlAPI.Token, file: cfg.ControlAPI.TokenFile}
+		if r.k8sControlClient, err = newControlAPIClient(cfg.ControlAPI.URL, token); err != nil {
+			return nil, fmt.Errorf("k8s control client: %w", err)
+		}
+	}
+
+	timezone := cfg.BillingTimezone
+	if timezone == "" {
+		timezone = c.String("billing-timezone")
+	}
+	location, err := billing.LoadLocation(timezone)
+	if err != nil {
+		return nil, err
+	}
+	hour, day := billing.Hour.In(location), billing.Day.In(location)
+
+	catalogFile := cfg.ProductCatalog
+	if catalogFile == "" {
+		catalogFile = c.String("product-catalog")
+	}
+	products, err := catalog.Load(catalogFile)
+	if err != nil {
+		return nil, err
+	}
+
+	rulesFile := cfg.SalesOrderRules
+	if rulesFile == "" {
+		rulesFile = c.String("sales-order-rules")
+	}
+	rules, err := salesorder.Load(rulesFile)
+	if err != nil {
+		return nil, err
+	}
+	salesOrders := salesorder.NewResolver(rules, cfg.Cluster.SalesOrder, r.k8sClient, r.k8sControlClient)
+
+	// one mapping for all collectors, which must map the units of every one of them
+	var units []string
+	if exo.ObjectStorage.Enabled {
+		units = append(units, exoscale.ObjectStorageUnits...)
+	}
+	if exo.DBaaS.Enabled {
+		units = append(units, exoscale.DBaaSUnits...)
+	}
+	if cloudscaleCfg.ObjectStorage.Enabled {
+		units = append(units, cs.Units...)
+	}
+	var mapping *uom.Mapping
+	if len(units) > 0 {
+		uomOpts, err := uomOptionsFromConfig(cfg)
+		if err != nil {
+			return nil, err
+		}
+		if mapping, err = uomOpts.load(c.Context, logger, r.k8sClient, units...); err != nil {
+			return nil, err
+		}
+	}
+
+	var jobs []collectorJob
+	if exo.ObjectStorage.Enabled || exo.DBaaS.Enabled {
+		logger.Info("Creating Exoscale client")
+		accessKey := &secretOption{name: "collectors.exoscale.accessKey", fileName: "collectors.exoscale.accessKeyFile", required: true, value: exo.AccessKey, file: exo.AccessKeyFile}
+		secretKey := &secretOption{name: "collectors.exoscale.secret", fileName: "collectors.exoscale.secretFile", required: true, value: exo.Secret, file: exo.SecretFile}
+		exoscaleClient, err := newExoscaleClient(c.Context, logger, accessKey, secretKey, r.secretReloadInterval())
+		if err != nil {
+			return nil, fmt.Errorf("exoscale client: %w", err)
+		}
+		if exo.ObjectStorage.Enabled {
+			o, err := exoscale.NewObjectStorage(exoscaleClient, r.k8sClient, salesOrders, cfg.Cluster.ID, cfg.Cluster.Zone, mapping, products, r.allMetrics["providerMetrics"])
+			if err != nil {
+				return nil, fmt.Errorf("objectbucket service: %w", err)
+			}
+			sink, err := r.sink(c, logger, "exoscale objectstorage")
+			if err != nil {
+				return nil, err
+			}
+			jobs = append(jobs, collectorJob{
+				name:     jobExoscaleObjectStorage,
+				period:   day,
+				target:   day.Previous,
+				collect:  o.GetMetrics,
+				sink:     sink,
+				schedule: scheduleOrDefault(exo.ObjectStorage, defaultExoscaleObjectStorageSchedule),
+			})
+		}
+		if exo.DBaaS.Enabled {
+			d, err := exoscale.NewDBaaS(exoscaleClient, r.k8sClient, 1, salesOrders, cfg.Cluster.ID, cfg.Cluster.Zone, mapping, products)
+			if err != nil {
+				return nil, fmt.Errorf("dbaas service: %w", err)
+			}
+			sink, err := r.sink(c, logger, "exoscale dbaas")
+			if err != nil {
+				return nil, err
+			}
+			jobs = append(jobs, collectorJob{
+				name:         jobExoscaleDBaaS,
+				period:       hour,
+				target:       hour.Containing,
+				collect:      d.GetMetrics,
+				parts:        exoscale.Zones,
+				collectParts: d.GetZoneMetrics,
+				sink:         sink,
+				schedule:     scheduleOrDefault(exo.DBaaS, defaultExoscaleDBaaSSchedule),
+			})
+		}
+	}
+
+	if cloudscaleCfg.ObjectStorage.Enabled {
+		logger.Info("Creating cloudscale client")
+		apiToken := &secretOption{name: "collectors.cloudscale.apiToken", fileName: "collectors.cloudscale.apiTokenFile", required: true, value: cloudscaleCfg.APIToken, file: cloudscaleCfg.APITokenFile}
+		cloudscaleClient, err := newCloudscaleClient(c.Context, logger, apiToken, r.secretReloadInterval())
+		if err != nil {
+			return nil, fmt.Errorf("cloudscale client: %w", err)
+		}
+		o, err := cs.NewObjectStorage(cloudscaleClient, r.k8sClient, salesOrders, cfg.Cluster.ID, cfg.Cluster.Zone, mapping, products, r.allMetrics["providerMetrics"])
+		if err != nil {
+			return nil, fmt.Errorf("object storage: %w", err)
+		}
+		sink, err := r.sink(c, logger, "cloudscale")
+		if err != nil {
+			return nil, err
+		}
+		days := 1
+		if cloudscaleCfg.Days != nil {
+			days = *cloudscaleCfg.Days
+		}
+		jobs = append(jobs, cloudscaleObjectStorageJob(logger.WithName("cloudscale"), o, sink, days, day,
+			scheduleOrDefault(cloudscaleCfg.ObjectStorage, defaultCloudscaleObjectStorageSchedule)))
+	}
+
+	if spks.Enabled {
+		sink, err := r.sink(c, logger, "spks")
+		if err != nil {
+			return nil, err
+		}
+		job := spksJob(logger.WithName("spks"), r.allMetrics, products, spks.PrometheusURL, spks.SalesOrder, spks.UnitID, day, sink)
+		job.schedule = scheduleOrDefault(spks.Collector, job.schedule)
+		jobs = append(jobs, job)
+	}
+	return jobs, nil
+}
+
+// secretReloadInterval returns how often the files of secrets are re-read, the default of the flag if the config sets none.
+func (r *runner) secretReloadInterval() time.Duration {
+	if r.cfg.SecretReloadInterval != 0 {
+		return time.Duration(r.cfg.SecretReloadInterval)
+	}
+	return defaultSecretReloadInterval
+}
+
+// sink creates the sink of a collector. Requests to Odoo are attributed to the collector in the audit log.
+func (r *runner) sink(c *cli.Context, logger logr.Logger, collector string) (odoo.Sink, error) {
+	return r.odooOpts.newCollectorSink(c, logger, r.allMetrics["odooMetrics"], collector)
+}
+
+func scheduleOrDefault(collector config.Collector, fallback string) string {
+	if collector.Schedule != "" {
+		return collector.Schedule
+	}
+	return fallback
+}
+
+// odooOptionsFromConfig returns the Odoo options of the config, with the defaults of the flags for unset values.
+func odooOptionsFromConfig(cfg config.Odoo) *odooOptions {
+	o := &odooOptions{
+		sinks:         sinkOdoo,
+		sinkFile:      defaultSinkFile,
+		url:           cfg.URL,
+		oauthTokenURL: cfg.OAuthTokenURL,
+		clientId:      cfg.ClientID,
+		clientSecret:  secretOption{name: "odoo.clientSecret", fileName: "odoo.clientSecretFile", value: cfg.ClientSecret, file: cfg.ClientSecretFile},
+		outboxDir:     cfg.OutboxDir,
+		retry:         odoo.DefaultRetryConfig,
+		batchSize:     defaultBatchSize,
+		ledgerFile:    cfg.LedgerFile,
+		quarantine:    cfg.QuarantineFile,
+		auditDir:      cfg.AuditDir,
+		auditMaxSize:  defaultAuditMaxSize,
+	}
+	if len(cfg.Sinks) > 0 {
+		o.sinks = strings.Join(cfg.Sinks, ",")
+	}
+	if cfg.SinkFile != "" {
+		o.sinkFile = cfg.SinkFile
+	}
+	if cfg.MaxRetries != nil {
+		o.retry.MaxRetries = *cfg.MaxRetries
+	}
+	if cfg.RetryBackoff != 0 {
+		o.retry.InitialBackoff = time.Duration(cfg.RetryBackoff)
+	}
+	if cfg.RetryMaxBackoff != 0 {
+		o.retry.MaxBackoff = time.Duration(cfg.RetryMaxBackoff)
+	}
+	if cfg.BatchSize != nil {
+		o.batchSize = *cfg.BatchSize
+	}
+	if cfg.AuditMaxSize != nil {
+		o.auditMaxSize = *cfg.AuditMaxSize
+	}
+	return o
+}
+
+// uomOptionsFromConfig returns the UOM options of the config, with the defaults of the flags for unset values.
+func uomOptionsFromConfig(cfg *config.Config) (*uomOptions, error) {
+	o := &uomOptions{
+		file:           cfg.UOMFile,
+		configMap:      cfg.UOMConfigMap,
+		reloadInterval: defaultUOMReloadInterval,
+	}
+	if len(cfg.UOM) > 0 {
+		data, err := json.Marshal(cfg.UOM)
+		if err != nil {
+			return nil, err
+		}
+		o.uom = string(data)
+	}
+	if cfg.UOMReloadInterval != 0 {
+		o.reloadInterval = time.Duration(cfg.UOMReloadInterval)
+	}
+	return o, nil
+}
+
+// applyConfig sets the schedule options from the config, with the defaults of the flags for unset values.
+func (o *scheduleOptions) applyConfig(cfg config.Schedule) {
+	o.timezone = billing.DefaultTimezone
+	if cfg.Timezone != "" {
+		o.timezone = cfg.Timezone
+	}
+	o.gracePeriod = defaultGracePeriod
+	if cfg.ShutdownGracePeriod != 0 {
+		o.gracePeriod = time.Duration(cfg.ShutdownGracePeriod)
+	}
+	o.maxCatchUp = defaultMaxCatchUp
+	if cfg.MaxCatchUp != 0 {
+		o.maxCatchUp = time.Duration(cfg.MaxCatchUp)
+	}
+	o.watermarkFile = cfg.WatermarkFile
+	o.watermarkConfigMap = cfg.WatermarkConfigMap
+	o.leaderElectionLease = cfg.LeaderElectionLease
+	o.leaderElectionLeaseDuration = leader.DefaultLeaseDuration
+	if cfg.LeaderElectionLeaseDuration != 0 {
+		o.leaderElectionLeaseDuration = time.Duration(cfg.LeaderElectionLeaseDuration)
+	}
+}
@@ -0,0 +1,229 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/urfave/cli/v2"
+	"github.com/vshn/billing-collector-cloudservices/pkg/billing"
+	"github.com/vshn/billing-collector-cloudservices/pkg/leader"
+	"github.com/vshn/billing-collector-cloudservices/pkg/odoo"
+	"github.com/vshn/billing-collector-cloudservices/pkg/scheduler"
+	k8s "sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// Defaults of the schedule flags, also used for the values the config file leaves unset.
+const (
+	defaultGracePeriod = time.Minute
+	defaultMaxCatchUp  = 7 * 24 * time.Hour
+)
+
+// scheduleOptions holds the flags which control when a collector runs.
+type scheduleOptions struct {
+	spec        string
+	timezone    string
+	gracePeriod time.Duration
+	once        bool
+	period      string
+
+	watermarkFile      string
+	watermarkConfigMap string
+	maxCatchUp         time.Duration
+
+	leaderElectionLease         string
+	leaderElectionLeaseDuration time.Duration
+
+	// kubeClient, if set, is used for the watermark ConfigMap instead of a client created from the kubeconfig.
+	kubeClient k8s.Client
+	// dryRun is the global dry-run flag. A dry run reads the watermark but never moves it, as nothing is billed.
+	dryRun bool
+}
+
+func (o *scheduleOptions) flags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{Name: "schedule", Usage: "When to collect, as cron expression or \"every <duration> [after HH:MM]\", e.g. \"every 6h after 06:00\", derived from the interval flags if empty",
+			EnvVars: []string{"SCHEDULE"}, Destination: &o.spec, Required: false, DefaultText: defaultTextForOptionalFlags},
+		&cli.StringFlag{Name: "timezone", Usage: "Time zone the schedule is evaluated in",
+			EnvVars: []string{"TIMEZONE"}, Destination: &o.timezone, Value: billing.DefaultTimezone},
+		&cli.DurationFlag{Name: "shutdown-grace-period", Usage: "How long a running collection and export may take to finish after SIGTERM before it is cancelled",
+			EnvVars: []string{"SHUTDOWN_GRACE_PERIOD"}, Destination: &o.gracePeriod, Value: defaultGracePeriod},
+		&cli.BoolFlag{Name: "once", Usage: "Bill one period, flush the outbox and exit instead of running on the schedule, e.g. in a CronJob",
+			EnvVars: []string{"ONCE"}, Destination: &o.once},
+		&cli.StringFlag{Name: "period", Usage: "Bill the period containing this date or time (RFC3339, YYYY-MM-DDTHH:MM or YYYY-MM-DD in the billing time zone) and exit, implies --once",
+			EnvVars: []string{"PERIOD"}, Destination: &o.period, Required: false, DefaultText: defaultTextForOptionalFlags},
+		&cli.StringFlag{Name: "watermark-file", Usage: "File to keep the end of the last billed period in, so that periods missed while down are billed on startup",
+			EnvVars: []string{"WATERMARK_FILE"}, Destination: &o.watermarkFile, Required: false, DefaultText: defaultTextForOptionalFlags},
+		&cli.StringFlag{Name: "watermark-configmap", Usage: "ConfigMap as namespace/name to keep the end of the last billed period in, as annotation, instead of a file",
+			EnvVars: []string{"WATERMARK_CONFIGMAP"}, Destination: &o.watermarkConfigMap, Required: false, DefaultText: defaultTextForOptionalFlags},
+		&cli.DurationFlag{Name: "max-catch-up", Usage: "How far back missed periods are billed, older ones need a backfill",
+			EnvVars: []string{"MAX_CATCH_UP"}, Destination: &o.maxCatchUp, Value: defaultMaxCatchUp},
+		&cli.StringFlag{Name: "leader-election-lease", Usage: "Lease as namespace/name which the replicas compete for, only the holder runs the scheduled collections, disabled if empty. Requires --watermark-configmap",
+			EnvVars: []string{"LEADER_ELECTION_LEASE"}, Destination: &o.leaderElectionLease, Required: false, DefaultText: defaultTextForOptionalFlags},
+		&cli.DurationFlag{Name: "leader-election-lease-duration", Usage: "How long the standby replicas wait before they take over from a leader which stopped renewing the lease",
+			EnvVars: []string{"LEADER_ELECTION_LEASE_DURATION"}, Destination: &o.leaderElectionLeaseDuration, Value: leader.DefaultLeaseDuration},
+	}
+}
+
+// schedule parses the schedule flag, or the fallback if the flag is empty.
+func (o *scheduleOptions) schedule(fallback string) (scheduler.Schedule, error) {
+	loc, err := time.LoadLocation(o.timezone)
+	if err != nil {
+		return nil, fmt.Errorf("timezone: %w", err)
+	}
+	spec := o.spec
+	if spec == "" {
+		spec = fallback
+	}
+	return scheduler.Parse(spec, loc)
+}
+
+// newScheduler creates a scheduler which lets running jobs finish within the grace period on shutdown.
+func (o *scheduleOptions) newScheduler(logger logr.Logger) *scheduler.Scheduler {
+	return scheduler.New(logger, scheduler.WithGracePeriod(o.gracePeriod))
+}
+
+// collectorJob is what a collector bills.
+type collectorJob struct {
+	name   string
+	period billing.Period
+	// target returns the period a run at the given time bills.
+	target  func(now time.Time) odoo.TimeRange
+	collect collectFunc
+	// parts are the parts of a period which can fail on their own, e.g. zones, and collectParts collects some of them.
+	// With a watermark, a part which failed is collected again on its own. Both are optional.
+	parts        []string
+	collectParts collectPartsFunc
+	sink         odoo.Sink
+	// schedule is used if the schedule flag is empty.
+	schedule string
+}
+
+// run bills the periods of the jobs on their schedules until the context is cancelled or a job fails fatally.
+// The jobs run concurrently, each on the schedule flag or its own schedule. On startup, a job without watermark
+// bills its period right away if its schedule has already run today.
+// With the once or period flag, every job bills a single period instead, flushes the outbox and returns.
+// If a watermark is configured, the periods missed before are billed first, except for an explicit period.
+// With leader election, only the replica holding the lease runs the schedules.
+func (o *scheduleOptions) run(ctx context.Context, logger logr.Logger, kubeconfig string, jobs ...collectorJob) error {
+	var err error
+	watermarks := make([]*collectorWatermark, len(jobs))
+	for i, job := range jobs {
+		if watermarks[i], err = o.newWatermark(kubeconfig, job.name, job.period); err != nil {
+			return configError(err)
+		}
+		watermarks[i].parts, watermarks[i].collectParts = job.parts, job.collectParts
+	}
+
+	if o.period != "" {
+		periods := make([]odoo.TimeRange, len(jobs))
+		for i, job := range jobs {
+			t, err := parseDateFlag("period", o.period, job.period.Location())
+			if err != nil {
+				return configError(err)
+			}
+			periods[i] = job.period.Containing(t)
+		}
+		return forEachJob(jobs, func(i int, job collectorJob) error {
+			err := billPeriod(ctx, logger.WithValues("job", job.name), job.name, job.sink, periods[i], job.collect)
+			return errors.Join(err, flush(ctx, job.sink))
+		})
+	}
+	if o.dryRun && (o.watermarkFile != "" || o.watermarkConfigMap != "") {
+		logger.Info("Dry run, the watermark is not moved")
+	}
+	if o.once {
+		return forEachJob(jobs, func(i int, job collectorJob) error {
+			err := watermarks[i].bill(ctx, logger.WithValues("job", job.name), job.sink, job.target(time.Now()), job.collect)
+			return errors.Join(err, flush(ctx, job.sink))
+		})
+	}
+
+	schedules := make([]scheduler.Schedule, len(jobs))
+	for i, job := range jobs {
+		if schedules[i], err = o.schedule(job.schedule); err != nil {
+			return configError(fmt.Errorf("job %s: %w", job.name, err))
+		}
+	}
+	elector, err := o.newElector(logger, kubeconfig)
+	if err != nil {
+		return configError(err)
+	}
+
+	scheduled := func(ctx context.Context) error {
+		now := time.Now()
+		err := forEachJob(jobs, func(i int, job collectorJob) error {
+			logger := logger.WithValues("job", job.name)
+			if watermarks[i].store == nil {
+				return billOnStartup(ctx, logger, job, schedules[i], now)
+			}
+			return watermarks[i].catchUp(ctx, logger, job.sink, now, job.collect)
+		})
+		if err != nil {
+			return err
+		}
+		s := o.newScheduler(logger)
+		for i, job := range jobs {
+			wm, logger := watermarks[i], logger.WithValues("job", job.name)
+			err := s.Register(job.name, schedules[i], func(ctx context.Context) error {
+				return wm.bill(ctx, logger, job.sink, job.target(time.Now()), job.collect)
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return s.Run(ctx)
+	}
+	if elector == nil {
+		return scheduled(ctx)
+	}
+	// a new leader catches up from the watermark the previous one left, so that no period is billed twice
+	return elector.Run(ctx, scheduled)
+}
+
+// billOnStartup bills the target period of the job right away if its schedule has already been active today, as the collectors
+// did before they ran on schedules, so that a restart without watermark does not skip the run of the day.
+// Errors are logged and the period is billed again at the next activation, only fatal errors are returned.
+func billOnStartup(ctx context.Context, logger logr.Logger, job collectorJob, schedule scheduler.Schedule, now time.Time) error {
+	today := billing.Day.In(job.period.Location()).Start(now)
+	if schedule.Next(today.Add(-time.Nanosecond)).After(now) {
+		return nil
+	}
+	logger.Info("Billing on startup, as the schedule has already been active today")
+	err := billPeriod(ctx, logger, job.name, job.sink, job.target(now), job.collect)
+	if err != nil && !scheduler.IsFatal(err) {
+		logger.Error(err, "Cannot bill on startup, will retry at the next run")
+		return nil
+	}
+	return err
+}
+
+// forEachJob calls f for every job concurrently and joins the errors.
+func forEachJob(jobs []collectorJob, f func(i int, job collectorJob) error) error {
+	errs := make([]error, len(jobs))
+	var wg sync.WaitGroup
+	for i, job := range jobs {
+		wg.Add(1)
+		go func(i int, job collectorJob) {
+			defer wg.Done()
+			errs[i] = f(i, job)
+		}(i, job)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// flush delivers the records left in the outbox, if the sink has one.
+func flush(ctx context.Context, sink odoo.Sink) error {
+	f, ok := sink.(odoo.Flusher)
+	if !ok {
+		return nil
+	}
+	if err := f.FlushOutbox(ctx); err != nil {
+		return deliveryError(fmt.Errorf("flush outbox: %w", err))
+	}
+	return nil
+}
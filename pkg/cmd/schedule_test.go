@@ -0,0 +1,84 @@
+package cmd
+
+import (
+	"context"
+	"io"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vshn/billing-collector-cloudservices/pkg/odoo"
+	"github.com/vshn/billing-collector-cloudservices/pkg/scheduler"
+	"github.com/vshn/billing-collector-cloudservices/pkg/watermark"
+)
+
+func TestScheduleOptions_run(t *testing.T) {
+	tests := map[string]struct {
+		dryRun            bool
+		expectedWatermark time.Time
+	}{
+		"given a run with --once, we should catch up and move the watermark": {
+			expectedWatermark: date(10),
+		},
+		"given a dry run with --once, we should catch up but leave the watermark": {
+			dryRun:            true,
+			expectedWatermark: date(7),
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "watermarks.json")
+			require.NoError(t, watermark.NewFileStore(path).Save(context.Background(), testJob, date(7)))
+			collect, collected := collectRecords(nil, nil)
+
+			o := &scheduleOptions{once: true, dryRun: tc.dryRun, watermarkFile: path, maxCatchUp: defaultMaxCatchUp}
+			err := o.run(context.Background(), logr.Discard(), "", collectorJob{
+				name:    testJob,
+				period:  testDay,
+				target:  func(time.Time) odoo.TimeRange { return testDay.Containing(date(9)) },
+				collect: collect,
+				sink:    odoo.NewWriterSink(io.Discard, odoo.FormatTable),
+			})
+			require.NoError(t, err)
+			assert.Equal(t, daysOf(7, 10), *collected)
+			last, err := watermark.NewFileStore(path).Load(context.Background(), testJob)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedWatermark, last)
+		})
+	}
+}
+
+func TestBillOnStartup(t *testing.T) {
+	schedule := scheduler.EveryAfter{Interval: 23 * time.Hour, Start: 6 * time.Hour, Location: time.UTC}
+
+	tests := map[string]struct {
+		now               time.Time
+		expectedCollected []odoo.TimeRange
+	}{
+		"given a start after the first activation of the day, we should bill the target period": {
+			now:               time.Date(2024, 3, 10, 6, 30, 0, 0, time.UTC),
+			expectedCollected: daysOf(9, 10),
+		},
+		"given a start before the first activation of the day, we should bill nothing": {
+			now: time.Date(2024, 3, 10, 5, 59, 0, 0, time.UTC),
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			collect, collected := collectRecords(nil, nil)
+
+			err := billOnStartup(context.Background(), logr.Discard(), collectorJob{
+				name:    testJob,
+				period:  testDay,
+				target:  testDay.Previous,
+				collect: collect,
+				sink:    odoo.NewWriterSink(io.Discard, odoo.FormatTable),
+			}, schedule, tc.now)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedCollected, *collected)
+		})
+	}
+}
@@ -0,0 +1,111 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/cloudscale-ch/cloudscale-go-sdk/v2"
+	egoscale "github.com/exoscale/egoscale/v2"
+	"github.com/go-logr/logr"
+	"github.com/urfave/cli/v2"
+	"github.com/vshn/billing-collector-cloudservices/pkg/exoscale"
+	"github.com/vshn/billing-collector-cloudservices/pkg/kubernetes"
+	"github.com/vshn/billing-collector-cloudservices/pkg/secret"
+	k8s "sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const defaultSecretReloadInterval = time.Minute
+
+// secretOption holds a secret given with a flag, or the file to read it from given with the -file variant of the flag.
+type secretOption struct {
+	// name and fileName name the flags or config fields of the secret and its file in errors
+	name     string
+	fileName string
+	required bool
+	envVars  []string
+	value    string
+	file     string
+}
+
+// flag sets up the flag of the secret. A required secret may be given with either the flag or its -file variant, see fileFlag.
+func (o *secretOption) flag(flag *cli.StringFlag, required bool) cli.Flag {
+	o.name, o.fileName, o.required, o.envVars = flag.Name, flag.Name+"-file", required, flag.EnvVars
+	flag.Destination, flag.Required = &o.value, false
+	if required {
+		flag.DefaultText = fmt.Sprintf("<required unless %s-file is set>", o.name)
+	}
+	return flag
+}
+
+// fileFlag returns the -file variant of the flag set up with flag, whose environment variables have the suffix _FILE.
+func (o *secretOption) fileFlag() cli.Flag {
+	var envVars []string
+	for _, env := range o.envVars {
+		envVars = append(envVars, env+"_FILE")
+	}
+	return &cli.StringFlag{Name: o.fileName, Usage: fmt.Sprintf("File to read the %s from instead, re-read when it changes", o.name),
+		EnvVars: envVars, Destination: &o.file, Required: false, DefaultText: defaultTextForOptionalFlags}
+}
+
+// load returns the secret. A secret read from a file is re-read every interval until the context is done.
+func (o *secretOption) load(ctx context.Context, logger logr.Logger, interval time.Duration) (*secret.Secret, error) {
+	switch {
+	case o.value != "" && o.file != "":
+		return nil, configError(fmt.Errorf("%s and %s are mutually exclusive", o.name, o.fileName))
+	case o.file != "":
+		if interval <= 0 {
+			return nil, configError(fmt.Errorf("flag secret-reload-interval must be positive, got %s", interval))
+		}
+		s, err := secret.FromFile(o.name, o.file)
+		if err != nil {
+			return nil, configError(err)
+		}
+		go s.Watch(ctx, logger.WithName("secret"), interval)
+		return s, nil
+	case o.value == "" && o.required:
+		return nil, configError(fmt.Errorf("%s or %s is required", o.name, o.fileName))
+	}
+	return secret.Value(o.name, o.value), nil
+}
+
+// newExoscaleClient creates the Exoscale client, which is rebuilt when the access key or secret changes.
+func newExoscaleClient(ctx context.Context, logger logr.Logger, accessKey, secretKey *secretOption, interval time.Duration) (*secret.Client[egoscale.Client], error) {
+	key, err := accessKey.load(ctx, logger, interval)
+	if err != nil {
+		return nil, err
+	}
+	sec, err := secretKey.load(ctx, logger, interval)
+	if err != nil {
+		return nil, err
+	}
+	return secret.NewClient(logger.WithName("exoscale"), func() (*egoscale.Client, error) {
+		return exoscale.NewClient(key.Get(), sec.Get())
+	}, key, sec)
+}
+
+// newCloudscaleClient creates the cloudscale client, which is rebuilt when the API token changes.
+func newCloudscaleClient(ctx context.Context, logger logr.Logger, apiToken *secretOption, interval time.Duration) (*secret.Client[cloudscale.Client], error) {
+	token, err := apiToken.load(ctx, logger, interval)
+	if err != nil {
+		return nil, err
+	}
+	return secret.NewClient(logger.WithName("cloudscale"), func() (*cloudscale.Client, error) {
+		client := cloudscale.NewClient(http.DefaultClient)
+		client.AuthToken = token.Get()
+		return client, nil
+	}, token)
+}
+
+// newControlAPIClient creates the client of the APPUiO Cloud Control API.
+// A token file is re-read by the client itself, see kubernetes.NewClientWithTokenFile.
+func newControlAPIClient(url string, token *secretOption) (k8s.Client, error) {
+	if token.value != "" && token.file != "" {
+		return nil, configError(fmt.Errorf("%s and %s are mutually exclusive", token.name, token.fileName))
+	}
+	if token.file != "" {
+		return kubernetes.NewClientWithTokenFile(url, token.file)
+	}
+	return kubernetes.NewClient("", url, token.value)
+}
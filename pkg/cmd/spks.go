@@ -2,6 +2,7 @@ package cmd
 
 import (
 	"context"
+	"fmt"
 
 	"time"
 
@@ -11,8 +12,11 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/model"
 	"github.com/urfave/cli/v2"
+	"github.com/vshn/billing-collector-cloudservices/pkg/billing"
+	"github.com/vshn/billing-collector-cloudservices/pkg/catalog"
 	"github.com/vshn/billing-collector-cloudservices/pkg/log"
 	"github.com/vshn/billing-collector-cloudservices/pkg/odoo"
+	"github.com/vshn/billing-collector-cloudservices/pkg/scheduler"
 )
 
 var (
@@ -22,31 +26,22 @@ var (
 		"count(max_over_time(crossplane_resource_info{kind=\"compositeredisinstances\", service_level=\"standard\"}[1d:1d]))",
 		"count(max_over_time(crossplane_resource_info{kind=\"compositeredisinstances\", service_level=\"premium\"}[1d:1d]))",
 	}
-	odooURL           string
-	odooOauthTokenURL string
-	odooClientId      string
-	odooClientSecret  string
-	salesOrder        string
-	prometheusURL     string
-	UnitID            string
-	days              int
+	spksOdooOpts  odooOptions
+	spksSchedOpts scheduleOptions
+	spksBackfill  backfillOptions
+	salesOrder    string
+	prometheusURL string
+	UnitID        string
+	days          int
 )
 
-func SpksCMD(allMetrics map[string]map[string]prometheus.Counter, ctx context.Context) *cli.Command {
+func SpksCMD(allMetrics map[string]map[string]prometheus.Counter) *cli.Command {
 
 	return &cli.Command{
 		Name:   "spks",
 		Usage:  "Collect metrics from spks.",
 		Before: addCommandName,
-		Flags: []cli.Flag{
-			&cli.StringFlag{Name: "odoo-url", Usage: "URL of the Odoo Metered Billing API",
-				EnvVars: []string{"ODOO_URL"}, Destination: &odooURL, Value: "https://preprod.central.vshn.ch/api/v2/product_usage_report_POST"},
-			&cli.StringFlag{Name: "odoo-oauth-token-url", Usage: "Oauth Token URL to authenticate with Odoo metered billing API",
-				EnvVars: []string{"ODOO_OAUTH_TOKEN_URL"}, Destination: &odooOauthTokenURL, Required: true, DefaultText: defaultTextForRequiredFlags},
-			&cli.StringFlag{Name: "odoo-oauth-client-id", Usage: "Client ID of the oauth client to interact with Odoo metered billing API",
-				EnvVars: []string{"ODOO_OAUTH_CLIENT_ID"}, Destination: &odooClientId, Required: true, DefaultText: defaultTextForRequiredFlags},
-			&cli.StringFlag{Name: "odoo-oauth-client-secret", Usage: "Client secret of the oauth client to interact with Odoo metered billing API",
-				EnvVars: []string{"ODOO_OAUTH_CLIENT_SECRET"}, Destination: &odooClientSecret, Required: true, DefaultText: defaultTextForRequiredFlags},
+		Flags: append([]cli.Flag{
 			&cli.StringFlag{Name: "sales-order", Usage: "Sales order to report billing data to",
 				EnvVars: []string{"SALES_ORDER"}, Destination: &salesOrder, Required: false, DefaultText: defaultTextForOptionalFlags, Value: "S10121"},
 			&cli.StringFlag{Name: "prometheus-url", Usage: "URL of the Prometheus API",
@@ -55,117 +50,145 @@ func SpksCMD(allMetrics map[string]map[string]prometheus.Counter, ctx context.Co
 				EnvVars: []string{"UNIT_ID"}, Destination: &UnitID, Required: false, DefaultText: defaultTextForRequiredFlags, Value: "uom_uom_68_b1811ca1"},
 			&cli.IntFlag{Name: "days", Usage: "Days of metrics to fetch since today, set to 0 to get current metrics",
 				EnvVars: []string{"DAYS"}, Destination: &days, Value: 0, Required: false, DefaultText: defaultTextForOptionalFlags},
-		},
+		}, append(spksSchedOpts.flags(), spksOdooOpts.flags("https://preprod.central.vshn.ch/api/v2/product_usage_report_POST")...)...),
 		Action: func(c *cli.Context) error {
-			ctxx, cancel := context.WithCancel(ctx)
-			defer cancel()
 			logger := log.Logger(c.Context)
 			logger.Info("starting spks data collector")
 
-			ticker := time.NewTicker(24 * time.Hour)
-
-			daysChannel := make(chan int, 1)
-			if days != 0 {
-				daysChannel <- days
-			} else {
-				runSPKSBilling(prometheusURL, prometheusQueryArr, logger, allMetrics, salesOrder, UnitID, c.Context)
+			sink, err := spksOdooOpts.newSink(c, logger, allMetrics["odooMetrics"])
+			if err != nil {
+				return configError(err)
 			}
 
-			for {
-				select {
-				case <-ctxx.Done():
-					logger.Info("Received Context cancellation, exiting...")
-					return nil
-				case <-ticker.C:
-					// this runs every 24 hours after program start
-					runSPKSBilling(prometheusURL, prometheusQueryArr, logger, allMetrics, salesOrder, UnitID, c.Context)
-				case <-daysChannel:
-					runSPKSBilling(prometheusURL, prometheusQueryArr, logger, allMetrics, salesOrder, UnitID, c.Context)
-					if days > 0 {
-						days--
-						daysChannel <- days
-					}
+			location, err := billingLocation(c)
+			if err != nil {
+				return configError(err)
+			}
+			day := billing.Day.In(location)
+			products, err := productCatalog(c)
+			if err != nil {
+				return configError(err)
+			}
+			job := spksJob(logger, allMetrics, products, prometheusURL, salesOrder, UnitID, day, sink)
+			job.schedule = scheduleOrDefault(configFrom(c.Context).Collectors.SPKS.Collector, job.schedule)
+
+			// catch up on the requested number of past days first, oldest first, up to yesterday
+			if days > 0 {
+				today := day.Start(time.Now())
+				err := (&backfillOptions{}).run(c.Context, logger, jobSPKS, sink, day.Between(today.AddDate(0, 0, -days-1), today), job.collect)
+				if scheduler.IsFatal(err) {
+					return err
+				}
+				if err != nil {
+					logger.Error(err, "cannot bill past days", "days", days)
 				}
 			}
+
+			spksSchedOpts.dryRun = c.Bool("dry-run")
+			return spksSchedOpts.run(c.Context, logger, "", job)
+		},
+		Subcommands: []*cli.Command{
+			{
+				Name:   "backfill",
+				Usage:  "Bill the instance counts for every day from --from to --to, e.g. after an outage",
+				Before: addCommandName,
+				Flags:  spksBackfill.flags(false),
+				Action: func(c *cli.Context) error {
+					logger := log.Logger(c.Context)
+
+					location, err := billingLocation(c)
+					if err != nil {
+						return configError(err)
+					}
+					periods, err := spksBackfill.periods(billing.Day.In(location), time.Now())
+					if err != nil {
+						return configError(err)
+					}
+					sink, err := spksOdooOpts.newSink(c, logger, allMetrics["odooMetrics"])
+					if err != nil {
+						return configError(err)
+					}
+					products, err := productCatalog(c)
+					if err != nil {
+						return configError(err)
+					}
+					return spksBackfill.run(c.Context, logger, jobSPKS, sink, periods, func(ctx context.Context, period odoo.TimeRange) ([]odoo.OdooMeteredBillingRecord, error) {
+						return collectSPKS(ctx, prometheusURL, prometheusQueryArr, logger, allMetrics, products, salesOrder, UnitID, period, location)
+					})
+				},
+			},
 		},
 	}
 }
 
-func runSPKSBilling(prometheusURL string, prometheusQueryArr [4]string, logger logr.Logger, allMetrics map[string]map[string]prometheus.Counter, salesOrder string, UnitID string, c context.Context) {
-	// var startYesterdayAbsolute time.Time
-	location, err := time.LoadLocation("Europe/Zurich")
-	if err != nil {
-		allMetrics["odooMetrics"]["odooFailed"].Inc()
+// spksJob bills the instance counts of the previous day, every day after 01:00 unless scheduled otherwise.
+func spksJob(logger logr.Logger, allMetrics map[string]map[string]prometheus.Counter, products *catalog.Catalog, prometheusURL, salesOrder, unitID string, day billing.Period, sink odoo.Sink) collectorJob {
+	return collectorJob{
+		name:   jobSPKS,
+		period: day,
+		target: day.Previous,
+		collect: func(ctx context.Context, period odoo.TimeRange) ([]odoo.OdooMeteredBillingRecord, error) {
+			return collectSPKS(ctx, prometheusURL, prometheusQueryArr, logger, allMetrics, products, salesOrder, unitID, period, day.Location())
+		},
+		sink:     sink,
+		schedule: "every 24h after 01:00",
 	}
-	now := time.Now().In(location)
-	// this variable is necessary to query Prometheus, with timerange [1d:1d] it returns data from 1 day up to midnight
-	startOfToday := time.Date(now.Year(), now.Month(), now.Day()-days, 0, 0, 0, 0, location)
-	startYesterdayAbsolute := time.Date(now.Year(), now.Month(), now.Day()-days-1, 0, 0, 0, 0, location).In(time.UTC)
-
-	endYesterdayAbsolute := startYesterdayAbsolute.Add(24 * time.Hour)
+}
 
-	logger.Info("Running SPKS billing with such timeranges: ", "startOfToday", startOfToday, "startYesterdayAbsolute", startYesterdayAbsolute.Local(), "endYesterdayAbsolute", endYesterdayAbsolute.Local())
+// collectSPKS counts the instances which existed during the period, a day, and creates a billing record per product.
+func collectSPKS(ctx context.Context, prometheusURL string, prometheusQueryArr [4]string, logger logr.Logger, allMetrics map[string]map[string]prometheus.Counter, products *catalog.Catalog, salesOrder string, UnitID string, period odoo.TimeRange, location *time.Location) ([]odoo.OdooMeteredBillingRecord, error) {
+	// with the time range [1d:1d], Prometheus returns the data of the day up to the query time, so query at the end of the day
+	endOfDay := period.To.In(location)
 
-	odooClient := odoo.NewOdooAPIClient(c, odooURL, odooOauthTokenURL, odooClientId, odooClientSecret, logger, allMetrics["odooMetrics"])
+	logger.Info("Running SPKS billing with such timeranges: ", "endOfDay", endOfDay, "from", period.From.Local(), "to", period.To.Local())
 
-	mariadbStandard, mariadbPremium, redisStandard, redisPremium, err := getDatabasesCounts(prometheusURL, prometheusQueryArr, logger, startOfToday, allMetrics)
+	mariadbStandard, mariadbPremium, redisStandard, redisPremium, err := getDatabasesCounts(ctx, prometheusURL, prometheusQueryArr, logger, endOfDay, allMetrics)
 	if err != nil {
-		logger.Error(err, "Error getting database counts")
+		// sending zero counts would bill nothing for the day, better try again at the next run
+		return nil, collectionError(fmt.Errorf("error getting database counts: %w", err))
 	}
 
-	billingRecords := generateBillingRecords(salesOrder, UnitID, startYesterdayAbsolute, endYesterdayAbsolute, mariadbStandard, mariadbPremium, redisStandard, redisPremium)
-
-	err = odooClient.SendData(billingRecords)
-	if err != nil {
-		logger.Error(err, "Error sending data to Odoo API")
-	}
+	return generateBillingRecords(products, salesOrder, UnitID, period.From, period.To, mariadbStandard, mariadbPremium, redisStandard, redisPremium)
 }
 
-func generateBillingRecords(salesOrder string, UnitID string, startYesterdayAbsolute time.Time, endYesterdayAbsolute time.Time, mariadbStandard int, mariadbPremium int, redisStandard int, redisPremium int) []odoo.OdooMeteredBillingRecord {
+// productSPKS is the name of the SPKS product in the catalog, whose ID is rendered with the service and plan of the instances.
+const productSPKS = "spks"
+
+func generateBillingRecords(products *catalog.Catalog, salesOrder string, UnitID string, startYesterdayAbsolute time.Time, endYesterdayAbsolute time.Time, mariadbStandard int, mariadbPremium int, redisStandard int, redisPremium int) ([]odoo.OdooMeteredBillingRecord, error) {
 	timerange := odoo.TimeRange{
 		From: startYesterdayAbsolute,
 		To:   endYesterdayAbsolute,
 	}
 
-	billingRecords := []odoo.OdooMeteredBillingRecord{
-		{
-			ProductID:     "appcat-spks-mariadb-standard",
-			InstanceID:    "mariadb-standard",
-			SalesOrder:    salesOrder,
-			UnitID:        UnitID,
-			ConsumedUnits: float64(mariadbStandard),
-			TimeRange:     timerange,
-		},
-		{
-			ProductID:     "appcat-spks-mariadb-premium",
-			InstanceID:    "mariadb-premium",
-			SalesOrder:    salesOrder,
-			UnitID:        UnitID,
-			ConsumedUnits: float64(mariadbPremium),
-			TimeRange:     timerange,
-		},
-		{
-			ProductID:     "appcat-spks-redis-standard",
-			InstanceID:    "redis-standard",
-			SalesOrder:    salesOrder,
-			UnitID:        UnitID,
-			ConsumedUnits: float64(redisStandard),
-			TimeRange:     timerange,
-		},
-		{
-			ProductID:     "appcat-spks-redis-premium",
-			InstanceID:    "redis-premium",
+	counts := []struct {
+		service, plan string
+		count         int
+	}{
+		{"mariadb", "standard", mariadbStandard},
+		{"mariadb", "premium", mariadbPremium},
+		{"redis", "standard", redisStandard},
+		{"redis", "premium", redisPremium},
+	}
+	billingRecords := make([]odoo.OdooMeteredBillingRecord, 0, len(counts))
+	for _, c := range counts {
+		productID, err := products.ProductID(productSPKS, startYesterdayAbsolute, catalog.Fields{Provider: "spks", Service: c.service, Plan: c.plan})
+		if err != nil {
+			return nil, err
+		}
+		billingRecords = append(billingRecords, odoo.OdooMeteredBillingRecord{
+			ProductID:     productID,
+			InstanceID:    c.service + "-" + c.plan,
 			SalesOrder:    salesOrder,
 			UnitID:        UnitID,
-			ConsumedUnits: float64(redisPremium),
+			ConsumedUnits: float64(c.count),
 			TimeRange:     timerange,
-		},
+		})
 	}
 
-	return billingRecords
+	return billingRecords, nil
 }
 
-func getDatabasesCounts(prometheusURL string, prometheusQueryArr [4]string, logger logr.Logger, startOfToday time.Time, allMetrics map[string]map[string]prometheus.Counter) (int, int, int, int, error) {
+func getDatabasesCounts(ctx context.Context, prometheusURL string, prometheusQueryArr [4]string, logger logr.Logger, startOfToday time.Time, allMetrics map[string]map[string]prometheus.Counter) (int, int, int, int, error) {
 
 	client, err := api.NewClient(api.Config{
 		Address: prometheusURL,
@@ -175,7 +198,7 @@ func getDatabasesCounts(prometheusURL string, prometheusQueryArr [4]string, logg
 	}
 
 	v1api := v1.NewAPI(client)
-	ctxx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	ctxx, cancel := context.WithTimeout(ctx, 60*time.Second)
 	defer cancel()
 
 	mariadbStandard, err := QueryPrometheus(ctxx, v1api, prometheusQueryArr[0], logger, startOfToday, allMetrics["providerMetrics"])
@@ -0,0 +1,69 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/urfave/cli/v2"
+	"github.com/vshn/billing-collector-cloudservices/pkg/uom"
+	k8s "sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const defaultUOMReloadInterval = time.Minute
+
+// uomOptions holds the flags which choose where the UOM mapping comes from.
+type uomOptions struct {
+	uom            string
+	file           string
+	configMap      string
+	reloadInterval time.Duration
+}
+
+func (o *uomOptions) flags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{Name: "uom", Usage: "Unit of measure mapping between cloud services and Odoo16 in json format",
+			EnvVars: []string{"UOM"}, Destination: &o.uom, Required: false, DefaultText: "<required unless uom-file or uom-configmap is set>"},
+		&cli.StringFlag{Name: "uom-file", Usage: "File with the unit of measure mapping as JSON or YAML object, reloaded when it changes",
+			EnvVars: []string{"UOM_FILE"}, Destination: &o.file, Required: false, DefaultText: defaultTextForOptionalFlags},
+		&cli.StringFlag{Name: "uom-configmap", Usage: "ConfigMap as namespace/name whose data is the unit of measure mapping, reloaded when it changes",
+			EnvVars: []string{"UOM_CONFIGMAP"}, Destination: &o.configMap, Required: false, DefaultText: defaultTextForOptionalFlags},
+		&cli.DurationFlag{Name: "uom-reload-interval", Usage: "How often the file or ConfigMap of the unit of measure mapping is checked for changes",
+			EnvVars: []string{"UOM_RELOAD_INTERVAL"}, Destination: &o.reloadInterval, Value: defaultUOMReloadInterval},
+	}
+}
+
+// load loads the UOM mapping and checks that it maps all the units, e.g. the union of the units of several collectors.
+// A mapping from a file or ConfigMap is reloaded when it changes, until the context is done.
+func (o *uomOptions) load(ctx context.Context, logger logr.Logger, kubeClient k8s.Client, units ...string) (*uom.Mapping, error) {
+	var source uom.Source
+	switch {
+	case o.file != "" && o.configMap != "":
+		return nil, configError(fmt.Errorf("flags uom-file and uom-configmap are mutually exclusive"))
+	case o.file != "":
+		source = uom.NewFileSource(o.file)
+	case o.configMap != "":
+		namespace, name, ok := strings.Cut(o.configMap, "/")
+		if !ok || namespace == "" || name == "" {
+			return nil, configError(fmt.Errorf("flag uom-configmap: expected namespace/name, got %q", o.configMap))
+		}
+		source = uom.NewConfigMapSource(kubeClient, namespace, name)
+	default:
+		source = uom.JSONSource(o.uom)
+	}
+
+	logger.Info("Checking UOM mappings")
+	mapping, err := uom.Load(ctx, logger, source, units...)
+	if err != nil {
+		return nil, mappingError(err)
+	}
+	if o.file != "" || o.configMap != "" {
+		if o.reloadInterval <= 0 {
+			return nil, configError(fmt.Errorf("flag uom-reload-interval must be positive, got %s", o.reloadInterval))
+		}
+		go mapping.Watch(ctx, logger.WithName("uom"), o.reloadInterval)
+	}
+	return mapping, nil
+}
@@ -0,0 +1,307 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/vshn/billing-collector-cloudservices/pkg/billing"
+	"github.com/vshn/billing-collector-cloudservices/pkg/kubernetes"
+	"github.com/vshn/billing-collector-cloudservices/pkg/odoo"
+	"github.com/vshn/billing-collector-cloudservices/pkg/scheduler"
+	"github.com/vshn/billing-collector-cloudservices/pkg/watermark"
+)
+
+// collectorWatermark bills the periods of a collector in order and remembers the end of the last one billed,
+// so that periods missed while the collector was down or failing are billed at the next run.
+// Without a store, it only bills the periods it is asked to.
+type collectorWatermark struct {
+	store      watermark.Store
+	job        string
+	period     billing.Period
+	maxCatchUp time.Duration
+	// dryRun leaves the watermark where it is, as the records only went to stdout.
+	dryRun bool
+
+	// parts are the parts of a period which can fail on their own, e.g. zones, and collectParts collects some of them.
+	// A part which fails gets a watermark of its own at the start of the period. It is left out of the following periods
+	// and collected on its own from its watermark at the next runs, until it has caught up with the watermark of the job.
+	parts        []string
+	collectParts collectPartsFunc
+}
+
+// newWatermark creates the watermark of the job from the watermark flags. If none is set, it has no store.
+func (o *scheduleOptions) newWatermark(kubeconfig, job string, period billing.Period) (*collectorWatermark, error) {
+	w := &collectorWatermark{job: job, period: period, maxCatchUp: o.maxCatchUp, dryRun: o.dryRun}
+	switch {
+	case o.watermarkFile != "" && o.watermarkConfigMap != "":
+		return nil, fmt.Errorf("flags watermark-file and watermark-configmap are mutually exclusive")
+	case o.watermarkFile != "":
+		w.store = watermark.NewFileStore(o.watermarkFile)
+	case o.watermarkConfigMap != "":
+		namespace, name, ok := strings.Cut(o.watermarkConfigMap, "/")
+		if !ok || namespace == "" || name == "" {
+			return nil, fmt.Errorf("flag watermark-configmap: expected namespace/name, got %q", o.watermarkConfigMap)
+		}
+		k8sClient := o.kubeClient
+		if k8sClient == nil {
+			var err error
+			if k8sClient, err = kubernetes.NewClient(kubeconfig, "", ""); err != nil {
+				return nil, fmt.Errorf("watermark k8s client: %w", err)
+			}
+		}
+		w.store = watermark.NewConfigMapStore(k8sClient, namespace, name)
+	}
+	return w, nil
+}
+
+// catchUp bills the complete periods between the watermark and now, e.g. on startup after the collector was down.
+// A period which fails is logged and billed again at the next run, only fatal errors are returned.
+func (w *collectorWatermark) catchUp(ctx context.Context, logger logr.Logger, sink odoo.Sink, now time.Time, collect collectFunc) error {
+	if w.store == nil {
+		return nil
+	}
+	pending, err := w.retryParts(ctx, logger, sink)
+	if scheduler.IsFatal(err) {
+		return err
+	}
+	gaps, gapsErr := w.gaps(ctx, logger, w.period.Start(now))
+	if gapsErr == nil && len(gaps) > 0 {
+		logger.Info("Catching up on missed periods", "periods", len(gaps), "from", gaps[0].From, "to", gaps[len(gaps)-1].To)
+		gapsErr = w.billPeriods(ctx, logger, sink, gaps, pending, collect)
+	}
+	if err = errors.Join(err, gapsErr); err != nil && !scheduler.IsFatal(err) {
+		logger.Error(err, "Cannot catch up on missed periods, will retry at the next run")
+		return nil
+	}
+	return err
+}
+
+// bill bills the periods the failed parts missed, the periods missed since the watermark and then the target period.
+// It stops at the first period which fails, so that it is billed again at the next run.
+func (w *collectorWatermark) bill(ctx context.Context, logger logr.Logger, sink odoo.Sink, target odoo.TimeRange, collect collectFunc) error {
+	if w.store == nil {
+		return billPeriod(ctx, logger, w.job, sink, target, collect)
+	}
+	pending, retryErr := w.retryParts(ctx, logger, sink)
+	if scheduler.IsFatal(retryErr) {
+		return retryErr
+	}
+	gaps, err := w.gaps(ctx, logger, target.From)
+	if err != nil {
+		return errors.Join(err, retryErr)
+	}
+	if len(gaps) > 0 {
+		logger.Info("Catching up on missed periods", "periods", len(gaps), "from", gaps[0].From, "to", gaps[len(gaps)-1].To)
+	}
+	return errors.Join(w.billPeriods(ctx, logger, sink, append(gaps, target), pending, collect), retryErr)
+}
+
+// gaps returns the periods after the watermark which end at or before the given time.
+// Without a watermark, e.g. on the very first run, there are no gaps.
+func (w *collectorWatermark) gaps(ctx context.Context, logger logr.Logger, before time.Time) ([]odoo.TimeRange, error) {
+	last, err := w.store.Load(ctx, w.job)
+	if err != nil {
+		return nil, fmt.Errorf("load watermark: %w", err)
+	}
+	if last.IsZero() {
+		return nil, nil
+	}
+	return w.period.Between(w.limit(logger, last, before), before), nil
+}
+
+// limit returns the watermark, or the catch-up limit before the given time if the watermark is older.
+func (w *collectorWatermark) limit(logger logr.Logger, last, before time.Time) time.Time {
+	if earliest := before.Add(-w.maxCatchUp); last.Before(earliest) {
+		logger.Info("Watermark is older than the catch-up limit, periods before the limit are not billed, use backfill for them",
+			"watermark", last, "limit", earliest)
+		return earliest
+	}
+	return last
+}
+
+// billPeriods bills the periods in order and moves the watermark past every period billed, except in a dry run.
+// Mapping errors do not stop it, as billing the period again would not help. Neither do failed parts: the records of
+// the other parts are billed and the failed parts are left out of the following periods, to be collected on their own.
+// The parts pending from earlier runs are left out from the start.
+func (w *collectorWatermark) billPeriods(ctx context.Context, logger logr.Logger, sink odoo.Sink, periods []odoo.TimeRange, pending map[string]time.Time, collect collectFunc) error {
+	var errs []error
+	for _, period := range periods {
+		collectErr, sendErr := collectAndSend(ctx, logger, w.job, sink, period, w.collectWithout(pending, collect))
+		failedParts := billing.FailedParts(collectErr)
+		switch {
+		case collectErr != nil && (len(failedParts) == 0 || w.collectParts == nil):
+			return errors.Join(append([]error{collectErr, sendErr}, errs...)...)
+		case sendErr != nil && !isMappingError(sendErr):
+			return errors.Join(append([]error{collectErr, sendErr}, errs...)...)
+		}
+		if collectErr != nil {
+			errs = append(errs, collectErr)
+		}
+		if sendErr != nil {
+			errs = append(errs, sendErr)
+		}
+		if err := w.holdParts(ctx, logger, pending, failedParts, period.From); err != nil {
+			return errors.Join(append([]error{err}, errs...)...)
+		}
+		if w.dryRun {
+			continue
+		}
+		if err := w.store.Save(ctx, w.job, period.To); err != nil {
+			return errors.Join(append([]error{fmt.Errorf("save watermark: %w", err)}, errs...)...)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// partKey is the key of the watermark of a part of the job in the store.
+func (w *collectorWatermark) partKey(part string) string {
+	return w.job + "." + part
+}
+
+// pendingParts loads the parts which failed before, with the start of the first period they have not been billed for.
+func (w *collectorWatermark) pendingParts(ctx context.Context) (map[string]time.Time, error) {
+	pending := map[string]time.Time{}
+	for _, part := range w.parts {
+		from, err := w.store.Load(ctx, w.partKey(part))
+		if err != nil {
+			return nil, fmt.Errorf("load watermark of %s: %w", part, err)
+		}
+		if !from.IsZero() {
+			pending[part] = from
+		}
+	}
+	return pending, nil
+}
+
+// holdParts adds the failed parts to the pending ones, from the given period on. A part already pending keeps its watermark.
+func (w *collectorWatermark) holdParts(ctx context.Context, logger logr.Logger, pending map[string]time.Time, failed []string, from time.Time) error {
+	for _, part := range failed {
+		if _, ok := pending[part]; ok {
+			continue
+		}
+		logger.Info("Part of the period failed, billing it on its own from now on until it has caught up", "part", part, "from", from)
+		pending[part] = from
+		if w.dryRun {
+			continue
+		}
+		if err := w.store.Save(ctx, w.partKey(part), from); err != nil {
+			return fmt.Errorf("save watermark of %s: %w", part, err)
+		}
+	}
+	return nil
+}
+
+// retryParts bills the periods between the watermark of every pending part and the watermark of the job, collecting the part on its own.
+// A part which has caught up loses its watermark. It returns the parts which are still pending.
+func (w *collectorWatermark) retryParts(ctx context.Context, logger logr.Logger, sink odoo.Sink) (map[string]time.Time, error) {
+	if w.collectParts == nil {
+		return nil, nil
+	}
+	pending, err := w.pendingParts(ctx)
+	if err != nil || len(pending) == 0 {
+		return pending, err
+	}
+	last, err := w.store.Load(ctx, w.job)
+	if err != nil || last.IsZero() {
+		return pending, err
+	}
+
+	var errs []error
+	for _, part := range w.parts {
+		from, ok := pending[part]
+		if !ok {
+			continue
+		}
+		logger := logger.WithValues("part", part)
+		periods := w.period.Between(w.limit(logger, from, last), last)
+		if len(periods) > 0 {
+			logger.Info("Billing the periods a failed part missed", "periods", len(periods), "from", periods[0].From, "to", periods[len(periods)-1].To)
+		}
+		collect := func(ctx context.Context, period odoo.TimeRange) ([]odoo.OdooMeteredBillingRecord, error) {
+			return w.collectParts(ctx, period, []string{part})
+		}
+
+		caughtUp := true
+		for _, period := range periods {
+			err := billPeriod(ctx, logger, w.job, sink, period, collect)
+			if scheduler.IsFatal(err) {
+				return pending, errors.Join(append(errs, err)...)
+			}
+			if err == nil || isMappingError(err) {
+				if err != nil {
+					errs = append(errs, err)
+				}
+				continue
+			}
+			errs = append(errs, fmt.Errorf("part %s: %w", part, err))
+			caughtUp = false
+			pending[part] = period.From
+			if !w.dryRun {
+				if err := w.store.Save(ctx, w.partKey(part), period.From); err != nil {
+					errs = append(errs, fmt.Errorf("save watermark of %s: %w", part, err))
+				}
+			}
+			break
+		}
+		if !caughtUp {
+			continue
+		}
+		logger.Info("Failed part has caught up")
+		delete(pending, part)
+		if !w.dryRun {
+			if err := w.store.Delete(ctx, w.partKey(part)); err != nil {
+				// still pending, the periods it has been billed for are skipped by the ledger
+				errs = append(errs, fmt.Errorf("delete watermark of %s: %w", part, err))
+				pending[part] = from
+			}
+		}
+	}
+	return pending, errors.Join(errs...)
+}
+
+// collectWithout returns the collect function for the parts which are not pending.
+func (w *collectorWatermark) collectWithout(pending map[string]time.Time, collect collectFunc) collectFunc {
+	if len(pending) == 0 {
+		return collect
+	}
+	return func(ctx context.Context, period odoo.TimeRange) ([]odoo.OdooMeteredBillingRecord, error) {
+		var parts []string
+		for _, part := range w.parts {
+			if _, ok := pending[part]; !ok {
+				parts = append(parts, part)
+			}
+		}
+		if len(parts) == 0 {
+			return nil, nil
+		}
+		return w.collectParts(ctx, period, parts)
+	}
+}
+
+// billPeriod collects and sends the records of one period.
+// If only part of the period could be collected, that part is sent and the partial error returned.
+func billPeriod(ctx context.Context, logger logr.Logger, job string, sink odoo.Sink, period odoo.TimeRange, collect collectFunc) error {
+	collectErr, sendErr := collectAndSend(ctx, logger, job, sink, period, collect)
+	return errors.Join(collectErr, sendErr)
+}
+
+// collectAndSend is billPeriod returning the errors of collecting and of sending the records apart.
+func collectAndSend(ctx context.Context, logger logr.Logger, job string, sink odoo.Sink, period odoo.TimeRange, collect collectFunc) (collectErr, sendErr error) {
+	records, collectErr := collect(ctx, period)
+	if collectErr != nil {
+		collectErr = collectionError(fmt.Errorf("period %s/%s: %w", period.From.Format(time.RFC3339), period.To.Format(time.RFC3339), collectErr))
+		if !billing.IsPartial(collectErr) {
+			return collectErr, nil
+		}
+		logger.Error(collectErr, "Collected only part of the period, sending that part", "from", period.From, "to", period.To)
+	}
+	if len(records) == 0 {
+		logger.Info("No data to export to odoo", "from", period.From, "to", period.To)
+		return collectErr, nil
+	}
+	return collectErr, send(ctx, logger, job, sink, records)
+}
@@ -0,0 +1,344 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vshn/billing-collector-cloudservices/pkg/billing"
+	"github.com/vshn/billing-collector-cloudservices/pkg/odoo"
+	"github.com/vshn/billing-collector-cloudservices/pkg/watermark"
+)
+
+const testJob = "test"
+
+var (
+	testDay = billing.Day.In(time.UTC)
+	testNow = time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+)
+
+func date(day int) time.Time {
+	return time.Date(2024, 3, day, 0, 0, 0, 0, time.UTC)
+}
+
+func daysOf(from, to int) []odoo.TimeRange {
+	return testDay.Between(date(from), date(to))
+}
+
+// newTestWatermark returns a watermark in a file store, set to the given time unless it is zero.
+func newTestWatermark(t *testing.T, last time.Time, dryRun bool) *collectorWatermark {
+	store := watermark.NewFileStore(filepath.Join(t.TempDir(), "watermarks.json"))
+	if !last.IsZero() {
+		require.NoError(t, store.Save(context.Background(), testJob, last))
+	}
+	return &collectorWatermark{store: store, job: testJob, period: testDay, maxCatchUp: defaultMaxCatchUp, dryRun: dryRun}
+}
+
+// collectRecords returns a collect function which returns one record per period and the periods it was called for.
+// It fails for the periods starting at failAt, and returns the record with a partial error for those starting at partialAt.
+func collectRecords(failAt, partialAt []time.Time) (collectFunc, *[]odoo.TimeRange) {
+	var collected []odoo.TimeRange
+	return func(_ context.Context, period odoo.TimeRange) ([]odoo.OdooMeteredBillingRecord, error) {
+		collected = append(collected, period)
+		if slices.ContainsFunc(failAt, period.From.Equal) {
+			return nil, errors.New("provider unavailable")
+		}
+		records := []odoo.OdooMeteredBillingRecord{{ProductID: "product", InstanceID: "instance", TimeRange: period}}
+		if slices.ContainsFunc(partialAt, period.From.Equal) {
+			return records, billing.Partial(errors.New("zone unavailable"))
+		}
+		return records, nil
+	}, &collected
+}
+
+// recordingSink accepts all records and remembers their periods.
+type recordingSink struct {
+	sent []odoo.TimeRange
+}
+
+func (s *recordingSink) SendData(_ context.Context, records []odoo.OdooMeteredBillingRecord) (*odoo.SendResult, error) {
+	for _, r := range records {
+		s.sent = append(s.sent, r.TimeRange)
+	}
+	return &odoo.SendResult{Chunks: []odoo.ChunkResult{{Records: records}}}, nil
+}
+
+// collectZones returns collect functions for the zones a and b, which return one record per zone and period, with the zone as instance.
+// A zone fails for the periods starting at the times given for it.
+func collectZones(down map[string][]time.Time) (collectFunc, collectPartsFunc) {
+	collectParts := func(_ context.Context, period odoo.TimeRange, zones []string) ([]odoo.OdooMeteredBillingRecord, error) {
+		var records []odoo.OdooMeteredBillingRecord
+		var failed []string
+		for _, zone := range zones {
+			if slices.ContainsFunc(down[zone], period.From.Equal) {
+				failed = append(failed, zone)
+				continue
+			}
+			records = append(records, odoo.OdooMeteredBillingRecord{ProductID: "product", InstanceID: zone, TimeRange: period})
+		}
+		switch {
+		case len(failed) == len(zones):
+			return nil, errors.New("all zones unavailable")
+		case len(failed) > 0:
+			return records, billing.Partial(fmt.Errorf("zones %s unavailable", strings.Join(failed, ", ")), failed...)
+		}
+		return records, nil
+	}
+	collect := func(ctx context.Context, period odoo.TimeRange) ([]odoo.OdooMeteredBillingRecord, error) {
+		return collectParts(ctx, period, []string{"a", "b"})
+	}
+	return collect, collectParts
+}
+
+// zoneSink accepts all records and remembers the days billed per zone.
+type zoneSink map[string][]int
+
+func (s zoneSink) SendData(_ context.Context, records []odoo.OdooMeteredBillingRecord) (*odoo.SendResult, error) {
+	for _, r := range records {
+		s[r.InstanceID] = append(s[r.InstanceID], r.TimeRange.From.Day())
+	}
+	return &odoo.SendResult{Chunks: []odoo.ChunkResult{{Records: records}}}, nil
+}
+
+func loadWatermark(t *testing.T, w *collectorWatermark) time.Time {
+	last, err := w.store.Load(context.Background(), testJob)
+	require.NoError(t, err)
+	return last
+}
+
+func TestCollectorWatermark_gaps(t *testing.T) {
+	tests := map[string]struct {
+		watermark  time.Time
+		maxCatchUp time.Duration
+		expected   []odoo.TimeRange
+	}{
+		"given no watermark, we should get no gaps": {},
+		"given a watermark days ago, we should get the days since": {
+			watermark: date(7),
+			expected:  daysOf(7, 10),
+		},
+		"given a watermark at the start of the period, we should get no gaps": {
+			watermark: date(10),
+		},
+		"given a watermark older than the catch-up limit, we should get the days within the limit": {
+			watermark:  date(1),
+			maxCatchUp: 2 * 24 * time.Hour,
+			expected:   daysOf(8, 10),
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			w := newTestWatermark(t, tc.watermark, false)
+			if tc.maxCatchUp != 0 {
+				w.maxCatchUp = tc.maxCatchUp
+			}
+			gaps, err := w.gaps(context.Background(), logr.Discard(), testDay.Start(testNow))
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, gaps)
+		})
+	}
+}
+
+func TestCollectorWatermark_billPeriods(t *testing.T) {
+	tests := map[string]struct {
+		periods           []odoo.TimeRange
+		failAt            []time.Time
+		partialAt         []time.Time
+		dryRun            bool
+		expectedCollected []odoo.TimeRange
+		expectedSent      []odoo.TimeRange
+		expectedWatermark time.Time
+		expectedError     string
+	}{
+		"given periods, we should bill them in order and move the watermark past the last": {
+			periods:           daysOf(7, 10),
+			expectedCollected: daysOf(7, 10),
+			expectedSent:      daysOf(7, 10),
+			expectedWatermark: date(10),
+		},
+		"given a period which fails, we should stop and leave the watermark before it": {
+			periods:           daysOf(7, 10),
+			failAt:            []time.Time{date(8)},
+			expectedCollected: daysOf(7, 9),
+			expectedSent:      daysOf(7, 8),
+			expectedWatermark: date(8),
+			expectedError:     "period 2024-03-08T00:00:00Z/2024-03-09T00:00:00Z: provider unavailable",
+		},
+		"given a period collected partially, we should send its records but stop and leave the watermark before it": {
+			periods:           daysOf(7, 10),
+			partialAt:         []time.Time{date(8)},
+			expectedCollected: daysOf(7, 9),
+			expectedSent:      daysOf(7, 9),
+			expectedWatermark: date(8),
+			expectedError:     "period 2024-03-08T00:00:00Z/2024-03-09T00:00:00Z: zone unavailable",
+		},
+		"given a dry run, we should bill the periods but leave the watermark": {
+			periods:           daysOf(7, 10),
+			dryRun:            true,
+			expectedCollected: daysOf(7, 10),
+			expectedSent:      daysOf(7, 10),
+			expectedWatermark: date(7),
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			w := newTestWatermark(t, date(7), tc.dryRun)
+			collect, collected := collectRecords(tc.failAt, tc.partialAt)
+
+			sink := &recordingSink{}
+
+			err := w.billPeriods(context.Background(), logr.Discard(), sink, tc.periods, nil, collect)
+			if tc.expectedError != "" {
+				assert.EqualError(t, err, tc.expectedError)
+				assert.Equal(t, ExitCodeCollection, ExitCode(err))
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tc.expectedCollected, *collected)
+			assert.Equal(t, tc.expectedSent, sink.sent)
+			assert.Equal(t, tc.expectedWatermark, loadWatermark(t, w))
+		})
+	}
+}
+
+func TestCollectorWatermark_catchUp(t *testing.T) {
+	tests := map[string]struct {
+		noStore           bool
+		failAt            []time.Time
+		partialAt         []time.Time
+		dryRun            bool
+		expectedCollected []odoo.TimeRange
+		expectedWatermark time.Time
+	}{
+		"given no store, we should bill nothing": {
+			noStore: true,
+		},
+		"given a watermark days ago, we should bill the complete days since": {
+			expectedCollected: daysOf(7, 10),
+			expectedWatermark: date(10),
+		},
+		"given a day which fails, we should not return the error and retry from it at the next run": {
+			failAt:            []time.Time{date(9)},
+			expectedCollected: daysOf(7, 10),
+			expectedWatermark: date(9),
+		},
+		"given a day collected partially, we should retry from it at the next run": {
+			partialAt:         []time.Time{date(8)},
+			expectedCollected: daysOf(7, 9),
+			expectedWatermark: date(8),
+		},
+		"given a dry run, we should bill the days but leave the watermark": {
+			dryRun:            true,
+			expectedCollected: daysOf(7, 10),
+			expectedWatermark: date(7),
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			w := newTestWatermark(t, date(7), tc.dryRun)
+			if tc.noStore {
+				w.store = nil
+			}
+			collect, collected := collectRecords(tc.failAt, tc.partialAt)
+
+			err := w.catchUp(context.Background(), logr.Discard(), odoo.NewWriterSink(io.Discard, odoo.FormatTable), testNow, collect)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectedCollected, *collected)
+			if !tc.noStore {
+				assert.Equal(t, tc.expectedWatermark, loadWatermark(t, w))
+			}
+		})
+	}
+}
+
+func TestCollectorWatermark_parts(t *testing.T) {
+	tests := map[string]struct {
+		pendingB          time.Time
+		downA, downB      []time.Time
+		dryRun            bool
+		expectedBilled    zoneSink
+		expectedWatermark time.Time
+		expectedPendingB  time.Time
+		expectedError     string
+	}{
+		"given all zones available, we should bill them and move the watermark": {
+			expectedBilled:    zoneSink{"a": {7, 8, 9}, "b": {7, 8, 9}},
+			expectedWatermark: date(10),
+		},
+		"given a zone which fails, we should bill the other zone, move the watermark and bill the failed zone on its own from then": {
+			downB:             []time.Time{date(8)},
+			expectedBilled:    zoneSink{"a": {7, 8, 9}, "b": {7}},
+			expectedWatermark: date(10),
+			expectedPendingB:  date(8),
+			expectedError:     "period 2024-03-08T00:00:00Z/2024-03-09T00:00:00Z: zones b unavailable",
+		},
+		"given a pending zone which is back, we should bill the periods it missed and then all zones": {
+			pendingB:          date(5),
+			expectedBilled:    zoneSink{"a": {7, 8, 9}, "b": {5, 6, 7, 8, 9}},
+			expectedWatermark: date(10),
+		},
+		"given a pending zone which is still down, we should bill the other zone and keep it pending": {
+			pendingB:          date(5),
+			downB:             []time.Time{date(5)},
+			expectedBilled:    zoneSink{"a": {7, 8, 9}},
+			expectedWatermark: date(10),
+			expectedPendingB:  date(5),
+			expectedError:     "part b: period 2024-03-05T00:00:00Z/2024-03-06T00:00:00Z: all zones unavailable",
+		},
+		"given a pending zone which fails in a period it missed, we should keep it pending from that period": {
+			pendingB:          date(5),
+			downB:             []time.Time{date(6)},
+			expectedBilled:    zoneSink{"a": {7, 8, 9}, "b": {5}},
+			expectedWatermark: date(10),
+			expectedPendingB:  date(6),
+			expectedError:     "part b: period 2024-03-06T00:00:00Z/2024-03-07T00:00:00Z: all zones unavailable",
+		},
+		"given all zones failing, we should stop and leave the watermark before the period": {
+			downA:             []time.Time{date(8)},
+			downB:             []time.Time{date(8)},
+			expectedBilled:    zoneSink{"a": {7}, "b": {7}},
+			expectedWatermark: date(8),
+			expectedError:     "period 2024-03-08T00:00:00Z/2024-03-09T00:00:00Z: all zones unavailable",
+		},
+		"given a dry run, we should bill the other zone but move no watermark": {
+			downB:             []time.Time{date(8)},
+			dryRun:            true,
+			expectedBilled:    zoneSink{"a": {7, 8, 9}, "b": {7}},
+			expectedWatermark: date(7),
+			expectedError:     "period 2024-03-08T00:00:00Z/2024-03-09T00:00:00Z: zones b unavailable",
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			w := newTestWatermark(t, date(7), tc.dryRun)
+			if !tc.pendingB.IsZero() {
+				require.NoError(t, w.store.Save(ctx, w.partKey("b"), tc.pendingB))
+			}
+			collect, collectParts := collectZones(map[string][]time.Time{"a": tc.downA, "b": tc.downB})
+			w.parts, w.collectParts = []string{"a", "b"}, collectParts
+			sink := zoneSink{}
+
+			err := w.bill(ctx, logr.Discard(), sink, testDay.Containing(date(9)), collect)
+			if tc.expectedError != "" {
+				assert.EqualError(t, err, tc.expectedError)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tc.expectedBilled, sink)
+			assert.Equal(t, tc.expectedWatermark, loadWatermark(t, w))
+			pendingB, err := w.store.Load(ctx, w.partKey("b"))
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectedPendingB, pendingB)
+		})
+	}
+}
@@ -0,0 +1,372 @@
+// Package config reads the config file, which sets the flags of all commands and lists the collectors the run command runs.
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"sigs.k8s.io/yaml"
+)
+
+// Config lists the collectors to run together with the settings they share.
+type Config struct {
+	// BillingTimezone is the time zone billing periods start and end in, the billing-timezone flag if empty.
+	BillingTimezone string `json:"billingTimezone,omitempty"`
+	// ProductCatalog is the path to a product catalog whose products replace the built-in ones of the same name, the product-catalog flag if empty.
+	ProductCatalog string `json:"productCatalog,omitempty"`
+	// SalesOrderRules is the path to the rules which bill namespaces or organizations to specific sales orders, the sales-order-rules flag if empty.
+	SalesOrderRules string            `json:"salesOrderRules,omitempty"`
+	Odoo            Odoo              `json:"odoo"`
+	Kubernetes      Kubernetes        `json:"kubernetes"`
+	ControlAPI      ControlAPI        `json:"controlAPI"`
+	Cluster         Cluster           `json:"cluster"`
+	UOM             map[string]string `json:"uom,omitempty"`
+	// UOMFile or UOMConfigMap, as namespace/name, is where the UOM mapping is loaded from instead, reloaded when it changes.
+	UOMFile           string   `json:"uomFile,omitempty"`
+	UOMConfigMap      string   `json:"uomConfigMap,omitempty"`
+	UOMReloadInterval Duration `json:"uomReloadInterval,omitempty"`
+	// SecretReloadInterval is how often the files of secrets, like Odoo.ClientSecretFile, are re-read.
+	SecretReloadInterval Duration   `json:"secretReloadInterval,omitempty"`
+	Schedule             Schedule   `json:"schedule"`
+	Collectors           Collectors `json:"collectors"`
+}
+
+// Odoo configures the sinks and the Odoo client all collectors share.
+type Odoo struct {
+	Sinks         []string `json:"sinks,omitempty"`
+	SinkFile      string   `json:"sinkFile,omitempty"`
+	URL           string   `json:"url,omitempty"`
+	OAuthTokenURL string   `json:"oauthTokenURL,omitempty"`
+	ClientID      string   `json:"clientID,omitempty"`
+	ClientSecret  string   `json:"clientSecret,omitempty"`
+	// ClientSecretFile is a file to read the client secret from instead, e.g. a mounted Secret volume.
+	ClientSecretFile string   `json:"clientSecretFile,omitempty"`
+	OutboxDir        string   `json:"outboxDir,omitempty"`
+	MaxRetries       *int     `json:"maxRetries,omitempty"`
+	RetryBackoff     Duration `json:"retryBackoff,omitempty"`
+	RetryMaxBackoff  Duration `json:"retryMaxBackoff,omitempty"`
+	BatchSize        *int     `json:"batchSize,omitempty"`
+	LedgerFile       string   `json:"ledgerFile,omitempty"`
+	QuarantineFile   string   `json:"quarantineFile,omitempty"`
+	AuditDir         string   `json:"auditDir,omitempty"`
+	AuditMaxSize     *int64   `json:"auditMaxSize,omitempty"`
+}
+
+// Kubernetes configures the client of the cluster the collectors list the billed resources in.
+type Kubernetes struct {
+	// Kubeconfig is the path to a kubeconfig file, the in-cluster configuration is used if empty.
+	Kubeconfig string `json:"kubeconfig,omitempty"`
+}
+
+// ControlAPI configures the client of the APPUiO Cloud Control API, which knows the sales orders of organizations.
+type ControlAPI struct {
+	URL   string `json:"url,omitempty"`
+	Token string `json:"token,omitempty"`
+	// TokenFile is a file to read the token from instead.
+	TokenFile string `json:"tokenFile,omitempty"`
+}
+
+// Cluster describes the cluster the records are billed for.
+type Cluster struct {
+	ID   string `json:"id,omitempty"`
+	Zone string `json:"zone,omitempty"`
+	// SalesOrder is the sales order of APPUiO Managed clusters. If empty, the sales order of the organization is used.
+	SalesOrder string `json:"salesOrder,omitempty"`
+}
+
+// Schedule holds the settings of the schedules all collectors share.
+type Schedule struct {
+	Timezone            string   `json:"timezone,omitempty"`
+	ShutdownGracePeriod Duration `json:"shutdownGracePeriod,omitempty"`
+	WatermarkFile       string   `json:"watermarkFile,omitempty"`
+	WatermarkConfigMap  string   `json:"watermarkConfigMap,omitempty"`
+	MaxCatchUp          Duration `json:"maxCatchUp,omitempty"`
+	// LeaderElectionLease is the Lease as namespace/name the replicas compete for, leader election is disabled if empty.
+	LeaderElectionLease         string   `json:"leaderElectionLease,omitempty"`
+	LeaderElectionLeaseDuration Duration `json:"leaderElectionLeaseDuration,omitempty"`
+}
+
+// Collectors lists the collectors which can be run.
+type Collectors struct {
+	Exoscale   Exoscale   `json:"exoscale"`
+	Cloudscale Cloudscale `json:"cloudscale"`
+	SPKS       SPKS       `json:"spks"`
+}
+
+// Collector enables a collector and sets its schedule. The collector's default schedule is used if Schedule is empty.
+type Collector struct {
+	Enabled  bool   `json:"enabled,omitempty"`
+	Schedule string `json:"schedule,omitempty"`
+}
+
+// Exoscale holds the credentials and collectors of Exoscale.
+type Exoscale struct {
+	AccessKey string `json:"accessKey,omitempty"`
+	Secret    string `json:"secret,omitempty"`
+	// AccessKeyFile and SecretFile are files to read the credentials from instead.
+	AccessKeyFile string    `json:"accessKeyFile,omitempty"`
+	SecretFile    string    `json:"secretFile,omitempty"`
+	ObjectStorage Collector `json:"objectStorage"`
+	DBaaS         Collector `json:"dbaas"`
+}
+
+// Cloudscale holds the credentials and collectors of cloudscale.
+type Cloudscale struct {
+	APIToken string `json:"apiToken,omitempty"`
+	// APITokenFile is a file to read the API token from instead.
+	APITokenFile  string    `json:"apiTokenFile,omitempty"`
+	ObjectStorage Collector `json:"objectStorage"`
+	// Days is how many days back the billed day is, 0 bills today. Defaults to 1, yesterday.
+	Days *int `json:"days,omitempty"`
+}
+
+// SPKS configures the collector of the SPKS instance counts.
+type SPKS struct {
+	Collector
+	PrometheusURL string `json:"prometheusURL,omitempty"`
+	SalesOrder    string `json:"salesOrder,omitempty"`
+	UnitID        string `json:"unitID,omitempty"`
+}
+
+// Duration is a time.Duration written as string like "90s" or "1h30m".
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"90s\": %w", err)
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// Load reads the configuration from a YAML or JSON file.
+// References to environment variables like ${ODOO_OAUTH_CLIENT_SECRET} in string values are replaced by their values,
+// so that secrets don't need to be part of the file.
+func Load(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read config: %w", err)
+	}
+	cfg, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("config %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// Parse parses the configuration from YAML or JSON and validates it against the schema.
+// Every violation is reported with the path of the field, e.g. "odoo.batchSize: must be an integer".
+func Parse(data []byte) (*Config, error) {
+	doc := map[string]any{}
+	if err := yaml.UnmarshalStrict(data, &doc); err != nil {
+		return nil, err
+	}
+	if err := errors.Join(expandEnv("", doc)...); err != nil {
+		return nil, err
+	}
+	return decode(doc)
+}
+
+// envReference matches a reference to an environment variable, like ${ODOO_OAUTH_CLIENT_SECRET}.
+var envReference = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expandEnv replaces the references to environment variables in the string values of the document, in place.
+// Any other $, e.g. in a password, is kept. It returns an error naming the field for every reference to an undefined variable, sorted by field.
+func expandEnv(path string, value any) []error {
+	var errs []error
+	expand := func(path string, value any) any {
+		str, ok := value.(string)
+		if !ok {
+			errs = append(errs, expandEnv(path, value)...)
+			return value
+		}
+		return envReference.ReplaceAllStringFunc(str, func(ref string) string {
+			name := envReference.FindStringSubmatch(ref)[1]
+			env, ok := os.LookupEnv(name)
+			if !ok {
+				errs = append(errs, fmt.Errorf("%s: environment variable %s is not set", displayPath(path), name))
+			}
+			return env
+		})
+	}
+
+	switch v := value.(type) {
+	case map[string]any:
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			v[name] = expand(join(path, name), v[name])
+		}
+	case []any:
+		for i, item := range v {
+			v[i] = expand(fmt.Sprintf("%s[%d]", path, i), item)
+		}
+	}
+	return errs
+}
+
+// decode validates the document against the schema and decodes it.
+func decode(doc map[string]any) (*Config, error) {
+	if err := errors.Join(configSchema.validate("", doc)...); err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &Config{}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Values returns the fields which are set, by dotted path like "odoo.url", formatted like the values of the flags:
+// lists are comma separated and the UOM mapping is JSON.
+func (c *Config) Values() (map[string]string, error) {
+	doc, err := c.document()
+	if err != nil {
+		return nil, err
+	}
+	values := map[string]string{}
+	configSchema.values("", doc, values)
+	return values, nil
+}
+
+// Merge returns a copy of the config with the fields at the dotted paths set to the values, formatted like the values of the flags.
+func (c *Config) Merge(values map[string]string) (*Config, error) {
+	doc, err := c.document()
+	if err != nil {
+		return nil, err
+	}
+	for path, value := range values {
+		field := configSchema.field(path)
+		if field == nil {
+			return nil, fmt.Errorf("%s: unknown field", path)
+		}
+		parsed, err := field.parse(path, value)
+		if err != nil {
+			return nil, err
+		}
+		set(doc, strings.Split(path, "."), parsed)
+	}
+	return decode(doc)
+}
+
+// document returns the config as generic JSON document.
+func (c *Config) document() (map[string]any, error) {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	doc := map[string]any{}
+	return doc, json.Unmarshal(data, &doc)
+}
+
+func set(doc map[string]any, path []string, value any) {
+	if len(path) == 1 {
+		doc[path[0]] = value
+		return
+	}
+	child, ok := doc[path[0]].(map[string]any)
+	if !ok {
+		child = map[string]any{}
+		doc[path[0]] = child
+	}
+	set(child, path[1:], value)
+}
+
+// Redacted returns a copy of the config with the secrets replaced, e.g. to print it.
+func (c Config) Redacted() *Config {
+	redact := func(secret *string) {
+		if *secret != "" {
+			*secret = redacted
+		}
+	}
+	redact(&c.Odoo.ClientSecret)
+	redact(&c.ControlAPI.Token)
+	redact(&c.Collectors.Exoscale.AccessKey)
+	redact(&c.Collectors.Exoscale.Secret)
+	redact(&c.Collectors.Cloudscale.APIToken)
+	return &c
+}
+
+const redacted = "<redacted>"
+
+// Validate checks what the run command needs: that at least one collector is enabled and that the enabled collectors have their credentials.
+func (c *Config) Validate() error {
+	var missing []string
+	require := func(value, field string) {
+		if value == "" {
+			missing = append(missing, field)
+		}
+	}
+	// secrets can also be read from a file, given in the field with the suffix File
+	requireSecret := func(value, file, field string) {
+		if value == "" && file == "" {
+			missing = append(missing, field+" or "+field+"File")
+		}
+	}
+
+	exo := c.Collectors.Exoscale
+	if exo.ObjectStorage.Enabled || exo.DBaaS.Enabled {
+		requireSecret(exo.AccessKey, exo.AccessKeyFile, "collectors.exoscale.accessKey")
+		requireSecret(exo.Secret, exo.SecretFile, "collectors.exoscale.secret")
+	}
+	if cloudscale := c.Collectors.Cloudscale; cloudscale.ObjectStorage.Enabled {
+		requireSecret(cloudscale.APIToken, cloudscale.APITokenFile, "collectors.cloudscale.apiToken")
+	}
+	if spks := c.Collectors.SPKS; spks.Enabled {
+		require(spks.PrometheusURL, "collectors.spks.prometheusURL")
+		require(spks.SalesOrder, "collectors.spks.salesOrder")
+		require(spks.UnitID, "collectors.spks.unitID")
+	}
+	if exo.ObjectStorage.Enabled || exo.DBaaS.Enabled || c.Collectors.Cloudscale.ObjectStorage.Enabled {
+		require(c.Cluster.ID, "cluster.id")
+		if len(c.UOM) == 0 && c.UOMFile == "" && c.UOMConfigMap == "" {
+			missing = append(missing, "uom")
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("missing %s", strings.Join(missing, ", "))
+	}
+	if len(c.Enabled()) == 0 {
+		return fmt.Errorf("no collector enabled")
+	}
+	return nil
+}
+
+// Enabled returns the names of the enabled collectors, as used in the collectors section, sorted.
+func (c *Config) Enabled() []string {
+	var enabled []string
+	for name, collector := range map[string]Collector{
+		"exoscale.objectStorage":   c.Collectors.Exoscale.ObjectStorage,
+		"exoscale.dbaas":           c.Collectors.Exoscale.DBaaS,
+		"cloudscale.objectStorage": c.Collectors.Cloudscale.ObjectStorage,
+		"spks":                     c.Collectors.SPKS.Collector,
+	} {
+		if collector.Enabled {
+			enabled = append(enabled, name)
+		}
+	}
+	sort.Strings(enabled)
+	return enabled
+}
@@ -0,0 +1,341 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"sigs.k8s.io/yaml"
+)
+
+func TestParse(t *testing.T) {
+	t.Setenv("TEST_EXOSCALE_SECRET", "s3cr3t")
+
+	tests := map[string]struct {
+		config        string
+		expectedError string
+		check         func(t *testing.T, cfg *Config)
+	}{
+		"given enabled collectors, we should get their settings": {
+			config: `
+odoo:
+  url: https://odoo.example.com
+  sinks: [odoo, file]
+  batchSize: 100
+cluster:
+  id: c-test
+uom:
+  InstanceHour: uom_1
+schedule:
+  maxCatchUp: 48h
+collectors:
+  exoscale:
+    accessKey: key
+    secret: ${TEST_EXOSCALE_SECRET}
+    dbaas:
+      enabled: true
+      schedule: every 10m
+  spks:
+    enabled: true
+    prometheusURL: http://prometheus:9090
+    salesOrder: S10121
+    unitID: uom_2
+`,
+			check: func(t *testing.T, cfg *Config) {
+				assert.Equal(t, []string{"exoscale.dbaas", "spks"}, cfg.Enabled())
+				assert.Equal(t, "s3cr3t", cfg.Collectors.Exoscale.Secret)
+				assert.Equal(t, "every 10m", cfg.Collectors.Exoscale.DBaaS.Schedule)
+				assert.Equal(t, []string{"odoo", "file"}, cfg.Odoo.Sinks)
+				require.NotNil(t, cfg.Odoo.BatchSize)
+				assert.Equal(t, 100, *cfg.Odoo.BatchSize)
+				assert.Equal(t, Duration(48*time.Hour), cfg.Schedule.MaxCatchUp)
+				assert.Equal(t, "http://prometheus:9090", cfg.Collectors.SPKS.PrometheusURL)
+			},
+		},
+		"given a $ in a value which is no reference, we should keep it": {
+			config: `
+cluster:
+  id: c-test
+uom:
+  InstanceHour: uom_1
+odoo:
+  clientSecret: pa$$word$HOME
+collectors:
+  exoscale:
+    accessKey: key
+    secret: ${TEST_EXOSCALE_SECRET}$
+    dbaas:
+      enabled: true
+`,
+			check: func(t *testing.T, cfg *Config) {
+				assert.Equal(t, "pa$$word$HOME", cfg.Odoo.ClientSecret)
+				assert.Equal(t, "s3cr3t$", cfg.Collectors.Exoscale.Secret)
+			},
+		},
+		"given references to undefined environment variables, we should get every field": {
+			config: `
+odoo:
+  clientSecret: ${TEST_UNDEFINED_SECRET}
+  sinks: [odoo, "${TEST_UNDEFINED_SINK}"]
+`,
+			expectedError: `odoo.clientSecret: environment variable TEST_UNDEFINED_SECRET is not set
+odoo.sinks[1]: environment variable TEST_UNDEFINED_SINK is not set`,
+		},
+		"given no enabled collector, we should get an error": {
+			config: `
+collectors:
+  exoscale:
+    dbaas:
+      enabled: false
+`,
+			expectedError: "no collector enabled",
+		},
+		"given an enabled collector without credentials, we should get the missing fields": {
+			config: `
+collectors:
+  cloudscale:
+    objectStorage:
+      enabled: true
+`,
+			expectedError: "missing collectors.cloudscale.apiToken or collectors.cloudscale.apiTokenFile, cluster.id, uom",
+		},
+		"given credentials in files, we should accept them": {
+			config: `
+cluster:
+  id: c-test
+uomFile: /etc/billing/uom.yaml
+collectors:
+  exoscale:
+    accessKeyFile: /var/run/secrets/exoscale/key
+    secretFile: /var/run/secrets/exoscale/secret
+    dbaas:
+      enabled: true
+`,
+			check: func(t *testing.T, cfg *Config) {
+				assert.Equal(t, "/var/run/secrets/exoscale/key", cfg.Collectors.Exoscale.AccessKeyFile)
+				assert.Equal(t, "/var/run/secrets/exoscale/secret", cfg.Collectors.Exoscale.SecretFile)
+			},
+		},
+		"given an unknown field, we should get an error": {
+			config: `
+collectors:
+  spks:
+    enabled: true
+    prometheusURL: http://prometheus:9090
+    salesOrder: S10121
+    unitID: uom_2
+    interval: 1h
+`,
+			expectedError: "collectors.spks.interval: unknown field",
+		},
+		"given an invalid duration, we should get an error": {
+			config: `
+schedule:
+  shutdownGracePeriod: 5 minutes
+`,
+			expectedError: `schedule.shutdownGracePeriod: "5 minutes" does not match`,
+		},
+		"given values of the wrong type, we should get every field": {
+			config: `
+odoo:
+  batchSize: many
+  sinks: [odoo, mail]
+collectors:
+  cloudscale:
+    days: -1
+`,
+			expectedError: `collectors.cloudscale.days: must be at least 0, got -1
+odoo.batchSize: must be an integer, got string "many"
+odoo.sinks[1]: must be one of odoo, file, stdout, got "mail"`,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			cfg, err := Parse([]byte(tc.config))
+			if err == nil {
+				err = cfg.Validate()
+			}
+			if tc.expectedError != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tc.expectedError)
+				return
+			}
+			require.NoError(t, err)
+			tc.check(t, cfg)
+		})
+	}
+}
+
+func TestLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"collectors": {"spks": {"enabled": true, "prometheusURL": "http://prometheus:9090", "salesOrder": "S1", "unitID": "u"}}}`), 0o600))
+
+	cfg, err := Load(path)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"spks"}, cfg.Enabled())
+
+	_, err = Load(filepath.Join(t.TempDir(), "missing.yaml"))
+	assert.Error(t, err)
+}
+
+func TestConfig_Merge(t *testing.T) {
+	cfg, err := Parse([]byte(`
+odoo:
+  url: https://odoo.example.com
+  batchSize: 100
+cluster:
+  id: c-test
+`))
+	require.NoError(t, err)
+
+	tests := map[string]struct {
+		values        map[string]string
+		expectedError string
+		check         func(t *testing.T, merged *Config)
+	}{
+		"given values, we should override the file": {
+			values: map[string]string{
+				"odoo.url":                   "https://odoo.example.org",
+				"odoo.sinks":                 "odoo, file",
+				"uom":                        `{"InstanceHour": "uom_1"}`,
+				"schedule.maxCatchUp":        "48h",
+				"collectors.cloudscale.days": "0",
+			},
+			check: func(t *testing.T, merged *Config) {
+				assert.Equal(t, "https://odoo.example.org", merged.Odoo.URL)
+				assert.Equal(t, []string{"odoo", "file"}, merged.Odoo.Sinks)
+				assert.Equal(t, map[string]string{"InstanceHour": "uom_1"}, merged.UOM)
+				assert.Equal(t, Duration(48*time.Hour), merged.Schedule.MaxCatchUp)
+				require.NotNil(t, merged.Collectors.Cloudscale.Days)
+				assert.Equal(t, 0, *merged.Collectors.Cloudscale.Days)
+				require.NotNil(t, merged.Odoo.BatchSize)
+				assert.Equal(t, 100, *merged.Odoo.BatchSize)
+				assert.Equal(t, "c-test", merged.Cluster.ID)
+			},
+		},
+		"given an invalid value, we should get the field": {
+			values:        map[string]string{"odoo.batchSize": "many"},
+			expectedError: `odoo.batchSize: must be an integer, got "many"`,
+		},
+		"given an invalid duration, we should get the field": {
+			values:        map[string]string{"schedule.maxCatchUp": "2 days"},
+			expectedError: `schedule.maxCatchUp: "2 days" does not match`,
+		},
+		"given an unknown field, we should get an error": {
+			values:        map[string]string{"odoo.password": "secret"},
+			expectedError: "odoo.password: unknown field",
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			merged, err := cfg.Merge(tc.values)
+			if tc.expectedError != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tc.expectedError)
+				return
+			}
+			require.NoError(t, err)
+			tc.check(t, merged)
+			assert.Equal(t, "https://odoo.example.com", cfg.Odoo.URL, "the config should not be modified")
+		})
+	}
+}
+
+func TestConfig_Values(t *testing.T) {
+	cfg, err := Parse([]byte(`
+odoo:
+  sinks: [odoo, file]
+  batchSize: 100
+uom:
+  InstanceHour: uom_1
+schedule:
+  maxCatchUp: 48h
+collectors:
+  exoscale:
+    dbaas:
+      enabled: true
+`))
+	require.NoError(t, err)
+
+	values, err := cfg.Values()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"odoo.sinks":                        "odoo,file",
+		"odoo.batchSize":                    "100",
+		"uom":                               `{"InstanceHour":"uom_1"}`,
+		"schedule.maxCatchUp":               "48h0m0s",
+		"collectors.exoscale.dbaas.enabled": "true",
+	}, values)
+
+	roundTrip, err := (&Config{}).Merge(values)
+	require.NoError(t, err)
+	assert.Equal(t, cfg, roundTrip)
+}
+
+func TestConfig_Redacted(t *testing.T) {
+	credentials := map[string]func(cfg *Config) *string{
+		"odoo.clientSecret":              func(cfg *Config) *string { return &cfg.Odoo.ClientSecret },
+		"controlAPI.token":               func(cfg *Config) *string { return &cfg.ControlAPI.Token },
+		"collectors.exoscale.accessKey":  func(cfg *Config) *string { return &cfg.Collectors.Exoscale.AccessKey },
+		"collectors.exoscale.secret":     func(cfg *Config) *string { return &cfg.Collectors.Exoscale.Secret },
+		"collectors.cloudscale.apiToken": func(cfg *Config) *string { return &cfg.Collectors.Cloudscale.APIToken },
+	}
+	cfg := &Config{}
+	cfg.Odoo.ClientID = "client"
+	for path, field := range credentials {
+		*field(cfg) = "s3cr3t-" + path
+	}
+
+	r := cfg.Redacted()
+	for path, field := range credentials {
+		assert.Equal(t, redacted, *field(r), "%s should be redacted", path)
+		assert.Equal(t, "s3cr3t-"+path, *field(cfg), "the config should not be modified")
+	}
+	assert.Equal(t, "client", r.Odoo.ClientID)
+	dump, err := yaml.Marshal(r)
+	require.NoError(t, err)
+	assert.NotContains(t, string(dump), "s3cr3t", "the dump should contain no credential")
+
+	assert.Empty(t, (&Config{}).Redacted().Collectors.Cloudscale.APIToken, "unset secrets should stay unset")
+}
+
+// TestSchema checks that the published schema describes exactly the fields of Config.
+func TestSchema(t *testing.T) {
+	var check func(path string, s *schema, typ reflect.Type)
+	check = func(path string, s *schema, typ reflect.Type) {
+		s = s.resolve()
+		fields := map[string]reflect.Type{}
+		var collect func(typ reflect.Type)
+		collect = func(typ reflect.Type) {
+			for i := 0; i < typ.NumField(); i++ {
+				f := typ.Field(i)
+				if f.Anonymous {
+					collect(f.Type)
+					continue
+				}
+				name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+				fields[name] = f.Type
+			}
+		}
+		collect(typ)
+
+		for name := range s.Properties {
+			assert.Contains(t, fields, name, "%s: in the schema but not in Config", join(path, name))
+		}
+		for name, fieldType := range fields {
+			child, ok := s.Properties[name]
+			if !assert.True(t, ok, "%s: in Config but not in the schema", join(path, name)) {
+				continue
+			}
+			if fieldType.Kind() == reflect.Struct {
+				check(join(path, name), child, fieldType)
+			}
+		}
+	}
+	check("", configSchema, reflect.TypeOf(Config{}))
+}
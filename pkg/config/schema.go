@@ -0,0 +1,243 @@
+package config
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//go:embed schema.json
+var schemaJSON []byte
+
+// Schema returns the JSON schema of the config file.
+func Schema() []byte {
+	return schemaJSON
+}
+
+// schema is the subset of JSON schema the config schema uses.
+type schema struct {
+	Ref                  string             `json:"$ref"`
+	Type                 string             `json:"type"`
+	Properties           map[string]*schema `json:"properties"`
+	AdditionalProperties json.RawMessage    `json:"additionalProperties"`
+	Items                *schema            `json:"items"`
+	Enum                 []string           `json:"enum"`
+	Pattern              string             `json:"pattern"`
+	Minimum              *float64           `json:"minimum"`
+	Defs                 map[string]*schema `json:"$defs"`
+}
+
+var configSchema = func() *schema {
+	s := &schema{}
+	if err := json.Unmarshal(schemaJSON, s); err != nil {
+		panic(fmt.Sprintf("config schema: %v", err))
+	}
+	return s
+}()
+
+// resolve returns the definition s refers to, or s itself.
+func (s *schema) resolve() *schema {
+	if name, ok := strings.CutPrefix(s.Ref, "#/$defs/"); ok {
+		return configSchema.Defs[name]
+	}
+	return s
+}
+
+// additional returns the schema of the fields which are not listed in the properties, nil if they are not allowed.
+func (s *schema) additional() *schema {
+	if len(s.AdditionalProperties) == 0 || string(s.AdditionalProperties) == "false" {
+		return nil
+	}
+	additional := &schema{}
+	if err := json.Unmarshal(s.AdditionalProperties, additional); err != nil {
+		panic(fmt.Sprintf("config schema: %v", err))
+	}
+	return additional
+}
+
+// field returns the schema of the field at the dotted path, nil if there is no such field.
+func (s *schema) field(path string) *schema {
+	s = s.resolve()
+	name, rest, nested := strings.Cut(path, ".")
+	child, ok := s.Properties[name]
+	if !ok {
+		return nil
+	}
+	if !nested {
+		return child.resolve()
+	}
+	return child.field(rest)
+}
+
+// validate returns an error naming the field for every violation of the schema by the value, sorted by field.
+// Null is allowed everywhere and leaves the field unset, like an empty key in YAML.
+func (s *schema) validate(path string, value any) []error {
+	s = s.resolve()
+	if value == nil {
+		return nil
+	}
+	fail := func(format string, args ...any) []error {
+		return []error{fmt.Errorf("%s: %s", displayPath(path), fmt.Sprintf(format, args...))}
+	}
+
+	switch s.Type {
+	case "object":
+		object, ok := value.(map[string]any)
+		if !ok {
+			return fail("must be an object, got %s", describe(value))
+		}
+		names := make([]string, 0, len(object))
+		for name := range object {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		var errs []error
+		for _, name := range names {
+			child, ok := s.Properties[name]
+			if !ok {
+				child = s.additional()
+			}
+			if child == nil {
+				errs = append(errs, fmt.Errorf("%s: unknown field", join(path, name)))
+				continue
+			}
+			errs = append(errs, child.validate(join(path, name), object[name])...)
+		}
+		return errs
+	case "array":
+		items, ok := value.([]any)
+		if !ok {
+			return fail("must be a list, got %s", describe(value))
+		}
+		var errs []error
+		for i, item := range items {
+			errs = append(errs, s.Items.validate(fmt.Sprintf("%s[%d]", path, i), item)...)
+		}
+		return errs
+	case "string":
+		str, ok := value.(string)
+		if !ok {
+			return fail("must be a string, got %s", describe(value))
+		}
+		if len(s.Enum) > 0 && !slices.Contains(s.Enum, str) {
+			return fail("must be one of %s, got %q", strings.Join(s.Enum, ", "), str)
+		}
+		if s.Pattern != "" && !regexp.MustCompile(s.Pattern).MatchString(str) {
+			return fail("%q does not match %s", str, s.Pattern)
+		}
+	case "integer":
+		number, ok := value.(float64)
+		if !ok || number != math.Trunc(number) {
+			return fail("must be an integer, got %s", describe(value))
+		}
+		if s.Minimum != nil && number < *s.Minimum {
+			return fail("must be at least %v, got %v", *s.Minimum, number)
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return fail("must be true or false, got %s", describe(value))
+		}
+	}
+	return nil
+}
+
+// values flattens the leaves of the value to the strings flags and environment variables take, by dotted path.
+// Lists are comma separated and maps are JSON, like the UOM flag.
+func (s *schema) values(path string, value any, values map[string]string) {
+	s = s.resolve()
+	if object, ok := value.(map[string]any); ok && s.Type == "object" && s.Properties != nil {
+		for name, child := range object {
+			if childSchema, ok := s.Properties[name]; ok {
+				childSchema.values(join(path, name), child, values)
+			}
+		}
+		return
+	}
+	switch v := value.(type) {
+	case nil:
+	case string:
+		values[path] = v
+	case float64:
+		values[path] = strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		values[path] = strconv.FormatBool(v)
+	case []any:
+		items := make([]string, len(v))
+		for i, item := range v {
+			items[i] = fmt.Sprint(item)
+		}
+		values[path] = strings.Join(items, ",")
+	default:
+		data, _ := json.Marshal(v)
+		values[path] = string(data)
+	}
+}
+
+// parse parses a value as given to flags and environment variables, the inverse of values.
+func (s *schema) parse(path, value string) (any, error) {
+	switch s.Type {
+	case "integer":
+		i, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s: must be an integer, got %q", path, value)
+		}
+		return float64(i), nil
+	case "boolean":
+		b, err := strconv.ParseBool(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("%s: must be true or false, got %q", path, value)
+		}
+		return b, nil
+	case "array":
+		items := []any{}
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		return items, nil
+	case "object":
+		var object map[string]any
+		if err := json.Unmarshal([]byte(value), &object); err != nil {
+			return nil, fmt.Errorf("%s: must be a JSON object: %w", path, err)
+		}
+		return object, nil
+	}
+	return value, nil
+}
+
+func join(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+func displayPath(path string) string {
+	if path == "" {
+		return "config"
+	}
+	return path
+}
+
+func describe(value any) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case map[string]any:
+		return "an object"
+	case []any:
+		return "a list"
+	case string:
+		return fmt.Sprintf("string %q", v)
+	case bool:
+		return fmt.Sprintf("boolean %t", v)
+	}
+	return fmt.Sprintf("number %v", value)
+}
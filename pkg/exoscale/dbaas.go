@@ -2,21 +2,53 @@ package exoscale
 
 import (
 	"context"
+	goerrors "errors"
 	"fmt"
+	"slices"
+	"sort"
+	"strings"
 	"time"
 
 	egoscale "github.com/exoscale/egoscale/v2"
-	"github.com/vshn/billing-collector-cloudservices/pkg/controlAPI"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/vshn/billing-collector-cloudservices/pkg/billing"
+	"github.com/vshn/billing-collector-cloudservices/pkg/catalog"
 	"github.com/vshn/billing-collector-cloudservices/pkg/kubernetes"
 	"github.com/vshn/billing-collector-cloudservices/pkg/log"
 	"github.com/vshn/billing-collector-cloudservices/pkg/odoo"
+	"github.com/vshn/billing-collector-cloudservices/pkg/salesorder"
+	"github.com/vshn/billing-collector-cloudservices/pkg/secret"
+	"github.com/vshn/billing-collector-cloudservices/pkg/uom"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	k8s "sigs.k8s.io/controller-runtime/pkg/client"
 )
 
-const productIdPrefix = "appcat-exoscale"
+// Names of the products in the catalog, and the provider their IDs are rendered with.
+const (
+	productDBaaS         = "exoscale-dbaas"
+	productObjectStorage = "exoscale-objectstorage"
+	provider             = "exoscale"
+)
+
+const (
+	// defaultZoneTimeout limits every attempt to list the database services of a zone, so that an unavailable zone does not hold up the others.
+	defaultZoneTimeout = 30 * time.Second
+	zoneAttempts       = 2
+)
+
+var (
+	zoneListings = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "billing_cloud_collector_exoscale_dbaas_zone_listings_total",
+		Help: "Total number of listings of the DBaaS services of an Exoscale zone, by zone and result (success or failure)",
+	}, []string{"zone", "result"})
+	zoneUp = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "billing_cloud_collector_exoscale_dbaas_zone_up",
+		Help: "Whether the DBaaS services of an Exoscale zone could be listed in the last run (1) or not (0), by zone",
+	}, []string{"zone"})
+)
 
 var (
 	groupVersionKinds = map[string]schema.GroupVersionKind{
@@ -63,42 +95,68 @@ type Detail struct {
 
 // DBaaS provides DBaaS Odoo info and required clients
 type DBaaS struct {
-	exoscaleClient   *egoscale.Client
-	k8sClient        k8s.Client
-	controlApiClient k8s.Client
-	salesOrder       string
-	clusterId        string
-	cloudZone        string
-	collectInterval  int
-	uomMapping       map[string]string
+	exoscaleClient  *secret.Client[egoscale.Client]
+	k8sClient       k8s.Client
+	salesOrders     *salesorder.Resolver
+	clusterId       string
+	cloudZone       string
+	collectInterval int
+	uomMapping      *uom.Mapping
+	products        *catalog.Catalog
+
+	zoneTimeout          time.Duration
+	listDatabaseServices func(ctx context.Context, zone string) ([]*egoscale.DatabaseService, error)
 }
 
 // NewDBaaS creates a Service with the initial setup
-func NewDBaaS(exoscaleClient *egoscale.Client, k8sClient k8s.Client, controlApiClient k8s.Client, collectInterval int, salesOrder, clusterId string, cloudZone string, uomMapping map[string]string) (*DBaaS, error) {
+func NewDBaaS(exoscaleClient *secret.Client[egoscale.Client], k8sClient k8s.Client, collectInterval int, salesOrders *salesorder.Resolver, clusterId string, cloudZone string, uomMapping *uom.Mapping, products *catalog.Catalog) (*DBaaS, error) {
 	return &DBaaS{
-		exoscaleClient:   exoscaleClient,
-		k8sClient:        k8sClient,
-		controlApiClient: controlApiClient,
-		salesOrder:       salesOrder,
-		clusterId:        clusterId,
-		cloudZone:        cloudZone,
-		collectInterval:  collectInterval,
-		uomMapping:       uomMapping,
+		exoscaleClient:  exoscaleClient,
+		k8sClient:       k8sClient,
+		salesOrders:     salesOrders,
+		clusterId:       clusterId,
+		cloudZone:       cloudZone,
+		collectInterval: collectInterval,
+		uomMapping:      uomMapping,
+		products:        products,
+		zoneTimeout:     defaultZoneTimeout,
+		listDatabaseServices: func(ctx context.Context, zone string) ([]*egoscale.DatabaseService, error) {
+			return exoscaleClient.Get().ListDatabaseServices(ctx, zone)
+		},
 	}, nil
 }
 
-func (ds *DBaaS) GetMetrics(ctx context.Context) ([]odoo.OdooMeteredBillingRecord, error) {
+// GetMetrics bills every DBaaS instance which currently exists for one instance hour in the given period.
+func (ds *DBaaS) GetMetrics(ctx context.Context, period odoo.TimeRange) ([]odoo.OdooMeteredBillingRecord, error) {
+	return ds.GetZoneMetrics(ctx, period, Zones)
+}
+
+// GetZoneMetrics is GetMetrics for the DBaaS instances in the given zones only, e.g. to bill the zones which were unavailable before.
+// If some of the zones fail, the records of the others are returned with a partial error naming the failed zones.
+func (ds *DBaaS) GetZoneMetrics(ctx context.Context, period odoo.TimeRange, zones []string) ([]odoo.OdooMeteredBillingRecord, error) {
 	detail, err := ds.fetchManagedDBaaSAndNamespaces(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("fetchManagedDBaaSAndNamespaces: %w", err)
 	}
+	// the instances in the other zones are billed on their own, those without known zone are looked up in the given zones
+	detail = slices.DeleteFunc(detail, func(d Detail) bool {
+		return slices.Contains(Zones, d.Zone) && !slices.Contains(zones, d.Zone)
+	})
 
-	usage, err := ds.fetchDBaaSUsage(ctx)
+	usage, failedZones, err := ds.fetchDBaaSUsage(ctx, zones)
 	if err != nil {
 		return nil, fmt.Errorf("fetchDBaaSUsage: %w", err)
 	}
 
-	return ds.AggregateDBaaS(ctx, usage, detail)
+	records, err := ds.AggregateDBaaS(ctx, usage, detail, failedZones, period)
+	if err != nil {
+		return nil, err
+	}
+	if len(failedZones) > 0 {
+		// the records of the other zones are billed, the failed zones are collected again on their own
+		return records, billing.Partial(fmt.Errorf("cannot list DBaaS services in zones %s", strings.Join(failedZones, ", ")), failedZones...)
+	}
+	return records, nil
 }
 
 // fetchManagedDBaaSAndNamespaces fetches instances and namespaces from kubernetes cluster
@@ -164,25 +222,72 @@ func findDBaaSDetailInNamespacesMap(ctx context.Context, resource metav1.Partial
 	return &dbaasDetail
 }
 
-// fetchDBaaSUsage gets DBaaS service usage from Exoscale
-func (ds *DBaaS) fetchDBaaSUsage(ctx context.Context) ([]*egoscale.DatabaseService, error) {
+// fetchDBaaSUsage gets DBaaS service usage from Exoscale, listing the given zones concurrently.
+// The services of the zones which failed twice are left out and the zones returned, sorted. It only fails if all zones fail.
+func (ds *DBaaS) fetchDBaaSUsage(ctx context.Context, zones []string) ([]*egoscale.DatabaseService, []string, error) {
 	logger := log.Logger(ctx)
 	logger.Info("Fetching DBaaS usage from Exoscale")
 
+	type result struct {
+		zone     string
+		services []*egoscale.DatabaseService
+		err      error
+	}
+	results := make(chan result, len(zones))
+	for _, zone := range zones {
+		go func(zone string) {
+			services, err := ds.listZone(ctx, zone)
+			results <- result{zone: zone, services: services, err: err}
+		}(zone)
+	}
+
 	var databaseServices []*egoscale.DatabaseService
-	for _, zone := range Zones {
-		databaseServicesByZone, err := ds.exoscaleClient.ListDatabaseServices(ctx, zone)
-		if err != nil {
-			logger.V(1).Error(err, "Cannot get exoscale database services on zone", "zone", zone)
-			return nil, err
+	var failedZones []string
+	var errs []error
+	for range zones {
+		r := <-results
+		if r.err != nil {
+			zoneListings.WithLabelValues(r.zone, "failure").Inc()
+			zoneUp.WithLabelValues(r.zone).Set(0)
+			logger.Error(r.err, "Cannot get exoscale database services on zone, not billing its DBaaS", "zone", r.zone)
+			failedZones = append(failedZones, r.zone)
+			errs = append(errs, fmt.Errorf("zone %s: %w", r.zone, r.err))
+			continue
 		}
-		databaseServices = append(databaseServices, databaseServicesByZone...)
+		zoneListings.WithLabelValues(r.zone, "success").Inc()
+		zoneUp.WithLabelValues(r.zone).Set(1)
+		databaseServices = append(databaseServices, r.services...)
 	}
-	return databaseServices, nil
+	if len(failedZones) > 0 && len(failedZones) == len(zones) {
+		return nil, nil, goerrors.Join(errs...)
+	}
+	sort.Strings(failedZones)
+	return databaseServices, failedZones, nil
 }
 
-// AggregateDBaaS aggregates DBaaS services by namespaces and plan
-func (ds *DBaaS) AggregateDBaaS(ctx context.Context, exoscaleDBaaS []*egoscale.DatabaseService, dbaasDetails []Detail) ([]odoo.OdooMeteredBillingRecord, error) {
+// listZone lists the database services of the zone, retrying once. Every attempt has its own timeout.
+func (ds *DBaaS) listZone(ctx context.Context, zone string) ([]*egoscale.DatabaseService, error) {
+	var err error
+	for attempt := 0; attempt < zoneAttempts; attempt++ {
+		if attempt > 0 {
+			log.Logger(ctx).V(1).Info("Retrying to list database services", "zone", zone, "reason", err.Error())
+		}
+		var services []*egoscale.DatabaseService
+		services, err = func() ([]*egoscale.DatabaseService, error) {
+			ctx, cancel := context.WithTimeout(ctx, ds.zoneTimeout)
+			defer cancel()
+			return ds.listDatabaseServices(ctx, zone)
+		}()
+		if err == nil || ctx.Err() != nil {
+			return services, err
+		}
+	}
+	return nil, err
+}
+
+// AggregateDBaaS aggregates DBaaS services by namespaces and plan for the given billing period.
+// Services created after the period are left out, as are the DBaaS in the failed zones, whose services could not be listed.
+func (ds *DBaaS) AggregateDBaaS(ctx context.Context, exoscaleDBaaS []*egoscale.DatabaseService, dbaasDetails []Detail, failedZones []string, period odoo.TimeRange) ([]odoo.OdooMeteredBillingRecord, error) {
 	logger := log.Logger(ctx)
 	logger.Info("Aggregating DBaaS instances by namespace and plan")
 
@@ -192,15 +297,11 @@ func (ds *DBaaS) AggregateDBaaS(ctx context.Context, exoscaleDBaaS []*egoscale.D
 		dbaasServiceUsageMap[*usage.Name] = *usage
 	}
 
-	location, err := time.LoadLocation("Europe/Zurich")
+	salesOrders, err := ds.salesOrders.Lookup(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("load loaction: %w", err)
+		return nil, fmt.Errorf("cannot look up sales orders: %w", err)
 	}
 
-	now := time.Now().In(location)
-	billingDateStart := time.Date(now.Year(), now.Month(), now.Day(), now.Hour(), 0, 0, 0, now.Location()).In(time.UTC)
-	billingDateEnd := time.Date(now.Year(), now.Month(), now.Day(), now.Hour()+1, 0, 0, 0, now.Location()).In(time.UTC)
-
 	records := make([]odoo.OdooMeteredBillingRecord, 0)
 	for _, dbaasDetail := range dbaasDetails {
 		logger.V(1).Info("Checking DBaaS", "instance", dbaasDetail.DBName)
@@ -208,35 +309,48 @@ func (ds *DBaaS) AggregateDBaaS(ctx context.Context, exoscaleDBaaS []*egoscale.D
 		dbaasUsage, exists := dbaasServiceUsageMap[dbaasDetail.DBName]
 		if exists && dbaasDetail.Kind == groupVersionKinds[*dbaasUsage.Type].Kind {
 			logger.V(1).Info("Found exoscale dbaas usage", "instance", dbaasUsage.Name, "instance created", dbaasUsage.CreatedAt)
+			if dbaasUsage.CreatedAt != nil && !dbaasUsage.CreatedAt.Before(period.To) {
+				// when catching up on past periods, instances which did not exist yet are not billed
+				logger.V(1).Info("DBaaS was created after the billing period, skipping", "instance", dbaasDetail.DBName)
+				continue
+			}
+
+			salesOrder, billable, err := salesOrders.SalesOrder(ctx, dbaasDetail.Namespace, dbaasDetail.Organization)
+			if err != nil {
+				logger.Error(err, "Unable to sync DBaaS, cannot get salesOrder", "namespace", dbaasDetail.Namespace)
+				continue
+			}
+			if !billable {
+				logger.V(1).Info("Namespace is not billable, skipping", "instance", dbaasDetail.DBName, "namespace", dbaasDetail.Namespace)
+				continue
+			}
 
 			itemGroup := fmt.Sprintf("APPUiO Managed - Cluster: %s / Namespace: %s", ds.clusterId, dbaasDetail.Namespace)
-			instanceId := fmt.Sprintf("%s/%s", dbaasDetail.Zone, dbaasDetail.DBName)
-			salesOrder := ds.salesOrder
-			if salesOrder == "" {
+			if !ds.salesOrders.Managed() {
 				itemGroup = fmt.Sprintf("APPUiO Cloud - Zone: %s / Namespace: %s", ds.cloudZone, dbaasDetail.Namespace)
-				salesOrder, err = controlAPI.GetSalesOrder(ctx, ds.controlApiClient, dbaasDetail.Organization)
-				if err != nil {
-					logger.Error(err, "Unable to sync DBaaS, cannot get salesOrder", "namespace", dbaasDetail.Namespace)
-					continue
-				}
+			}
+			instanceId := fmt.Sprintf("%s/%s", dbaasDetail.Zone, dbaasDetail.DBName)
+
+			productID, err := ds.products.ProductID(productDBaaS, period.From, catalog.Fields{Provider: provider, Service: *dbaasUsage.Type, Plan: *dbaasUsage.Plan, Zone: dbaasDetail.Zone})
+			if err != nil {
+				return nil, err
 			}
 
 			o := odoo.OdooMeteredBillingRecord{
-				ProductID:            productIdPrefix + fmt.Sprintf("-v2-%s-%s", *dbaasUsage.Type, *dbaasUsage.Plan),
+				ProductID:            productID,
 				InstanceID:           instanceId,
 				ItemDescription:      dbaasDetail.DBName,
 				ItemGroupDescription: itemGroup,
 				SalesOrder:           salesOrder,
-				UnitID:               ds.uomMapping[odoo.InstanceHour],
+				UnitID:               ds.uomMapping.UnitID(odoo.InstanceHour),
 				ConsumedUnits:        1,
-				TimeRange: odoo.TimeRange{
-					From: billingDateStart,
-					To:   billingDateEnd,
-				},
+				TimeRange:            period,
 			}
 
 			records = append(records, o)
 
+		} else if slices.Contains(failedZones, dbaasDetail.Zone) {
+			logger.Info("Zone of DBaaS is unavailable, not billing it until the zone is back", "instance", dbaasDetail.DBName, "zone", dbaasDetail.Zone)
 		} else {
 			logger.Info("Could not find any DBaaS on exoscale", "instance", dbaasDetail.DBName)
 		}
@@ -245,9 +359,5 @@ func (ds *DBaaS) AggregateDBaaS(ctx context.Context, exoscaleDBaaS []*egoscale.D
 	return records, nil
 }
 
-func CheckDBaaSUOMExistence(mapping map[string]string) error {
-	if mapping[odoo.InstanceHour] == "" {
-		return fmt.Errorf("missing UOM mapping %s", odoo.InstanceHour)
-	}
-	return nil
-}
+// DBaaSUnits are the units of measure the DBaaS collector needs in the UOM mapping.
+var DBaaSUnits = []string{odoo.InstanceHour}
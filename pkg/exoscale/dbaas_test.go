@@ -2,22 +2,33 @@ package exoscale
 
 import (
 	"context"
+	"errors"
+	"slices"
+	"sort"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	egoscale "github.com/exoscale/egoscale/v2"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vshn/billing-collector-cloudservices/pkg/catalog"
 	"github.com/vshn/billing-collector-cloudservices/pkg/exofixtures"
 	"github.com/vshn/billing-collector-cloudservices/pkg/log"
 	"github.com/vshn/billing-collector-cloudservices/pkg/odoo"
+	"github.com/vshn/billing-collector-cloudservices/pkg/salesorder"
+	"github.com/vshn/billing-collector-cloudservices/pkg/uom"
 )
 
 func TestDBaaS_aggregatedDBaaS(t *testing.T) {
 	ctx := getTestContext(t)
 
-	location, _ := time.LoadLocation("Europe/Zurich")
-
-	now := time.Now().In(location)
+	// a past hour, as when backfilling
+	period := odoo.TimeRange{
+		From: time.Date(2024, 3, 1, 13, 0, 0, 0, time.UTC),
+		To:   time.Date(2024, 3, 1, 14, 0, 0, 0, time.UTC),
+	}
 	record1 := odoo.OdooMeteredBillingRecord{
 		ProductID:            "appcat-exoscale-v2-pg-hobbyist-2",
 		InstanceID:           "ch-gva-2/postgres-abc",
@@ -26,10 +37,7 @@ func TestDBaaS_aggregatedDBaaS(t *testing.T) {
 		SalesOrder:           "1234",
 		UnitID:               "",
 		ConsumedUnits:        1,
-		TimeRange: odoo.TimeRange{
-			From: time.Date(now.Year(), now.Month(), now.Day(), now.Hour(), 0, 0, 0, now.Location()).In(time.UTC),
-			To:   time.Date(now.Year(), now.Month(), now.Day(), now.Hour()+1, 0, 0, 0, now.Location()).In(time.UTC),
-		},
+		TimeRange:            period,
 	}
 	record2 := odoo.OdooMeteredBillingRecord{
 		ProductID:            "appcat-exoscale-v2-pg-business-128",
@@ -39,10 +47,7 @@ func TestDBaaS_aggregatedDBaaS(t *testing.T) {
 		SalesOrder:           "1234",
 		UnitID:               "",
 		ConsumedUnits:        1,
-		TimeRange: odoo.TimeRange{
-			From: time.Date(now.Year(), now.Month(), now.Day(), now.Hour(), 0, 0, 0, now.Location()).In(time.UTC),
-			To:   time.Date(now.Year(), now.Month(), now.Day(), now.Hour()+1, 0, 0, 0, now.Location()).In(time.UTC),
-		},
+		TimeRange:            period,
 	}
 
 	expectedAggregatedOdooRecords := []odoo.OdooMeteredBillingRecord{record1, record2}
@@ -50,6 +55,7 @@ func TestDBaaS_aggregatedDBaaS(t *testing.T) {
 	tests := map[string]struct {
 		dbaasDetails                  []Detail
 		exoscaleDBaaS                 []*egoscale.DatabaseService
+		salesOrderRules               []salesorder.Rule
 		expectedAggregatedOdooRecords []odoo.OdooMeteredBillingRecord
 	}{
 		"given DBaaS details and Exoscale DBaasS, we should get the ExpectedAggregatedDBaasS": {
@@ -83,6 +89,78 @@ func TestDBaaS_aggregatedDBaaS(t *testing.T) {
 			},
 			expectedAggregatedOdooRecords: expectedAggregatedOdooRecords,
 		},
+		"given a DBaaS created after the billing period, we should not bill it for the period": {
+			dbaasDetails: []Detail{
+				{
+					Organization: "org1",
+					DBName:       "postgres-abc",
+					Namespace:    "vshn-xyz",
+					Zone:         "ch-gva-2",
+					Kind:         "PostgreSQLList",
+				},
+				{
+					Organization: "org2",
+					DBName:       "postgres-def",
+					Namespace:    "vshn-uvw",
+					Zone:         "ch-gva-2",
+					Kind:         "PostgreSQLList",
+				},
+			},
+			exoscaleDBaaS: []*egoscale.DatabaseService{
+				{
+					Name:      strToPointer("postgres-abc"),
+					Type:      strToPointer(string(exofixtures.PostgresDBaaSType)),
+					Plan:      strToPointer("hobbyist-2"),
+					CreatedAt: timeToPointer(period.From.Add(-24 * time.Hour)),
+				},
+				{
+					Name:      strToPointer("postgres-def"),
+					Type:      strToPointer(string(exofixtures.PostgresDBaaSType)),
+					Plan:      strToPointer("business-128"),
+					CreatedAt: timeToPointer(period.To),
+				},
+			},
+			expectedAggregatedOdooRecords: []odoo.OdooMeteredBillingRecord{record1},
+		},
+		"given sales order rules, we should bill namespaces to the sales order of their rule and skip those not billable": {
+			dbaasDetails: []Detail{
+				{
+					Organization: "org1",
+					DBName:       "postgres-abc",
+					Namespace:    "vshn-xyz",
+					Zone:         "ch-gva-2",
+					Kind:         "PostgreSQLList",
+				},
+				{
+					Organization: "org2",
+					DBName:       "postgres-def",
+					Namespace:    "vshn-uvw",
+					Zone:         "ch-gva-2",
+					Kind:         "PostgreSQLList",
+				},
+			},
+			exoscaleDBaaS: []*egoscale.DatabaseService{
+				{
+					Name: strToPointer("postgres-abc"),
+					Type: strToPointer(string(exofixtures.PostgresDBaaSType)),
+					Plan: strToPointer("hobbyist-2"),
+				},
+				{
+					Name: strToPointer("postgres-def"),
+					Type: strToPointer(string(exofixtures.PostgresDBaaSType)),
+					Plan: strToPointer("business-128"),
+				},
+			},
+			salesOrderRules: []salesorder.Rule{
+				{Namespace: "vshn-x*", Billable: boolToPointer(false)},
+				{Organization: "org2", SalesOrder: "5678"},
+			},
+			expectedAggregatedOdooRecords: []odoo.OdooMeteredBillingRecord{func() odoo.OdooMeteredBillingRecord {
+				r := record2
+				r.SalesOrder = "5678"
+				return r
+			}()},
+		},
 		"given DBaaS details and different names in Exoscale DBaasS, we should not get the ExpectedAggregatedDBaasS": {
 			dbaasDetails: []Detail{
 				{
@@ -117,18 +195,125 @@ func TestDBaaS_aggregatedDBaaS(t *testing.T) {
 
 	for name, tc := range tests {
 		t.Run(name, func(t *testing.T) {
-			ds, _ := NewDBaaS(nil, nil, nil, 1, "1234", "c-test1", "", map[string]string{})
-			aggregatedOdooRecords, err := ds.AggregateDBaaS(ctx, tc.exoscaleDBaaS, tc.dbaasDetails)
+			ds, _ := NewDBaaS(nil, nil, 1, salesorder.NewResolver(tc.salesOrderRules, "1234", nil, nil), "c-test1", "", uom.Fixed(map[string]string{}), catalog.Default())
+			aggregatedOdooRecords, err := ds.AggregateDBaaS(ctx, tc.exoscaleDBaaS, tc.dbaasDetails, nil, period)
 			assert.NoError(t, err)
 			assert.Equal(t, tc.expectedAggregatedOdooRecords, aggregatedOdooRecords)
 		})
 	}
 }
 
+func TestDBaaS_fetchDBaaSUsage(t *testing.T) {
+	ctx := getTestContext(t)
+
+	tests := map[string]struct {
+		zones         []string
+		list          func(ctx context.Context, zone string) ([]*egoscale.DatabaseService, error)
+		expectedNames []string
+		failedZones   []string
+		expectedError string
+	}{
+		"given all zones available, we should get the services of all zones": {
+			list: func(ctx context.Context, zone string) ([]*egoscale.DatabaseService, error) {
+				return []*egoscale.DatabaseService{{Name: strToPointer("pg-" + zone)}}, nil
+			},
+			expectedNames: []string{"pg-at-vie-1", "pg-bg-sof-1", "pg-ch-dk-2", "pg-ch-gva-2", "pg-de-fra-1", "pg-de-muc-1"},
+		},
+		"given a failing and a hanging zone, we should get the services of the other zones": {
+			list: func(ctx context.Context, zone string) ([]*egoscale.DatabaseService, error) {
+				switch zone {
+				case "de-muc-1":
+					return nil, errors.New("service unavailable")
+				case "bg-sof-1":
+					<-ctx.Done()
+					return nil, ctx.Err()
+				}
+				return []*egoscale.DatabaseService{{Name: strToPointer("pg-" + zone)}}, nil
+			},
+			expectedNames: []string{"pg-at-vie-1", "pg-ch-dk-2", "pg-ch-gva-2", "pg-de-fra-1"},
+			failedZones:   []string{"bg-sof-1", "de-muc-1"},
+		},
+		"given a zone failing once, we should get its services on retry": {
+			list: func() func(ctx context.Context, zone string) ([]*egoscale.DatabaseService, error) {
+				var failed atomic.Bool
+				return func(ctx context.Context, zone string) ([]*egoscale.DatabaseService, error) {
+					if zone == "ch-dk-2" && !failed.Swap(true) {
+						return nil, errors.New("connection reset")
+					}
+					return []*egoscale.DatabaseService{{Name: strToPointer("pg-" + zone)}}, nil
+				}
+			}(),
+			expectedNames: []string{"pg-at-vie-1", "pg-bg-sof-1", "pg-ch-dk-2", "pg-ch-gva-2", "pg-de-fra-1", "pg-de-muc-1"},
+		},
+		"given some zones, we should get only their services": {
+			zones: []string{"ch-dk-2", "de-muc-1"},
+			list: func(ctx context.Context, zone string) ([]*egoscale.DatabaseService, error) {
+				if zone == "de-muc-1" {
+					return nil, errors.New("service unavailable")
+				}
+				return []*egoscale.DatabaseService{{Name: strToPointer("pg-" + zone)}}, nil
+			},
+			expectedNames: []string{"pg-ch-dk-2"},
+			failedZones:   []string{"de-muc-1"},
+		},
+		"given all zones failing, we should get an error": {
+			list: func(ctx context.Context, zone string) ([]*egoscale.DatabaseService, error) {
+				return nil, errors.New("service unavailable")
+			},
+			failedZones:   Zones,
+			expectedError: "zone at-vie-1: service unavailable",
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			ds := &DBaaS{zoneTimeout: 10 * time.Millisecond, listDatabaseServices: tc.list}
+			zones := tc.zones
+			if zones == nil {
+				zones = Zones
+			}
+			failures := map[string]float64{}
+			for _, zone := range zones {
+				failures[zone] = testutil.ToFloat64(zoneListings.WithLabelValues(zone, "failure"))
+			}
+
+			services, failedZones, err := ds.fetchDBaaSUsage(ctx, zones)
+			if tc.expectedError != "" {
+				assert.ErrorContains(t, err, tc.expectedError)
+			} else {
+				require.NoError(t, err)
+				assert.Equal(t, tc.failedZones, failedZones)
+			}
+			var names []string
+			for _, s := range services {
+				names = append(names, *s.Name)
+			}
+			sort.Strings(names)
+			assert.Equal(t, tc.expectedNames, names)
+
+			for _, zone := range zones {
+				failed, up := 0.0, 1.0
+				if slices.Contains(tc.failedZones, zone) {
+					failed, up = 1, 0
+				}
+				assert.Equal(t, failures[zone]+failed, testutil.ToFloat64(zoneListings.WithLabelValues(zone, "failure")), "failures of zone %s", zone)
+				assert.Equal(t, up, testutil.ToFloat64(zoneUp.WithLabelValues(zone)), "zone %s up", zone)
+			}
+		})
+	}
+}
+
+func boolToPointer(b bool) *bool {
+	return &b
+}
+
 func strToPointer(s string) *string {
 	return &s
 }
 
+func timeToPointer(t time.Time) *time.Time {
+	return &t
+}
+
 func getTestContext(t assert.TestingT) context.Context {
 	logger, err := log.NewLogger("test", time.Now().String(), 1, "console")
 	assert.NoError(t, err, "cannot create logger")
@@ -3,35 +3,33 @@ package exoscale
 import (
 	"context"
 	"fmt"
-	"time"
 
 	egoscale "github.com/exoscale/egoscale/v2"
 	"github.com/exoscale/egoscale/v2/oapi"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/vshn/billing-collector-cloudservices/pkg/controlAPI"
+	"github.com/vshn/billing-collector-cloudservices/pkg/catalog"
 	"github.com/vshn/billing-collector-cloudservices/pkg/exofixtures"
 	"github.com/vshn/billing-collector-cloudservices/pkg/kubernetes"
 	"github.com/vshn/billing-collector-cloudservices/pkg/log"
 	"github.com/vshn/billing-collector-cloudservices/pkg/odoo"
+	"github.com/vshn/billing-collector-cloudservices/pkg/salesorder"
+	"github.com/vshn/billing-collector-cloudservices/pkg/secret"
+	"github.com/vshn/billing-collector-cloudservices/pkg/uom"
 	exoscalev1 "github.com/vshn/provider-exoscale/apis/exoscale/v1"
 
 	k8s "sigs.k8s.io/controller-runtime/pkg/client"
 )
 
-const productIdStorageTier1 = "appcat-exoscale-objectstorage-storage-tier-1"
-const productIdStorageTier2 = "appcat-exoscale-objectstorage-storage-tier-2"
-const productIdStorageTier3 = "appcat-exoscale-objectstorage-storage-tier-3"
-
 // ObjectStorage gathers bucket data from exoscale provider and cluster and saves to the database
 type ObjectStorage struct {
-	k8sClient        k8s.Client
-	exoscaleClient   *egoscale.Client
-	controlApiClient k8s.Client
-	salesOrder       string
-	clusterId        string
-	cloudZone        string
-	uomMapping       map[string]string
-	providerMetrics  map[string]prometheus.Counter
+	k8sClient       k8s.Client
+	exoscaleClient  *secret.Client[egoscale.Client]
+	salesOrders     *salesorder.Resolver
+	clusterId       string
+	cloudZone       string
+	uomMapping      *uom.Mapping
+	products        *catalog.Catalog
+	providerMetrics map[string]prometheus.Counter
 }
 
 // BucketDetail a k8s bucket object with relevant data
@@ -40,20 +38,21 @@ type BucketDetail struct {
 }
 
 // NewObjectStorage creates an ObjectStorage with the initial setup
-func NewObjectStorage(exoscaleClient *egoscale.Client, k8sClient k8s.Client, controlApiClient k8s.Client, salesOrder, clusterId string, cloudZone string, uomMapping map[string]string, providerMetrics map[string]prometheus.Counter) (*ObjectStorage, error) {
+func NewObjectStorage(exoscaleClient *secret.Client[egoscale.Client], k8sClient k8s.Client, salesOrders *salesorder.Resolver, clusterId string, cloudZone string, uomMapping *uom.Mapping, products *catalog.Catalog, providerMetrics map[string]prometheus.Counter) (*ObjectStorage, error) {
 	return &ObjectStorage{
-		k8sClient:        k8sClient,
-		exoscaleClient:   exoscaleClient,
-		controlApiClient: controlApiClient,
-		salesOrder:       salesOrder,
-		clusterId:        clusterId,
-		cloudZone:        cloudZone,
-		uomMapping:       uomMapping,
-		providerMetrics:  providerMetrics,
+		k8sClient:       k8sClient,
+		exoscaleClient:  exoscaleClient,
+		salesOrders:     salesOrders,
+		clusterId:       clusterId,
+		cloudZone:       cloudZone,
+		uomMapping:      uomMapping,
+		products:        products,
+		providerMetrics: providerMetrics,
 	}, nil
 }
 
-func (o *ObjectStorage) GetMetrics(ctx context.Context) ([]odoo.OdooMeteredBillingRecord, error) {
+// GetMetrics bills the current size of every bucket for the given period, usually a day.
+func (o *ObjectStorage) GetMetrics(ctx context.Context, period odoo.TimeRange) ([]odoo.OdooMeteredBillingRecord, error) {
 	detail, err := o.fetchManagedBucketsAndNamespaces(ctx)
 	if err != nil {
 		o.providerMetrics["providerFailed"].Inc()
@@ -62,7 +61,7 @@ func (o *ObjectStorage) GetMetrics(ctx context.Context) ([]odoo.OdooMeteredBilli
 		o.providerMetrics["providerSucceeded"].Inc()
 	}
 
-	metrics, err := o.getBucketUsage(ctx, detail)
+	metrics, err := o.getBucketUsage(ctx, detail, period)
 	if err != nil {
 		return nil, fmt.Errorf("getBucketUsage: %w", err)
 	}
@@ -71,11 +70,11 @@ func (o *ObjectStorage) GetMetrics(ctx context.Context) ([]odoo.OdooMeteredBilli
 
 // getBucketUsage gets bucket usage from Exoscale and matches them with the bucket from the cluster
 // If there are no buckets in Exoscale, the API will return an empty slice
-func (o *ObjectStorage) getBucketUsage(ctx context.Context, bucketDetails []BucketDetail) ([]odoo.OdooMeteredBillingRecord, error) {
+func (o *ObjectStorage) getBucketUsage(ctx context.Context, bucketDetails []BucketDetail, period odoo.TimeRange) ([]odoo.OdooMeteredBillingRecord, error) {
 	logger := log.Logger(ctx)
 	logger.Info("Fetching bucket usage from Exoscale")
 
-	resp, err := o.exoscaleClient.ListSosBucketsUsageWithResponse(ctx)
+	resp, err := o.exoscaleClient.Get().ListSosBucketsUsageWithResponse(ctx)
 	if err != nil {
 		o.providerMetrics["providerFailed"].Inc()
 		return nil, err
@@ -83,7 +82,7 @@ func (o *ObjectStorage) getBucketUsage(ctx context.Context, bucketDetails []Buck
 		o.providerMetrics["providerSucceeded"].Inc()
 	}
 
-	odooMetrics, err := o.getOdooMeteredBillingRecords(ctx, *resp.JSON200.SosBucketsUsage, bucketDetails)
+	odooMetrics, err := o.getOdooMeteredBillingRecords(ctx, *resp.JSON200.SosBucketsUsage, bucketDetails, period)
 	if err != nil {
 		return nil, err
 	}
@@ -95,7 +94,7 @@ func (o *ObjectStorage) getBucketUsage(ctx context.Context, bucketDetails []Buck
 	return odooMetrics, nil
 }
 
-func (o *ObjectStorage) getOdooMeteredBillingRecords(ctx context.Context, sosBucketsUsage []oapi.SosBucketUsage, bucketDetails []BucketDetail) ([]odoo.OdooMeteredBillingRecord, error) {
+func (o *ObjectStorage) getOdooMeteredBillingRecords(ctx context.Context, sosBucketsUsage []oapi.SosBucketUsage, bucketDetails []BucketDetail, period odoo.TimeRange) ([]odoo.OdooMeteredBillingRecord, error) {
 	logger := log.Logger(ctx)
 	logger.Info("Aggregating buckets by namespace")
 
@@ -104,14 +103,11 @@ func (o *ObjectStorage) getOdooMeteredBillingRecords(ctx context.Context, sosBuc
 		sosBucketsUsageMap[*usage.Name] = usage
 	}
 
-	location, err := time.LoadLocation("Europe/Zurich")
+	salesOrders, err := o.salesOrders.Lookup(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("load loaction: %w", err)
+		return nil, fmt.Errorf("cannot look up sales orders: %w", err)
 	}
 
-	now := time.Now().In(location)
-	billingDate := time.Date(now.Year(), now.Month(), now.Day()-1, 0, 0, 0, 0, now.Location()).In(time.UTC)
-
 	aggregatedBuckets := make([]odoo.OdooMeteredBillingRecord, 0)
 	for _, bucketDetail := range bucketDetails {
 		logger.V(1).Info("Checking bucket", "bucket", bucketDetail.BucketName)
@@ -123,30 +119,36 @@ func (o *ObjectStorage) getOdooMeteredBillingRecords(ctx context.Context, sosBuc
 				return nil, err
 			}
 
+			salesOrder, billable, err := salesOrders.SalesOrder(ctx, bucketDetail.Namespace, bucketDetail.Organization)
+			if err != nil {
+				logger.Error(err, "unable to sync bucket", "namespace", bucketDetail.Namespace)
+				continue
+			}
+			if !billable {
+				logger.V(1).Info("Namespace is not billable, skipping", "bucket", bucketDetail.BucketName, "namespace", bucketDetail.Namespace)
+				continue
+			}
+
 			itemGroup := fmt.Sprintf("APPUiO Managed - Cluster: %s / Namespace: %s", o.clusterId, bucketDetail.Namespace)
-			instanceId := fmt.Sprintf("%s/%s", bucketDetail.Zone, bucketDetail.BucketName)
-			salesOrder := o.salesOrder
-			if salesOrder == "" {
+			if !o.salesOrders.Managed() {
 				itemGroup = fmt.Sprintf("APPUiO Cloud - Zone: %s / Namespace: %s", o.cloudZone, bucketDetail.Namespace)
-				salesOrder, err = controlAPI.GetSalesOrder(ctx, o.controlApiClient, bucketDetail.Organization)
-				if err != nil {
-					logger.Error(err, "unable to sync bucket", "namespace", bucketDetail.Namespace)
-					continue
-				}
+			}
+			instanceId := fmt.Sprintf("%s/%s", bucketDetail.Zone, bucketDetail.BucketName)
+
+			productID, err := o.products.ProductID(productObjectStorage, period.From, catalog.Fields{Provider: provider, Service: "objectstorage", Tier: storageTier(value), Zone: bucketDetail.Zone})
+			if err != nil {
+				return nil, err
 			}
 
 			o := odoo.OdooMeteredBillingRecord{
-				ProductID:            getProductId(value),
+				ProductID:            productID,
 				InstanceID:           instanceId + "/storage",
 				ItemDescription:      bucketDetail.BucketName,
 				ItemGroupDescription: itemGroup,
 				SalesOrder:           salesOrder,
-				UnitID:               o.uomMapping[odoo.GBDay],
+				UnitID:               o.uomMapping.UnitID(odoo.GBDay),
 				ConsumedUnits:        value,
-				TimeRange: odoo.TimeRange{
-					From: billingDate,
-					To:   billingDate.AddDate(0, 0, 1),
-				},
+				TimeRange:            period,
 			}
 
 			aggregatedBuckets = append(aggregatedBuckets, o)
@@ -158,17 +160,17 @@ func (o *ObjectStorage) getOdooMeteredBillingRecords(ctx context.Context, sosBuc
 	return aggregatedBuckets, nil
 }
 
-// getProductId calculates the tier based on the bucket storage consumption
+// storageTier calculates the tier based on the bucket storage consumption
 // For more details https://www.exoscale.com/object-storage/
 // Value is passed as GiB
-func getProductId(value float64) string {
+func storageTier(value float64) string {
 	valueTB := value / 1024
 	if valueTB < 512 {
-		return productIdStorageTier1
+		return "1"
 	} else if valueTB > 1024 {
-		return productIdStorageTier3
+		return "3"
 	} else {
-		return productIdStorageTier2
+		return "2"
 	}
 }
 
@@ -229,12 +231,8 @@ func addOrgAndNamespaceToBucket(ctx context.Context, buckets exoscalev1.BucketLi
 	return bucketDetails
 }
 
-func CheckObjectStorageUOMExistence(mapping map[string]string) error {
-	if mapping[odoo.GBDay] == "" {
-		return fmt.Errorf("missing UOM mapping %s", odoo.GBDay)
-	}
-	return nil
-}
+// ObjectStorageUnits are the units of measure the object storage collector needs in the UOM mapping.
+var ObjectStorageUnits = []string{odoo.GBDay}
 
 func adjustStorageSizeUnit(value float64) (float64, error) {
 	sosUnit := exofixtures.ObjectStorage.Query.Unit
@@ -27,6 +27,23 @@ const (
 // If kubeconfig (path to it) is supplied, that takes precedence. Its use is mainly for local development
 // since local clusters usually don't have a valid certificate.
 func NewClient(kubeconfig, url, token string) (client.Client, error) {
+	config, err := NewConfig(kubeconfig, url, token)
+	if err != nil {
+		return nil, fmt.Errorf("cannot initialize k8s client: %w", err)
+	}
+	return newClient(config)
+}
+
+// NewClientWithTokenFile creates a k8s client from the server url and the token in tokenFile, e.g. a mounted Secret volume.
+// The file is re-read periodically, so that a rotated token is used without restart.
+func NewClientWithTokenFile(url, tokenFile string) (client.Client, error) {
+	if url == "" {
+		return nil, fmt.Errorf("cannot initialize k8s client: url is required with a token file")
+	}
+	return newClient(&rest.Config{Host: url, BearerTokenFile: tokenFile})
+}
+
+func newClient(config *rest.Config) (client.Client, error) {
 	scheme := runtime.NewScheme()
 	if err := corev1.AddToScheme(scheme); err != nil {
 		return nil, fmt.Errorf("core scheme: %w", err)
@@ -41,30 +58,22 @@ func NewClient(kubeconfig, url, token string) (client.Client, error) {
 		return nil, fmt.Errorf("control api org scheme: %w", err)
 	}
 
-	var c client.Client
-	var err error
-	config, err := restConfig(kubeconfig, url, token)
+	c, err := client.New(config, client.Options{
+		Scheme: scheme,
+	})
 	if err != nil {
-		return nil, fmt.Errorf("cannot initialize k8s client: %w", err)
-	}
-	if kubeconfig != "" || (url != "" && token != "") {
-		c, err = client.New(config, client.Options{
-			Scheme: scheme,
-		})
-		if err != nil {
-			return nil, fmt.Errorf("cannot create new k8s client: %w", err)
-		}
-	} else {
-		c, err = client.New(ctrl.GetConfigOrDie(), client.Options{
-			Scheme: scheme,
-		})
-	}
-
-	if err != nil {
-		return nil, fmt.Errorf("cannot initialize k8s client: %w", err)
+		return nil, fmt.Errorf("cannot create new k8s client: %w", err)
 	}
 	return c, nil
+}
 
+// NewConfig returns the config NewClient connects with: the kubeconfig if supplied, else the server url and token if both are set,
+// else the in-cluster config or the default kubeconfig.
+func NewConfig(kubeconfig, url, token string) (*rest.Config, error) {
+	if kubeconfig != "" || (url != "" && token != "") {
+		return restConfig(kubeconfig, url, token)
+	}
+	return ctrl.GetConfig()
 }
 
 func restConfig(kubeconfig string, url string, token string) (*rest.Config, error) {
@@ -76,6 +85,24 @@ func restConfig(kubeconfig string, url string, token string) (*rest.Config, erro
 }
 
 func FetchNamespaceWithOrganizationMap(ctx context.Context, k8sClient client.Client) (map[string]string, error) {
+	labels, err := FetchNamespaceLabels(ctx, k8sClient)
+	if err != nil {
+		return nil, err
+	}
+
+	namespaces := map[string]string{}
+	for ns, nsLabels := range labels {
+		orgLabel, ok := nsLabels[OrganizationLabel]
+		if !ok {
+			continue
+		}
+		namespaces[ns] = orgLabel
+	}
+	return namespaces, nil
+}
+
+// FetchNamespaceLabels returns the labels of every namespace by namespace name.
+func FetchNamespaceLabels(ctx context.Context, k8sClient client.Client) (map[string]map[string]string, error) {
 
 	gvk := schema.GroupVersionKind{
 		Group:   "",
@@ -90,13 +117,9 @@ func FetchNamespaceWithOrganizationMap(ctx context.Context, k8sClient client.Cli
 		return nil, fmt.Errorf("cannot get namespace list: %w", err)
 	}
 
-	namespaces := map[string]string{}
+	namespaces := make(map[string]map[string]string, len(list.Items))
 	for _, ns := range list.Items {
-		orgLabel, ok := ns.GetLabels()[OrganizationLabel]
-		if !ok {
-			continue
-		}
-		namespaces[ns.GetName()] = orgLabel
+		namespaces[ns.GetName()] = ns.GetLabels()
 	}
 	return namespaces, nil
 }
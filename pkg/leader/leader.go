@@ -0,0 +1,143 @@
+// Package leader elects one of several replicas of the collector with a Kubernetes Lease, so that only one of them bills.
+package leader
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	coordinationv1 "k8s.io/client-go/kubernetes/typed/coordination/v1"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+var isLeader = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "billing_cloud_collector_leader",
+	Help: "1 if this replica holds the lease and runs the collectors, 0 if it is on standby",
+}, []string{"lease"})
+
+// DefaultLeaseDuration is how long the other replicas wait before they take over from a leader which stopped renewing the lease.
+const DefaultLeaseDuration = 15 * time.Second
+
+// Elector runs a function only while this replica holds the lease.
+type Elector struct {
+	logger        logr.Logger
+	lock          *resourcelock.LeaseLock
+	leaseDuration time.Duration
+}
+
+// New creates an Elector competing for the Lease namespace/name as identity, which must be unique among the replicas.
+func New(logger logr.Logger, client coordinationv1.LeasesGetter, namespace, name, identity string, leaseDuration time.Duration) *Elector {
+	return &Elector{
+		logger: logger.WithValues("lease", namespace+"/"+name, "identity", identity),
+		lock: &resourcelock.LeaseLock{
+			LeaseMeta:  metav1.ObjectMeta{Namespace: namespace, Name: name},
+			Client:     client,
+			LockConfig: resourcelock.ResourceLockConfig{Identity: identity},
+		},
+		leaseDuration: leaseDuration,
+	}
+}
+
+// Run waits until this replica holds the lease and runs the function until the context is cancelled or the lease is lost,
+// which cancels the context of the function. The lease is released only once the function has returned,
+// so that the next leader never runs at the same time.
+// After the lease was lost, it stands by to take it again. It returns the error of the function,
+// or nil once the context is cancelled.
+func (e *Elector) Run(ctx context.Context, run func(ctx context.Context) error) error {
+	lease := e.lock.LeaseMeta.Namespace + "/" + e.lock.LeaseMeta.Name
+	isLeader.WithLabelValues(lease).Set(0)
+
+	for {
+		if ctx.Err() != nil {
+			return nil
+		}
+		// the election gets a context of its own, so that the lease is kept until the function has returned
+		electionCtx, stopElection := context.WithCancel(context.WithoutCancel(ctx))
+		lock := &acquiringLock{Interface: e.lock}
+		stopWatch := context.AfterFunc(ctx, func() {
+			// once the lease is acquired, the function ends on the cancelled context and stops the election itself
+			if !lock.acquired.Load() {
+				stopElection()
+			}
+		})
+
+		done := make(chan struct{})
+		var runErr error
+		elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+			Lock:            lock,
+			LeaseDuration:   e.leaseDuration,
+			RenewDeadline:   e.leaseDuration * 2 / 3,
+			RetryPeriod:     e.leaseDuration / 7,
+			ReleaseOnCancel: true,
+			Name:            lease,
+			Callbacks: leaderelection.LeaderCallbacks{
+				OnStartedLeading: func(leaderCtx context.Context) {
+					defer close(done)
+					defer stopElection()
+					isLeader.WithLabelValues(lease).Set(1)
+					e.logger.Info("Acquired lease, running the collectors")
+
+					runCtx, cancelRun := context.WithCancel(ctx)
+					defer cancelRun()
+					stopLost := context.AfterFunc(leaderCtx, cancelRun)
+					defer stopLost()
+					runErr = run(runCtx)
+				},
+				OnStoppedLeading: func() {
+					isLeader.WithLabelValues(lease).Set(0)
+				},
+				OnNewLeader: func(identity string) {
+					e.logger.Info("Leader elected", "leader", identity)
+				},
+			},
+		})
+		if err != nil {
+			stopWatch()
+			stopElection()
+			return fmt.Errorf("leader election: %w", err)
+		}
+
+		elector.Run(electionCtx)
+		if lock.acquired.Load() {
+			<-done
+		}
+		stopWatch()
+		stopElection()
+		isLeader.WithLabelValues(lease).Set(0)
+
+		if runErr != nil || ctx.Err() != nil {
+			return runErr
+		}
+		e.logger.Info("Lost lease, standing by")
+	}
+}
+
+// acquiringLock records whether the lease was acquired, which tells whether the elector runs the callback.
+type acquiringLock struct {
+	resourcelock.Interface
+	acquired atomic.Bool
+}
+
+func (l *acquiringLock) Create(ctx context.Context, record resourcelock.LeaderElectionRecord) error {
+	err := l.Interface.Create(ctx, record)
+	l.observe(record, err)
+	return err
+}
+
+func (l *acquiringLock) Update(ctx context.Context, record resourcelock.LeaderElectionRecord) error {
+	err := l.Interface.Update(ctx, record)
+	l.observe(record, err)
+	return err
+}
+
+func (l *acquiringLock) observe(record resourcelock.LeaderElectionRecord, err error) {
+	if err == nil && record.HolderIdentity == l.Identity() {
+		l.acquired.Store(true)
+	}
+}
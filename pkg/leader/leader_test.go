@@ -0,0 +1,79 @@
+package leader
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// the lease stores its duration in whole seconds
+const testLeaseDuration = time.Second
+
+func TestElector_Run(t *testing.T) {
+	client := fake.NewSimpleClientset().CoordinationV1()
+
+	var running, maxRunning, runs int32
+	var billed []string
+	var mu sync.Mutex
+	run := func(identity string) func(ctx context.Context) error {
+		return func(ctx context.Context) error {
+			n := atomic.AddInt32(&running, 1)
+			defer atomic.AddInt32(&running, -1)
+			for {
+				m := atomic.LoadInt32(&maxRunning)
+				if n <= m || atomic.CompareAndSwapInt32(&maxRunning, m, n) {
+					break
+				}
+			}
+			atomic.AddInt32(&runs, 1)
+			mu.Lock()
+			billed = append(billed, identity)
+			mu.Unlock()
+			<-ctx.Done()
+			// finishing the in-flight work must not let the standby take over yet
+			time.Sleep(100 * time.Millisecond)
+			return nil
+		}
+	}
+
+	ctxA, stopA := context.WithCancel(context.Background())
+	ctxB, stopB := context.WithCancel(context.Background())
+	defer stopB()
+	errs := make(chan error, 2)
+	go func() {
+		errs <- New(logr.Discard(), client, "billing", "collector", "a", testLeaseDuration).Run(ctxA, run("a"))
+	}()
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&runs) == 1 }, 5*time.Second, 10*time.Millisecond, "replica a should become the leader")
+
+	go func() {
+		errs <- New(logr.Discard(), client, "billing", "collector", "b", testLeaseDuration).Run(ctxB, run("b"))
+	}()
+	time.Sleep(2 * testLeaseDuration)
+	assert.EqualValues(t, 1, atomic.LoadInt32(&runs), "replica b should stand by while a holds the lease")
+
+	stopA()
+	require.NoError(t, <-errs)
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&runs) == 2 }, 5*time.Second, 10*time.Millisecond, "replica b should take over")
+
+	stopB()
+	require.NoError(t, <-errs)
+	assert.EqualValues(t, 1, atomic.LoadInt32(&maxRunning), "only one replica should run at a time")
+	assert.Equal(t, []string{"a", "b"}, billed)
+}
+
+func TestElector_Run_error(t *testing.T) {
+	client := fake.NewSimpleClientset().CoordinationV1()
+	expected := assert.AnError
+
+	err := New(logr.Discard(), client, "billing", "collector", "a", testLeaseDuration).Run(context.Background(), func(ctx context.Context) error {
+		return expected
+	})
+	assert.ErrorIs(t, err, expected)
+}
@@ -0,0 +1,296 @@
+package odoo
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	auditFileName     = "audit.jsonl"
+	auditRotatedGlob  = "audit-*.jsonl"
+	auditRotatedTime  = "20060102T150405.000000000Z"
+	auditScanBufLimit = 64 << 20
+)
+
+// AuditEntry is a request sent to Odoo together with the response.
+type AuditEntry struct {
+	Time      time.Time                  `json:"time"`
+	Collector string                     `json:"collector"`
+	Status    int                        `json:"status"`
+	Response  string                     `json:"response"`
+	Error     string                     `json:"error,omitempty"`
+	Records   []OdooMeteredBillingRecord `json:"records"`
+	// PrevHash is the hash of the entry before, which chains the entries together.
+	PrevHash string `json:"prev_hash"`
+}
+
+// auditLine is how an entry is stored. The hash covers PrevHash and the exact bytes of the entry,
+// so that any change to an entry, or removing or reordering entries, breaks the chain.
+type auditLine struct {
+	Hash  string          `json:"hash"`
+	Entry json.RawMessage `json:"entry"`
+}
+
+func auditHash(entry []byte) string {
+	sum := sha256.Sum256(entry)
+	return hex.EncodeToString(sum[:])
+}
+
+// AuditLog is an append-only, hash-chained log of every request sent to Odoo.
+// The current file is rotated once it grows beyond the configured size; the chain continues across files.
+type AuditLog struct {
+	mu       sync.Mutex
+	dir      string
+	maxBytes int64
+	file     *os.File
+	size     int64
+	lastHash string
+}
+
+// OpenAuditLog opens the audit log in dir, creating the directory if it does not exist.
+// The current file is rotated once it is larger than maxBytes, a maxBytes of 0 or less disables rotation.
+func OpenAuditLog(dir string, maxBytes int64) (*AuditLog, error) {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, fmt.Errorf("cannot create audit directory %s: %w", dir, err)
+	}
+	files, err := auditFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	lastHash := ""
+	for i := len(files) - 1; i >= 0 && lastHash == ""; i-- {
+		lastHash, err = lastAuditHash(files[i])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	file, err := os.OpenFile(filepath.Join(dir, auditFileName), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open audit log: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("cannot open audit log: %w", err)
+	}
+	return &AuditLog{dir: dir, maxBytes: maxBytes, file: file, size: info.Size(), lastHash: lastHash}, nil
+}
+
+// Append adds the entry to the log, chained to the entry before.
+func (a *AuditLog) Append(entry AuditEntry) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	entry.PrevHash = a.lastHash
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("cannot encode audit entry: %w", err)
+	}
+	hash := auditHash(append([]byte(entry.PrevHash), data...))
+	line, err := json.Marshal(auditLine{Hash: hash, Entry: data})
+	if err != nil {
+		return fmt.Errorf("cannot encode audit entry: %w", err)
+	}
+	line = append(line, '\n')
+
+	if a.maxBytes > 0 && a.size > 0 && a.size+int64(len(line)) > a.maxBytes {
+		if err := a.rotate(); err != nil {
+			return err
+		}
+	}
+	if _, err := a.file.Write(line); err != nil {
+		return fmt.Errorf("cannot write audit log: %w", err)
+	}
+	if err := a.file.Sync(); err != nil {
+		return fmt.Errorf("cannot sync audit log: %w", err)
+	}
+	a.size += int64(len(line))
+	a.lastHash = hash
+	return nil
+}
+
+// rotate renames the current file after the current time and starts a new one.
+func (a *AuditLog) rotate() error {
+	if err := a.file.Close(); err != nil {
+		return fmt.Errorf("cannot close audit log: %w", err)
+	}
+	current := filepath.Join(a.dir, auditFileName)
+	rotated := filepath.Join(a.dir, "audit-"+time.Now().UTC().Format(auditRotatedTime)+".jsonl")
+	if err := os.Rename(current, rotated); err != nil {
+		return fmt.Errorf("cannot rotate audit log: %w", err)
+	}
+	file, err := os.OpenFile(current, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return fmt.Errorf("cannot open audit log: %w", err)
+	}
+	a.file = file
+	a.size = 0
+	return nil
+}
+
+// Close closes the current file.
+func (a *AuditLog) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.file.Close()
+}
+
+// AuditFilter selects audit entries and records. Empty fields match everything.
+type AuditFilter struct {
+	SalesOrder string
+	InstanceID string
+	ProductID  string
+	// From and To select records whose billing period overlaps [From, To).
+	From, To time.Time
+}
+
+func (f AuditFilter) matches(r OdooMeteredBillingRecord) bool {
+	return (f.SalesOrder == "" || f.SalesOrder == r.SalesOrder) &&
+		(f.InstanceID == "" || f.InstanceID == r.InstanceID) &&
+		(f.ProductID == "" || f.ProductID == r.ProductID) &&
+		(f.From.IsZero() || r.TimeRange.To.After(f.From)) &&
+		(f.To.IsZero() || r.TimeRange.From.Before(f.To))
+}
+
+// QueryAuditLog reads the audit log in dir, oldest entry first, verifies the hash chain and returns
+// the entries with at least one record matching the filter. Only the matching records are kept in the entries.
+// If the chain is broken, the error tells the first entry which was tampered with, together with the entries read so far.
+func QueryAuditLog(dir string, filter AuditFilter) ([]AuditEntry, error) {
+	files, err := auditFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	var entries []AuditEntry
+	prevHash := ""
+	for _, path := range files {
+		err := readAuditFile(path, func(lineNo int, line auditLine) error {
+			var entry AuditEntry
+			if err := json.Unmarshal(line.Entry, &entry); err != nil {
+				return fmt.Errorf("%s:%d: cannot decode entry: %w", path, lineNo, err)
+			}
+			if entry.PrevHash != prevHash || auditHash(append([]byte(entry.PrevHash), line.Entry...)) != line.Hash {
+				return fmt.Errorf("%s:%d: %w", path, lineNo, ErrAuditChainBroken)
+			}
+			prevHash = line.Hash
+
+			var matching []OdooMeteredBillingRecord
+			for _, r := range entry.Records {
+				if filter.matches(r) {
+					matching = append(matching, r)
+				}
+			}
+			if len(matching) > 0 {
+				entry.Records = matching
+				entries = append(entries, entry)
+			}
+			return nil
+		})
+		if err != nil {
+			return entries, err
+		}
+	}
+	return entries, nil
+}
+
+// ErrAuditChainBroken means an audit entry was changed, removed or reordered.
+var ErrAuditChainBroken = errors.New("hash chain broken, the audit log was tampered with")
+
+// auditFiles returns the rotated files in the order they were written, followed by the current file if it exists.
+func auditFiles(dir string) ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(dir, auditRotatedGlob))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	current := filepath.Join(dir, auditFileName)
+	if _, err := os.Stat(current); err == nil {
+		files = append(files, current)
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("cannot read audit log: %w", err)
+	}
+	return files, nil
+}
+
+func lastAuditHash(path string) (string, error) {
+	last := ""
+	err := readAuditFile(path, func(_ int, line auditLine) error {
+		last = line.Hash
+		return nil
+	})
+	return last, err
+}
+
+func readAuditFile(path string, fn func(lineNo int, line auditLine) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("cannot open audit log: %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), auditScanBufLimit)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		data := bytes.TrimSpace(scanner.Bytes())
+		if len(data) == 0 {
+			continue
+		}
+		var line auditLine
+		if err := json.Unmarshal(data, &line); err != nil {
+			return fmt.Errorf("%s:%d: cannot decode line: %w", path, lineNo, err)
+		}
+		if err := fn(lineNo, line); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("cannot read audit log %s: %w", path, err)
+	}
+	return nil
+}
+
+// WithAuditLog makes the client append every request to the audit log, attributed to the collector.
+func WithAuditLog(log *AuditLog, collector string) OdooAPIClientOpt {
+	return func(c *OdooAPIClient) {
+		c.audit = log
+		c.collector = collector
+	}
+}
+
+// auditRequest appends a request to the audit log, if one is configured.
+func (c OdooAPIClient) auditRequest(payload []byte, status int, body string, reqErr error) {
+	if c.audit == nil {
+		return
+	}
+	var obj apiObject
+	if err := json.Unmarshal(payload, &obj); err != nil {
+		c.logger.Error(err, "cannot decode payload for the audit log")
+	}
+	entry := AuditEntry{
+		Time:      time.Now().UTC(),
+		Collector: c.collector,
+		Status:    status,
+		Response:  body,
+		Records:   obj.Data,
+	}
+	if reqErr != nil {
+		entry.Error = strings.TrimSpace(reqErr.Error())
+	}
+	if err := c.audit.Append(entry); err != nil {
+		c.logger.Error(err, "cannot write audit log")
+	}
+}
@@ -0,0 +1,190 @@
+package odoo
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func auditRecord(salesOrder, instance string, day int) OdooMeteredBillingRecord {
+	from := time.Date(2024, 3, day, 0, 0, 0, 0, time.UTC)
+	return OdooMeteredBillingRecord{ProductID: "pg", InstanceID: instance, SalesOrder: salesOrder, UnitID: "h", ConsumedUnits: 1,
+		TimeRange: TimeRange{From: from, To: from.AddDate(0, 0, 1)}}
+}
+
+func TestAuditLog_Query(t *testing.T) {
+	dir := t.TempDir()
+	audit, err := OpenAuditLog(dir, 600)
+	require.NoError(t, err)
+	for day := 1; day <= 4; day++ {
+		require.NoError(t, audit.Append(AuditEntry{Collector: "dbaas", Status: http.StatusOK, Records: []OdooMeteredBillingRecord{
+			auditRecord("S1", "a", day),
+			auditRecord("S2", "b", day),
+		}}))
+	}
+	require.NoError(t, audit.Close())
+
+	rotated, err := filepath.Glob(filepath.Join(dir, auditRotatedGlob))
+	require.NoError(t, err)
+	assert.NotEmpty(t, rotated, "the log should have been rotated")
+
+	// the chain continues after reopening
+	audit, err = OpenAuditLog(dir, 0)
+	require.NoError(t, err)
+	require.NoError(t, audit.Append(AuditEntry{Collector: "objectstorage", Status: http.StatusBadRequest, Records: []OdooMeteredBillingRecord{auditRecord("S2", "c", 5)}}))
+	require.NoError(t, audit.Close())
+
+	tests := map[string]struct {
+		filter            AuditFilter
+		expectedInstances []string
+	}{
+		"given no filter, we should get everything": {
+			filter:            AuditFilter{},
+			expectedInstances: []string{"a", "b", "a", "b", "a", "b", "a", "b", "c"},
+		},
+		"given a sales order, we should get only its records": {
+			filter:            AuditFilter{SalesOrder: "S2"},
+			expectedInstances: []string{"b", "b", "b", "b", "c"},
+		},
+		"given an instance and a date range, we should get the overlapping records": {
+			filter:            AuditFilter{InstanceID: "a", From: time.Date(2024, 3, 2, 12, 0, 0, 0, time.UTC), To: time.Date(2024, 3, 4, 0, 0, 0, 0, time.UTC)},
+			expectedInstances: []string{"a", "a"},
+		},
+		"given an unknown product, we should get nothing": {
+			filter: AuditFilter{ProductID: "mysql"},
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			entries, err := QueryAuditLog(dir, tc.filter)
+			require.NoError(t, err)
+			var instances []string
+			for _, e := range entries {
+				for _, r := range e.Records {
+					instances = append(instances, r.InstanceID)
+				}
+			}
+			assert.Equal(t, tc.expectedInstances, instances)
+		})
+	}
+}
+
+func TestAuditLog_Tampering(t *testing.T) {
+	dir := t.TempDir()
+	audit, err := OpenAuditLog(dir, 0)
+	require.NoError(t, err)
+	for day := 1; day <= 3; day++ {
+		require.NoError(t, audit.Append(AuditEntry{Collector: "dbaas", Status: http.StatusOK, Records: []OdooMeteredBillingRecord{auditRecord("S1", "a", day)}}))
+	}
+	require.NoError(t, audit.Close())
+
+	path := filepath.Join(dir, auditFileName)
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	lines := strings.SplitAfter(string(data), "\n")
+
+	tests := map[string]string{
+		"given a changed entry, we should detect it":   lines[0] + strings.Replace(lines[1], `"S1"`, `"S9"`, 1) + lines[2],
+		"given a removed entry, we should detect it":   lines[0] + lines[2],
+		"given swapped entries, we should detect it":   lines[1] + lines[0] + lines[2],
+		"given the untouched log, we should accept it": string(data),
+	}
+	for name, content := range tests {
+		t.Run(name, func(t *testing.T) {
+			require.NoError(t, os.WriteFile(path, []byte(content), 0o640))
+			_, err := QueryAuditLog(dir, AuditFilter{})
+			if content == string(data) {
+				assert.NoError(t, err)
+				return
+			}
+			assert.ErrorIs(t, err, ErrAuditChainBroken)
+		})
+	}
+}
+
+func TestOdooAPIClient_SendData_Audit(t *testing.T) {
+	srv, _ := newTestServer(t, http.StatusOK, http.StatusServiceUnavailable, http.StatusOK)
+	dir := t.TempDir()
+	audit, err := OpenAuditLog(dir, 0)
+	require.NoError(t, err)
+	defer audit.Close()
+
+	client := NewOdooAPIClient(context.Background(), srv.URL+"/usage", srv.URL+"/token", "id", "secret", logr.Discard(), newTestMetrics(),
+		WithRetry(testRetryConfig), WithAuditLog(audit, "exoscale dbaas"))
+	record := auditRecord("S1", "a", 1)
+	_, err = client.SendData(context.Background(), []OdooMeteredBillingRecord{record})
+	require.NoError(t, err)
+
+	entries, err := QueryAuditLog(dir, AuditFilter{})
+	require.NoError(t, err)
+	require.Len(t, entries, 2, "every attempt should be audited")
+	assert.Equal(t, http.StatusServiceUnavailable, entries[0].Status)
+	assert.Equal(t, http.StatusOK, entries[1].Status)
+	assert.Equal(t, "exoscale dbaas", entries[1].Collector)
+	assert.Equal(t, []OdooMeteredBillingRecord{record}, entries[1].Records)
+}
+
+func TestOdooAPIClient_SendData_AuditAuthFailure(t *testing.T) {
+	srv, calls := newTestServer(t, http.StatusUnauthorized, http.StatusOK)
+	dir := t.TempDir()
+	audit, err := OpenAuditLog(dir, 0)
+	require.NoError(t, err)
+	defer audit.Close()
+
+	client := NewOdooAPIClient(context.Background(), srv.URL+"/usage", srv.URL+"/token", "id", "secret", logr.Discard(), newTestMetrics(),
+		WithRetry(testRetryConfig), WithAuditLog(audit, "exoscale dbaas"))
+	record := auditRecord("S1", "a", 1)
+	_, err = client.SendData(context.Background(), []OdooMeteredBillingRecord{record})
+	require.Error(t, err)
+
+	entries, err := QueryAuditLog(dir, AuditFilter{})
+	require.NoError(t, err)
+	require.NotEmpty(t, entries, "a request failing on the token should be audited")
+	assert.Zero(t, atomic.LoadInt32(calls))
+	assert.Zero(t, entries[0].Status)
+	assert.NotEmpty(t, entries[0].Error)
+	assert.Equal(t, []OdooMeteredBillingRecord{record}, entries[0].Records)
+}
+
+func TestOdooAPIClient_WithCollector(t *testing.T) {
+	srv, calls := newTestServer(t, http.StatusOK, http.StatusOK)
+	dir := t.TempDir()
+	audit, err := OpenAuditLog(dir, 0)
+	require.NoError(t, err)
+	defer audit.Close()
+	outbox, err := NewOutbox(t.TempDir())
+	require.NoError(t, err)
+
+	client := NewOdooAPIClient(context.Background(), srv.URL+"/usage", srv.URL+"/token", "id", "secret", logr.Discard(), newTestMetrics(),
+		WithRetry(testRetryConfig), WithOutbox(outbox), WithAuditLog(audit, "run"))
+	collectors := []string{"exoscale dbaas", "spks"}
+	var wg sync.WaitGroup
+	for i, collector := range collectors {
+		wg.Add(1)
+		go func(day int, c *OdooAPIClient) {
+			defer wg.Done()
+			_, err := c.SendData(context.Background(), []OdooMeteredBillingRecord{auditRecord("S1", "a", day)})
+			assert.NoError(t, err)
+		}(i+1, client.WithCollector(collector))
+	}
+	wg.Wait()
+
+	assert.EqualValues(t, 2, atomic.LoadInt32(calls), "every payload of the shared outbox should be sent once")
+	entries, err := QueryAuditLog(dir, AuditFilter{})
+	require.NoError(t, err)
+	var audited []string
+	for _, e := range entries {
+		audited = append(audited, e.Collector)
+	}
+	assert.ElementsMatch(t, collectors, audited)
+}
@@ -0,0 +1,156 @@
+package odoo
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Ledger remembers the fingerprint of every record Odoo has accepted, so that the same
+// instance, product and billing period is not billed twice.
+// Fingerprints are appended to a plain text file, one per line, followed by the time they were recorded.
+type Ledger struct {
+	mu   sync.Mutex
+	file *os.File
+	seen map[string]struct{}
+}
+
+// Fingerprint returns a deterministic identifier of the record's instance, product and billing period.
+// The time range is normalized to UTC, so the same period in different time zones has the same fingerprint.
+func Fingerprint(record OdooMeteredBillingRecord) string {
+	h := sha256.New()
+	for _, token := range []string{
+		record.InstanceID,
+		record.ProductID,
+		record.TimeRange.From.UTC().Format(time.RFC3339),
+		record.TimeRange.To.UTC().Format(time.RFC3339),
+	} {
+		h.Write([]byte(token))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// OpenLedger opens the ledger file at path, creating it if it does not exist.
+func OpenLedger(path string) (*Ledger, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o640)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open ledger %s: %w", path, err)
+	}
+
+	seen := map[string]struct{}{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		seen[fields[0]] = struct{}{}
+	}
+	if err := scanner.Err(); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("cannot read ledger %s: %w", path, err)
+	}
+	return &Ledger{file: file, seen: seen}, nil
+}
+
+// Contains reports whether Odoo has already accepted a record with the same fingerprint.
+func (l *Ledger) Contains(record OdooMeteredBillingRecord) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, ok := l.seen[Fingerprint(record)]
+	return ok
+}
+
+// Record adds the fingerprints of the records to the ledger.
+func (l *Ledger) Record(records []OdooMeteredBillingRecord) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now().UTC().Format(time.RFC3339)
+	var sb strings.Builder
+	for _, r := range records {
+		fp := Fingerprint(r)
+		if _, ok := l.seen[fp]; ok {
+			continue
+		}
+		sb.WriteString(fp + " " + now + "\n")
+		l.seen[fp] = struct{}{}
+	}
+	if sb.Len() == 0 {
+		return nil
+	}
+	if _, err := l.file.WriteString(sb.String()); err != nil {
+		return fmt.Errorf("cannot write ledger: %w", err)
+	}
+	return l.file.Sync()
+}
+
+// Close closes the ledger file.
+func (l *Ledger) Close() error {
+	return l.file.Close()
+}
+
+// WithLedger makes the client skip records which are already in the ledger and record every record Odoo accepts.
+func WithLedger(ledger *Ledger) OdooAPIClientOpt {
+	return func(c *OdooAPIClient) {
+		c.ledger = ledger
+	}
+}
+
+// WithForceResend makes the client send records even if they are already in the ledger, e.g. to correct them.
+func WithForceResend(force bool) OdooAPIClientOpt {
+	return func(c *OdooAPIClient) {
+		c.forceResend = force
+	}
+}
+
+// filterBilled splits the records into those which still need to be sent and those which were already billed.
+// Duplicates within the records themselves count as already billed, too.
+func (c OdooAPIClient) filterBilled(records []OdooMeteredBillingRecord) (pending, billed []OdooMeteredBillingRecord) {
+	if c.ledger == nil || c.forceResend {
+		return records, nil
+	}
+	inBatch := make(map[string]struct{}, len(records))
+	for _, r := range records {
+		fp := Fingerprint(r)
+		_, duplicate := inBatch[fp]
+		if duplicate || c.ledger.Contains(r) {
+			billed = append(billed, r)
+			continue
+		}
+		inBatch[fp] = struct{}{}
+		pending = append(pending, r)
+	}
+	return pending, billed
+}
+
+// recordAccepted adds the records to the ledger, if one is configured.
+func (c OdooAPIClient) recordAccepted(records []OdooMeteredBillingRecord) {
+	if c.ledger == nil {
+		return
+	}
+	if err := c.ledger.Record(records); err != nil {
+		c.logger.Error(err, "cannot record accepted records in ledger, they might be sent again")
+	}
+}
+
+// recordAcceptedPayload adds the records of a marshalled apiObject to the ledger, except those the report says Odoo refused.
+func (c OdooAPIClient) recordAcceptedPayload(payload []byte, report *UsageReport) {
+	if c.ledger == nil {
+		return
+	}
+	var obj apiObject
+	if err := json.Unmarshal(payload, &obj); err != nil {
+		c.logger.Error(err, "cannot decode accepted payload, its records are not recorded in the ledger")
+		return
+	}
+	accepted, _ := report.split(obj.Data)
+	c.recordAccepted(accepted)
+}
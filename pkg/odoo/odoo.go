@@ -8,10 +8,12 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/go-logr/logr"
 	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/clientcredentials"
 )
 
@@ -25,8 +27,28 @@ const (
 type OdooAPIClient struct {
 	odooURL     string
 	logger      logr.Logger
-	oauthClient *http.Client
+	oauth       *oauthClient
 	odooMetrics map[string]prometheus.Counter
+	outbox      *Outbox
+	retry       RetryConfig
+	batchSize   int
+	ledger      *Ledger
+	forceResend bool
+	audit       *AuditLog
+	collector   string
+	// sending serializes sending between the copies of a client made with WithCollector,
+	// so that no outbox entry is delivered twice.
+	sending *sync.Mutex
+}
+
+// OdooAPIClientOpt configures optional behaviour of the OdooAPIClient.
+type OdooAPIClientOpt func(*OdooAPIClient)
+
+// WithOutbox makes the client persist every payload in the given Outbox until Odoo has accepted it.
+func WithOutbox(outbox *Outbox) OdooAPIClientOpt {
+	return func(c *OdooAPIClient) {
+		c.outbox = outbox
+	}
 }
 
 type apiObject struct {
@@ -44,61 +66,291 @@ type OdooMeteredBillingRecord struct {
 	TimeRange            TimeRange `json:"timerange"`
 }
 
+// TimeRange is the billing period of a record. It is marshalled as ISO 8601 time interval "from/to".
 type TimeRange struct {
 	From time.Time
 	To   time.Time
 }
 
 func (t TimeRange) MarshalJSON() ([]byte, error) {
-	return []byte(`"` + t.From.Format(time.RFC3339) + "/" + t.To.Format(time.RFC3339) + `"`), nil
+	return []byte(`"` + t.From.Format(time.RFC3339Nano) + "/" + t.To.Format(time.RFC3339Nano) + `"`), nil
 }
 
-func (t *TimeRange) UnmarshalJSON([]byte) error {
-	return errors.New("Not implemented")
+// UnmarshalJSON parses the "from/to" format produced by MarshalJSON, as well as other ISO 8601 time intervals
+// Odoo might send back, see parseTimeRange.
+func (t *TimeRange) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("time range must be a string: %w", err)
+	}
+	parsed, err := parseTimeRange(s)
+	if err != nil {
+		return err
+	}
+	*t = parsed
+	return nil
 }
 
-func NewOdooAPIClient(ctx context.Context, odooURL string, oauthTokenURL string, oauthClientId string, oauthClientSecret string, logger logr.Logger, odooMetrics map[string]prometheus.Counter) *OdooAPIClient {
+func NewOdooAPIClient(ctx context.Context, odooURL string, oauthTokenURL string, oauthClientId string, oauthClientSecret string, logger logr.Logger, odooMetrics map[string]prometheus.Counter, opts ...OdooAPIClientOpt) *OdooAPIClient {
 	oauthConfig := clientcredentials.Config{
 		ClientID:     oauthClientId,
 		ClientSecret: oauthClientSecret,
 		TokenURL:     oauthTokenURL,
 	}
-	oauthClient := oauthConfig.Client(ctx)
-	return &OdooAPIClient{
+	c := &OdooAPIClient{
 		odooURL:     odooURL,
 		logger:      logger,
-		oauthClient: oauthClient,
+		oauth:       &oauthClient{ctx: ctx, config: oauthConfig},
 		odooMetrics: odooMetrics,
+		retry:       DefaultRetryConfig,
+		sending:     &sync.Mutex{},
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// WithClientSecret makes the client get the OAuth client secret from the function before every request instead of using the one it was created with.
+// When the secret changed, e.g. because a rotated secret file was re-read, the OAuth client is rebuilt and a new token fetched.
+func WithClientSecret(secret func() string) OdooAPIClientOpt {
+	return func(c *OdooAPIClient) {
+		c.oauth.secret = secret
 	}
 }
 
-func (c OdooAPIClient) SendData(data []OdooMeteredBillingRecord) error {
-	apiObject := apiObject{
-		Data: data,
+// oauthClient is the http.Client which authenticates the requests to Odoo with a token of the client credentials.
+// It is rebuilt when the client secret changed.
+type oauthClient struct {
+	ctx    context.Context
+	config clientcredentials.Config
+	secret func() string
+
+	mu     sync.Mutex
+	client *http.Client
+}
+
+func (o *oauthClient) get() *http.Client {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.secret != nil {
+		if secret := o.secret(); secret != o.config.ClientSecret {
+			o.config.ClientSecret = secret
+			o.client = nil
+		}
+	}
+	if o.client == nil {
+		o.client = oauth2.NewClient(o.ctx, authTokenSource{source: o.config.TokenSource(o.ctx)})
 	}
-	str, err := json.Marshal(apiObject)
+	return o.client
+}
+
+// WithCollector returns a copy of the client which attributes its requests to the given collector in the audit log.
+// The copy shares the OAuth token, outbox, ledger and audit log with the client, so that collectors running
+// in the same process can share one client.
+func (c *OdooAPIClient) WithCollector(collector string) *OdooAPIClient {
+	cp := *c
+	cp.collector = collector
+	return &cp
+}
+
+// SendData sends the records to Odoo in chunks of at most the configured batch size.
+// Every chunk is sent and accounted for on its own, temporary failures are retried according to the RetryConfig.
+// Records which are already in the ledger are skipped, unless the client is configured to force resending them.
+// If an outbox is configured, any payloads left over from previous failed attempts are sent first and every chunk
+// is persisted before it is sent.
+// The returned SendResult is never nil and tells which records were accepted, the error joins the errors of all failed chunks
+// and of the records Odoo refused individually.
+func (c OdooAPIClient) SendData(ctx context.Context, data []OdooMeteredBillingRecord) (*SendResult, error) {
+	c.sending.Lock()
+	defer c.sending.Unlock()
+
+	if err := c.flushOutbox(ctx); err != nil {
+		c.logger.Error(err, "cannot send pending records from outbox")
+	}
+
+	pending, billed := c.filterBilled(data)
+	if len(billed) > 0 {
+		c.logger.Info("Skipping records which were already accepted by Odoo", "numberOfRecords", len(billed))
+	}
+
+	result := &SendResult{Suppressed: billed}
+	chunks := splitChunks(pending, c.batchSize)
+	for i, chunk := range chunks {
+		report, err := c.sendChunk(ctx, chunk)
+		chunkResult := ChunkResult{Index: i, Records: chunk, Err: err, Report: report}
+		if err != nil {
+			c.logger.Error(err, "Odoo did not accept chunk", "chunk", i+1, "numberOfChunks", len(chunks), "numberOfRecords", len(chunk))
+		} else {
+			c.recordAccepted(chunkResult.accepted())
+		}
+		result.Chunks = append(result.Chunks, chunkResult)
+	}
+	return result, result.Err()
+}
+
+func (c OdooAPIClient) sendChunk(ctx context.Context, chunk []OdooMeteredBillingRecord) (*UsageReport, error) {
+	payload, err := json.Marshal(apiObject{Data: chunk})
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	if c.outbox == nil {
+		return c.post(ctx, payload, len(chunk))
+	}
+
+	id, err := c.outbox.Add(payload)
+	if err != nil {
+		c.logger.Error(err, "cannot persist records in outbox, sending them anyway", "numberOfRecords", len(chunk))
+		return c.post(ctx, payload, len(chunk))
 	}
-	resp, err := c.oauthClient.Post(c.odooURL, "application/json", bytes.NewBuffer(str))
+	return c.deliver(ctx, id, payload, len(chunk))
+}
+
+// FlushOutbox sends all pending payloads from the outbox to Odoo, oldest first.
+// Payloads Odoo rejects permanently are moved aside, so they don't block the ones after them.
+// On any other failure it stops, so that the order is kept for the next attempt.
+func (c OdooAPIClient) FlushOutbox(ctx context.Context) error {
+	c.sending.Lock()
+	defer c.sending.Unlock()
+	return c.flushOutbox(ctx)
+}
+
+func (c OdooAPIClient) flushOutbox(ctx context.Context) error {
+	if c.outbox == nil {
+		return nil
+	}
+	ids, err := c.outbox.Pending()
 	if err != nil {
-		c.odooMetrics["odooFailed"].Inc()
 		return err
 	}
+	if len(ids) > 0 {
+		c.logger.Info("Sending pending payloads from outbox", "numberOfPayloads", len(ids))
+	}
+	var rejected []error
+	for _, id := range ids {
+		payload, err := c.outbox.Load(id)
+		if err != nil {
+			return err
+		}
+		report, err := c.deliver(ctx, id, payload, countRecords(payload))
+		if err != nil {
+			if !isPermanent(err) {
+				return errors.Join(append(rejected, err)...)
+			}
+			rejected = append(rejected, err)
+			continue
+		}
+		c.recordAcceptedPayload(payload, report)
+	}
+	return errors.Join(rejected...)
+}
+
+// deliver sends an outbox entry and removes it from the outbox once Odoo has accepted it.
+// Entries Odoo rejects permanently are moved aside.
+func (c OdooAPIClient) deliver(ctx context.Context, id string, payload []byte, numberOfRecords int) (*UsageReport, error) {
+	report, err := c.post(ctx, payload, numberOfRecords)
+	if err != nil {
+		if isPermanent(err) {
+			c.logger.Error(err, "Odoo rejected payload permanently, moving it out of the outbox", "entry", id)
+			if rejectErr := c.outbox.Reject(id); rejectErr != nil {
+				return report, errors.Join(err, rejectErr)
+			}
+		}
+		return report, fmt.Errorf("outbox entry %s: %w", id, err)
+	}
+	return report, c.outbox.Done(id)
+}
+
+// post sends the payload to Odoo and retries on temporary failures.
+// The returned report is the one of the last attempt, or nil if Odoo could not be reached.
+func (c OdooAPIClient) post(ctx context.Context, payload []byte, numberOfRecords int) (*UsageReport, error) {
+	for retry := 0; ; retry++ {
+		report, err := c.postOnce(ctx, payload, numberOfRecords)
+		if err == nil {
+			return report, nil
+		}
+		if isPermanent(err) || retry >= c.retry.MaxRetries {
+			return report, err
+		}
+
+		wait := c.retry.backoff(retry)
+		var apiErr *APIError
+		if errors.As(err, &apiErr) && apiErr.RetryAfter > 0 {
+			wait = apiErr.RetryAfter
+		}
+		c.logger.Info("Sending records to Odoo failed, retrying", "reason", err.Error(), "retry", retry+1, "maxRetries", c.retry.MaxRetries, "wait", wait)
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return report, errors.Join(err, ctx.Err())
+		case <-timer.C:
+		}
+	}
+}
+
+func (c OdooAPIClient) postOnce(ctx context.Context, payload []byte, numberOfRecords int) (*UsageReport, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.odooURL, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.oauth.get().Do(req)
+	if err != nil {
+		var authErr *AuthError
+		if errors.As(err, &authErr) {
+			c.logger.Error(authErr, "Cannot get OAuth token for Odoo API")
+			c.incMetric("odooAuthFailed")
+			c.auditRequest(payload, 0, "", authErr)
+			return nil, authErr
+		}
+		c.incMetric("odooFailed")
+		c.auditRequest(payload, 0, "", err)
+		return nil, err
+	}
 
 	defer resp.Body.Close()
 
 	body, _ := io.ReadAll(resp.Body)
-	c.logger.Info("Records sent to Odoo API", "status", resp.Status, "body", string(body), "numberOfRecords", len(data))
+	c.logger.Info("Records sent to Odoo API", "status", resp.Status, "body", string(body), "numberOfRecords", numberOfRecords)
+	c.auditRequest(payload, resp.StatusCode, string(body), nil)
 
 	if resp.StatusCode != 200 {
-		c.odooMetrics["odooFailed"].Inc()
-		return errors.New(fmt.Sprintf("API error when sending records to Odoo:\n%s", body))
-	} else {
-		c.odooMetrics["odooSucceeded"].Inc()
+		c.incMetric("odooFailed")
+		report := parseUsageReport(body, numberOfRecords, false)
+		return report, &APIError{
+			StatusCode: resp.StatusCode,
+			Body:       string(body),
+			RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+			Report:     report,
+		}
 	}
+	c.incMetric("odooSucceeded")
+	report := parseUsageReport(body, numberOfRecords, true)
+	if report == nil {
+		report = &UsageReport{Accepted: numberOfRecords}
+	}
+	return report, nil
+}
 
-	return nil
+func (c OdooAPIClient) incMetric(name string) {
+	if counter, ok := c.odooMetrics[name]; ok && counter != nil {
+		counter.Inc()
+	}
+}
+
+// countRecords returns the number of records in a marshalled apiObject, or -1 if it cannot be decoded.
+func countRecords(payload []byte) int {
+	var obj struct {
+		Data []json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(payload, &obj); err != nil {
+		return -1
+	}
+	return len(obj.Data)
 }
 
 func LoadUOM(uom string) (m map[string]string, err error) {
@@ -0,0 +1,230 @@
+package odoo
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testRetryConfig = RetryConfig{MaxRetries: 2, InitialBackoff: time.Millisecond, MaxBackoff: 5 * time.Millisecond}
+
+func newTestMetrics() map[string]prometheus.Counter {
+	return map[string]prometheus.Counter{
+		"odooFailed":     prometheus.NewCounter(prometheus.CounterOpts{Name: "failed"}),
+		"odooAuthFailed": prometheus.NewCounter(prometheus.CounterOpts{Name: "auth_failed"}),
+		"odooSucceeded":  prometheus.NewCounter(prometheus.CounterOpts{Name: "succeeded"}),
+	}
+}
+
+// newTestServer returns a server which hands out tokens on /token and answers /usage with the given status codes in turn.
+func newTestServer(t *testing.T, tokenStatus int, statusCodes ...int) (*httptest.Server, *int32) {
+	var calls int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(tokenStatus)
+		_, _ = w.Write([]byte(`{"access_token":"token","token_type":"bearer","expires_in":3600}`))
+	})
+	mux.HandleFunc("/usage", func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&calls, 1)
+		status := statusCodes[len(statusCodes)-1]
+		if int(n) <= len(statusCodes) {
+			status = statusCodes[n-1]
+		}
+		if status == http.StatusTooManyRequests {
+			w.Header().Set("Retry-After", "0")
+		}
+		w.WriteHeader(status)
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv, &calls
+}
+
+func TestOdooAPIClient_SendData(t *testing.T) {
+	tests := map[string]struct {
+		tokenStatus     int
+		statusCodes     []int
+		expectErr       bool
+		expectCalls     int32
+		expectFailed    float64
+		expectAuthFails float64
+	}{
+		"given a server error followed by success, we should retry and succeed": {
+			tokenStatus:  http.StatusOK,
+			statusCodes:  []int{http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusOK},
+			expectCalls:  3,
+			expectFailed: 2,
+		},
+		"given a permanent client error, we should not retry": {
+			tokenStatus:  http.StatusOK,
+			statusCodes:  []int{http.StatusBadRequest},
+			expectErr:    true,
+			expectCalls:  1,
+			expectFailed: 1,
+		},
+		"given persistent server errors, we should give up after the configured retries": {
+			tokenStatus:  http.StatusOK,
+			statusCodes:  []int{http.StatusBadGateway},
+			expectErr:    true,
+			expectCalls:  3,
+			expectFailed: 3,
+		},
+		"given rejected client credentials, we should count an auth failure and not call the API": {
+			tokenStatus:     http.StatusUnauthorized,
+			statusCodes:     []int{http.StatusOK},
+			expectErr:       true,
+			expectCalls:     0,
+			expectAuthFails: 1,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			srv, calls := newTestServer(t, tc.tokenStatus, tc.statusCodes...)
+			metrics := newTestMetrics()
+			client := NewOdooAPIClient(context.Background(), srv.URL+"/usage", srv.URL+"/token", "id", "secret", logr.Discard(), metrics, WithRetry(testRetryConfig))
+
+			_, err := client.SendData(context.Background(), []OdooMeteredBillingRecord{{ProductID: "product"}})
+			if tc.expectErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tc.expectCalls, atomic.LoadInt32(calls))
+			assert.Equal(t, tc.expectFailed, testutil.ToFloat64(metrics["odooFailed"]))
+			assert.Equal(t, tc.expectAuthFails, testutil.ToFloat64(metrics["odooAuthFailed"]))
+		})
+	}
+}
+
+func TestOdooAPIClient_SendDataWithOutbox(t *testing.T) {
+	srv, _ := newTestServer(t, http.StatusOK, http.StatusServiceUnavailable, http.StatusOK)
+	outbox, err := NewOutbox(t.TempDir())
+	require.NoError(t, err)
+	client := NewOdooAPIClient(context.Background(), srv.URL+"/usage", srv.URL+"/token", "id", "secret", logr.Discard(), newTestMetrics(),
+		WithRetry(RetryConfig{}), WithOutbox(outbox))
+
+	_, err = client.SendData(context.Background(), []OdooMeteredBillingRecord{{ProductID: "product"}})
+	require.Error(t, err)
+	pending, err := outbox.Pending()
+	require.NoError(t, err)
+	assert.Len(t, pending, 1, "records must stay in the outbox if Odoo did not accept them")
+
+	// the outbox is reached through the sinks wrapping the client
+	var sink Flusher = NewValidatingSink(MultiSink{NewFileSink(t.TempDir() + "/records.jsonl"), client}, nil, logr.Discard())
+	require.NoError(t, sink.FlushOutbox(context.Background()))
+	pending, err = outbox.Pending()
+	require.NoError(t, err)
+	assert.Empty(t, pending)
+}
+
+func TestOdooAPIClient_SendDataInChunks(t *testing.T) {
+	srv, calls := newTestServer(t, http.StatusOK, http.StatusOK, http.StatusBadRequest, http.StatusOK)
+	client := NewOdooAPIClient(context.Background(), srv.URL+"/usage", srv.URL+"/token", "id", "secret", logr.Discard(), newTestMetrics(),
+		WithRetry(testRetryConfig), WithBatchSize(2))
+
+	records := []OdooMeteredBillingRecord{{InstanceID: "a"}, {InstanceID: "b"}, {InstanceID: "c"}, {InstanceID: "d"}, {InstanceID: "e"}}
+	result, err := client.SendData(context.Background(), records)
+	assert.Error(t, err)
+	assert.Equal(t, int32(3), atomic.LoadInt32(calls))
+	require.Len(t, result.Chunks, 3)
+	assert.NoError(t, result.Chunks[0].Err)
+	assert.Error(t, result.Chunks[1].Err)
+	assert.NoError(t, result.Chunks[2].Err)
+	assert.Equal(t, []OdooMeteredBillingRecord{{InstanceID: "a"}, {InstanceID: "b"}, {InstanceID: "e"}}, result.Accepted())
+	assert.Equal(t, []OdooMeteredBillingRecord{{InstanceID: "c"}, {InstanceID: "d"}}, result.Rejected())
+}
+
+func TestOdooAPIClient_SendDataWithRotatedClientSecret(t *testing.T) {
+	var accepted atomic.Value
+	accepted.Store("old")
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		_, secret, ok := r.BasicAuth()
+		if !ok {
+			secret = r.FormValue("client_secret")
+		}
+		if secret != accepted.Load() {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"access_token":"` + secret + `","token_type":"bearer","expires_in":3600}`))
+	})
+	mux.HandleFunc("/usage", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer "+accepted.Load().(string) {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	var secret atomic.Value
+	secret.Store("old")
+	client := NewOdooAPIClient(context.Background(), srv.URL+"/usage", srv.URL+"/token", "id", "", logr.Discard(), newTestMetrics(),
+		WithRetry(RetryConfig{}), WithClientSecret(func() string { return secret.Load().(string) }))
+
+	_, err := client.SendData(context.Background(), []OdooMeteredBillingRecord{{ProductID: "product"}})
+	require.NoError(t, err)
+
+	accepted.Store("new")
+	secret.Store("new")
+	_, err = client.SendData(context.Background(), []OdooMeteredBillingRecord{{ProductID: "product"}})
+	require.NoError(t, err, "a new token should be fetched with the rotated secret")
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	assert.Equal(t, 5*time.Second, parseRetryAfter("5"))
+	assert.Equal(t, time.Duration(0), parseRetryAfter(""))
+	assert.Equal(t, time.Duration(0), parseRetryAfter("-1"))
+	d := parseRetryAfter(time.Now().Add(time.Minute).UTC().Format(http.TimeFormat))
+	assert.InDelta(t, time.Minute, d, float64(2*time.Second))
+}
+
+func TestOdooAPIClient_SendDataWithLedger(t *testing.T) {
+	srv, calls := newTestServer(t, http.StatusOK, http.StatusOK)
+	path := t.TempDir() + "/ledger"
+	ledger, err := OpenLedger(path)
+	require.NoError(t, err)
+
+	from := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	record := OdooMeteredBillingRecord{InstanceID: "ch-gva-2/db", ProductID: "product", TimeRange: TimeRange{From: from, To: from.Add(time.Hour)}}
+	client := NewOdooAPIClient(context.Background(), srv.URL+"/usage", srv.URL+"/token", "id", "secret", logr.Discard(), newTestMetrics(), WithLedger(ledger))
+
+	result, err := client.SendData(context.Background(), []OdooMeteredBillingRecord{record, record})
+	require.NoError(t, err)
+	assert.Equal(t, []OdooMeteredBillingRecord{record}, result.Accepted())
+	assert.Len(t, result.Suppressed, 1, "duplicates within the same batch must be sent only once")
+	require.NoError(t, ledger.Close())
+
+	// the same period in another time zone must be recognized after reopening the ledger
+	zurich, err := time.LoadLocation("Europe/Zurich")
+	require.NoError(t, err)
+	sameRecord := record
+	sameRecord.TimeRange = TimeRange{From: from.In(zurich), To: from.Add(time.Hour).In(zurich)}
+	ledger, err = OpenLedger(path)
+	require.NoError(t, err)
+	client = NewOdooAPIClient(context.Background(), srv.URL+"/usage", srv.URL+"/token", "id", "secret", logr.Discard(), newTestMetrics(), WithLedger(ledger))
+
+	result, err = client.SendData(context.Background(), []OdooMeteredBillingRecord{sameRecord})
+	require.NoError(t, err)
+	assert.Empty(t, result.Accepted())
+	assert.Equal(t, []OdooMeteredBillingRecord{sameRecord}, result.Suppressed)
+	assert.Equal(t, int32(1), atomic.LoadInt32(calls))
+
+	client = NewOdooAPIClient(context.Background(), srv.URL+"/usage", srv.URL+"/token", "id", "secret", logr.Discard(), newTestMetrics(), WithLedger(ledger), WithForceResend(true))
+	result, err = client.SendData(context.Background(), []OdooMeteredBillingRecord{sameRecord})
+	require.NoError(t, err)
+	assert.Equal(t, []OdooMeteredBillingRecord{sameRecord}, result.Accepted())
+	assert.Equal(t, int32(2), atomic.LoadInt32(calls))
+}
@@ -0,0 +1,337 @@
+// Package odootest provides a stand-in for the Odoo metered billing API, so that the OdooAPIClient
+// and the collectors can be exercised without credentials or a VPN.
+package odootest
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	mathrand "math/rand"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vshn/billing-collector-cloudservices/pkg/odoo"
+	"golang.org/x/time/rate"
+)
+
+const (
+	// TokenPath is where the server hands out OAuth2 tokens with the client credentials grant.
+	TokenPath = "/oauth2/token"
+	// RecordsPath lists the received records on GET and forgets them on DELETE.
+	RecordsPath = "/records"
+	// UsagePath is the path of the usage report endpoint in Odoo. Any other path accepts usage reports, too.
+	UsagePath = "/api/v2/product_usage_report_POST"
+
+	DefaultClientID     = "odoo-mock"
+	DefaultClientSecret = "odoo-mock-secret"
+
+	tokenLifetime = time.Hour
+)
+
+// Server is an http.Handler which imitates the Odoo metered billing API.
+// Usage reports are accepted on any path other than TokenPath and RecordsPath.
+// Records which fail odoo.Validate are refused individually, the others are stored.
+type Server struct {
+	clientID     string
+	clientSecret string
+	storageFile  string
+	latency      time.Duration
+	errorRate    float64
+	errorStatus  int
+	limiter      *rate.Limiter
+
+	mu       sync.Mutex
+	tokens   map[string]time.Time
+	records  []odoo.OdooMeteredBillingRecord
+	failNext []int
+	rnd      *mathrand.Rand
+}
+
+// Option configures a Server.
+type Option func(*Server)
+
+// WithClientCredentials sets the client ID and secret the token endpoint accepts.
+func WithClientCredentials(id, secret string) Option {
+	return func(s *Server) {
+		s.clientID = id
+		s.clientSecret = secret
+	}
+}
+
+// WithStorageFile keeps the received records in a file of JSON lines, so they survive restarts.
+func WithStorageFile(path string) Option {
+	return func(s *Server) {
+		s.storageFile = path
+	}
+}
+
+// WithLatency delays every response.
+func WithLatency(latency time.Duration) Option {
+	return func(s *Server) {
+		s.latency = latency
+	}
+}
+
+// WithErrorRate makes the usage report endpoint fail randomly with the given status code.
+// The rate is a probability between 0 and 1.
+func WithErrorRate(errorRate float64, status int) Option {
+	return func(s *Server) {
+		s.errorRate = errorRate
+		s.errorStatus = status
+	}
+}
+
+// WithRateLimit limits the usage report endpoint to the given number of requests per second.
+// Requests beyond the limit are answered with status 429 and a Retry-After header.
+func WithRateLimit(perSecond float64) Option {
+	return func(s *Server) {
+		if perSecond > 0 {
+			s.limiter = rate.NewLimiter(rate.Limit(perSecond), int(math.Max(1, perSecond)))
+		}
+	}
+}
+
+// NewServer creates a Server. Records in the storage file, if one is configured, are loaded right away.
+func NewServer(opts ...Option) (*Server, error) {
+	s := &Server{
+		clientID:     DefaultClientID,
+		clientSecret: DefaultClientSecret,
+		errorStatus:  http.StatusInternalServerError,
+		tokens:       map[string]time.Time{},
+		rnd:          mathrand.New(mathrand.NewSource(time.Now().UnixNano())),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	if s.storageFile != "" {
+		file, err := os.Open(s.storageFile)
+		switch {
+		case os.IsNotExist(err):
+		case err != nil:
+			return nil, fmt.Errorf("cannot open storage file: %w", err)
+		default:
+			defer file.Close()
+			s.records, err = odoo.ReadRecords(file)
+			if err != nil {
+				return nil, fmt.Errorf("cannot read storage file: %w", err)
+			}
+		}
+	}
+	return s, nil
+}
+
+// Records returns all records received so far.
+func (s *Server) Records() []odoo.OdooMeteredBillingRecord {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]odoo.OdooMeteredBillingRecord(nil), s.records...)
+}
+
+// FailNext makes the next usage reports fail with the given status codes, one per request.
+func (s *Server) FailNext(statusCodes ...int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failNext = append(s.failNext, statusCodes...)
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.latency > 0 {
+		select {
+		case <-time.After(s.latency):
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	switch r.URL.Path {
+	case TokenPath:
+		s.serveToken(w, r)
+	case RecordsPath:
+		s.serveRecords(w, r)
+	default:
+		s.serveUsageReport(w, r)
+	}
+}
+
+func (s *Server) serveToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "invalid_request"})
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_request"})
+		return
+	}
+	if r.PostForm.Get("grant_type") != "client_credentials" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "unsupported_grant_type"})
+		return
+	}
+	id, secret, ok := r.BasicAuth()
+	if !ok {
+		id, secret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+	if id != s.clientID || secret != s.clientSecret {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+		return
+	}
+
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	token := hex.EncodeToString(b)
+	s.mu.Lock()
+	s.tokens[token] = time.Now().Add(tokenLifetime)
+	s.mu.Unlock()
+
+	writeJSON(w, http.StatusOK, map[string]any{
+		"access_token": token,
+		"token_type":   "bearer",
+		"expires_in":   int(tokenLifetime.Seconds()),
+	})
+}
+
+func (s *Server) serveRecords(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		q := r.URL.Query()
+		records := make([]odoo.OdooMeteredBillingRecord, 0)
+		for _, record := range s.Records() {
+			if matches(q.Get("sales_order_id"), record.SalesOrder) && matches(q.Get("instance_id"), record.InstanceID) && matches(q.Get("product_id"), record.ProductID) {
+				records = append(records, record)
+			}
+		}
+		writeJSON(w, http.StatusOK, records)
+	case http.MethodDelete:
+		if err := s.reset(); err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"message": err.Error()})
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"message": "use GET or DELETE"})
+	}
+}
+
+func (s *Server) serveUsageReport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"message": "use POST"})
+		return
+	}
+	if !s.authorized(r) {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"message": "invalid or expired access token"})
+		return
+	}
+	if s.limiter != nil && !s.limiter.Allow() {
+		w.Header().Set("Retry-After", "1")
+		writeJSON(w, http.StatusTooManyRequests, map[string]string{"message": "rate limit exceeded"})
+		return
+	}
+	if status := s.injectedError(); status != 0 {
+		writeJSON(w, status, map[string]string{"message": "injected error"})
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"message": err.Error()})
+		return
+	}
+	var payload struct {
+		Data []odoo.OdooMeteredBillingRecord `json:"data"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"message": fmt.Sprintf("invalid payload: %v", err)})
+		return
+	}
+
+	valid, quarantined := odoo.Validate(payload.Data, odoo.DefaultRules)
+	if err := s.store(r.Context(), valid); err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"message": err.Error()})
+		return
+	}
+
+	type rejected struct {
+		ProductID  string `json:"product_id"`
+		InstanceID string `json:"instance_id"`
+		Reason     string `json:"reason"`
+	}
+	response := struct {
+		Accepted int        `json:"accepted"`
+		Rejected []rejected `json:"rejected"`
+	}{Accepted: len(valid), Rejected: make([]rejected, 0, len(quarantined))}
+	for _, q := range quarantined {
+		reasons := make([]string, 0, len(q.Violations))
+		for _, v := range q.Violations {
+			reasons = append(reasons, v.Reason)
+		}
+		response.Rejected = append(response.Rejected, rejected{ProductID: q.Record.ProductID, InstanceID: q.Record.InstanceID, Reason: strings.Join(reasons, "; ")})
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+func (s *Server) authorized(r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	expiry, ok := s.tokens[token]
+	return ok && time.Now().Before(expiry)
+}
+
+// injectedError returns the status code of the next injected error, or 0 if the request should succeed.
+func (s *Server) injectedError() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.failNext) > 0 {
+		status := s.failNext[0]
+		s.failNext = s.failNext[1:]
+		return status
+	}
+	if s.errorRate > 0 && s.rnd.Float64() < s.errorRate {
+		return s.errorStatus
+	}
+	return 0
+}
+
+func (s *Server) store(ctx context.Context, records []odoo.OdooMeteredBillingRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.storageFile != "" && len(records) > 0 {
+		if _, err := odoo.NewFileSink(s.storageFile).SendData(ctx, records); err != nil {
+			return fmt.Errorf("cannot store records: %w", err)
+		}
+	}
+	s.records = append(s.records, records...)
+	return nil
+}
+
+func (s *Server) reset() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records = nil
+	if s.storageFile != "" {
+		if err := os.Remove(s.storageFile); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("cannot remove storage file: %w", err)
+		}
+	}
+	return nil
+}
+
+func matches(filter, value string) bool {
+	return filter == "" || filter == value
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
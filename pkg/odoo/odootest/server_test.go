@@ -0,0 +1,102 @@
+package odootest
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vshn/billing-collector-cloudservices/pkg/odoo"
+)
+
+var testRetryConfig = odoo.RetryConfig{MaxRetries: 2, InitialBackoff: time.Millisecond, MaxBackoff: 5 * time.Millisecond}
+
+func newTestClient(t *testing.T, opts ...Option) (*Server, *httptest.Server, *odoo.OdooAPIClient) {
+	srv, err := NewServer(opts...)
+	require.NoError(t, err)
+	httpSrv := httptest.NewServer(srv)
+	t.Cleanup(httpSrv.Close)
+	client := odoo.NewOdooAPIClient(context.Background(), httpSrv.URL+UsagePath, httpSrv.URL+TokenPath, DefaultClientID, DefaultClientSecret,
+		logr.Discard(), nil, odoo.WithRetry(testRetryConfig))
+	return srv, httpSrv, client
+}
+
+func testRecords() []odoo.OdooMeteredBillingRecord {
+	from := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	tr := odoo.TimeRange{From: from, To: from.Add(time.Hour)}
+	return []odoo.OdooMeteredBillingRecord{
+		{ProductID: "pg", InstanceID: "a", SalesOrder: "S1", UnitID: "h", ConsumedUnits: 1, TimeRange: tr},
+		{ProductID: "pg", InstanceID: "b", SalesOrder: "S2", UnitID: "h", ConsumedUnits: 1, TimeRange: tr},
+	}
+}
+
+func TestServer_SendData(t *testing.T) {
+	srv, httpSrv, client := newTestClient(t)
+	records := testRecords()
+
+	result, err := client.SendData(context.Background(), records)
+	require.NoError(t, err)
+	assert.Equal(t, records, result.Accepted())
+	assert.Equal(t, records, srv.Records())
+
+	resp, err := http.Get(httpSrv.URL + RecordsPath + "?sales_order_id=S2")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	var queried []odoo.OdooMeteredBillingRecord
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&queried))
+	assert.Equal(t, records[1:], queried)
+}
+
+func TestServer_InvalidRecords(t *testing.T) {
+	srv, _, client := newTestClient(t)
+	records := testRecords()
+	records[1].UnitID = ""
+
+	result, err := client.SendData(context.Background(), records)
+	assert.Error(t, err)
+	assert.Equal(t, records[:1], result.Accepted())
+	require.Len(t, result.Failures(), 1)
+	assert.Equal(t, records[1], result.Failures()[0].Record)
+	assert.Equal(t, "unit ID is empty", result.Failures()[0].Reason)
+	assert.Equal(t, records[:1], srv.Records())
+}
+
+func TestServer_InjectedErrors(t *testing.T) {
+	srv, _, client := newTestClient(t)
+	srv.FailNext(http.StatusServiceUnavailable, http.StatusTooManyRequests)
+
+	_, err := client.SendData(context.Background(), testRecords())
+	require.NoError(t, err, "the client should retry past injected temporary errors")
+	assert.Len(t, srv.Records(), 2)
+
+	srv.FailNext(http.StatusBadRequest)
+	_, err = client.SendData(context.Background(), testRecords())
+	assert.Error(t, err)
+	assert.Len(t, srv.Records(), 2)
+}
+
+func TestServer_RejectsWrongCredentials(t *testing.T) {
+	_, httpSrv, _ := newTestClient(t)
+	client := odoo.NewOdooAPIClient(context.Background(), httpSrv.URL+UsagePath, httpSrv.URL+TokenPath, DefaultClientID, "wrong",
+		logr.Discard(), nil, odoo.WithRetry(testRetryConfig))
+
+	_, err := client.SendData(context.Background(), testRecords())
+	var authErr *odoo.AuthError
+	assert.ErrorAs(t, err, &authErr)
+}
+
+func TestServer_StorageFile(t *testing.T) {
+	path := t.TempDir() + "/records.jsonl"
+	_, _, client := newTestClient(t, WithStorageFile(path))
+	_, err := client.SendData(context.Background(), testRecords())
+	require.NoError(t, err)
+
+	restarted, err := NewServer(WithStorageFile(path))
+	require.NoError(t, err)
+	assert.Equal(t, testRecords(), restarted.Records())
+}
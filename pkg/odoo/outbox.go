@@ -0,0 +1,117 @@
+package odoo
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	outboxFileSuffix  = ".json"
+	outboxRejectedDir = "rejected"
+)
+
+// Outbox is a spool directory which keeps payloads on disk until Odoo has accepted them.
+// Every payload is stored in its own file, named after the time it was added, so that pending
+// payloads are replayed in the order they were produced.
+type Outbox struct {
+	dir string
+	mu  sync.Mutex
+	seq int
+}
+
+// NewOutbox creates an Outbox in the given directory. The directory is created if it does not exist.
+func NewOutbox(dir string) (*Outbox, error) {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, fmt.Errorf("cannot create outbox directory %s: %w", dir, err)
+	}
+	return &Outbox{dir: dir}, nil
+}
+
+// Add persists the payload and returns the id of the new entry.
+// The entry is written to a temporary file first and renamed afterwards, so a crash never leaves a partial entry behind.
+func (o *Outbox) Add(payload []byte) (string, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.seq++
+	id := fmt.Sprintf("%020d-%06d", time.Now().UnixNano(), o.seq)
+
+	tmp, err := os.CreateTemp(o.dir, ".tmp-*")
+	if err != nil {
+		return "", fmt.Errorf("cannot create outbox entry: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(payload); err != nil {
+		tmp.Close()
+		return "", fmt.Errorf("cannot write outbox entry: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return "", fmt.Errorf("cannot sync outbox entry: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return "", fmt.Errorf("cannot close outbox entry: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), o.path(id)); err != nil {
+		return "", fmt.Errorf("cannot store outbox entry: %w", err)
+	}
+	return id, nil
+}
+
+// Pending returns the ids of all entries which have not been marked as done, oldest first.
+func (o *Outbox) Pending() ([]string, error) {
+	entries, err := os.ReadDir(o.dir)
+	if err != nil {
+		return nil, fmt.Errorf("cannot list outbox entries: %w", err)
+	}
+	ids := make([]string, 0, len(entries))
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || strings.HasPrefix(name, ".") || !strings.HasSuffix(name, outboxFileSuffix) {
+			continue
+		}
+		ids = append(ids, strings.TrimSuffix(name, outboxFileSuffix))
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// Load returns the payload of the entry with the given id.
+func (o *Outbox) Load(id string) ([]byte, error) {
+	payload, err := os.ReadFile(o.path(id))
+	if err != nil {
+		return nil, fmt.Errorf("cannot read outbox entry %s: %w", id, err)
+	}
+	return payload, nil
+}
+
+// Done removes the entry with the given id from the outbox.
+func (o *Outbox) Done(id string) error {
+	if err := os.Remove(o.path(id)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("cannot remove outbox entry %s: %w", id, err)
+	}
+	return nil
+}
+
+// Reject moves the entry with the given id into the rejected subdirectory of the outbox.
+// Rejected entries are not sent again and are kept for manual inspection.
+func (o *Outbox) Reject(id string) error {
+	rejectedDir := filepath.Join(o.dir, outboxRejectedDir)
+	if err := os.MkdirAll(rejectedDir, 0o750); err != nil {
+		return fmt.Errorf("cannot create rejected outbox directory: %w", err)
+	}
+	if err := os.Rename(o.path(id), filepath.Join(rejectedDir, id+outboxFileSuffix)); err != nil {
+		return fmt.Errorf("cannot reject outbox entry %s: %w", id, err)
+	}
+	return nil
+}
+
+func (o *Outbox) path(id string) string {
+	return filepath.Join(o.dir, id+outboxFileSuffix)
+}
@@ -0,0 +1,41 @@
+package odoo
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOutbox_PendingInOrder(t *testing.T) {
+	dir := t.TempDir()
+	outbox, err := NewOutbox(dir)
+	require.NoError(t, err)
+
+	first, err := outbox.Add([]byte(`{"data":[{}]}`))
+	require.NoError(t, err)
+	second, err := outbox.Add([]byte(`{"data":[{},{}]}`))
+	require.NoError(t, err)
+
+	// a leftover temporary file from a crash must not show up as pending entry
+	require.NoError(t, os.WriteFile(dir+"/.tmp-crashed", []byte("garbage"), 0o600))
+
+	pending, err := outbox.Pending()
+	require.NoError(t, err)
+	assert.Equal(t, []string{first, second}, pending)
+
+	payload, err := outbox.Load(second)
+	require.NoError(t, err)
+	assert.Equal(t, 2, countRecords(payload))
+
+	require.NoError(t, outbox.Done(first))
+	require.NoError(t, outbox.Done(first), "marking an entry done twice must not fail")
+
+	// a new outbox on the same directory picks up what is left
+	reopened, err := NewOutbox(dir)
+	require.NoError(t, err)
+	pending, err = reopened.Pending()
+	require.NoError(t, err)
+	assert.Equal(t, []string{second}, pending)
+}
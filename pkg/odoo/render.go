@@ -0,0 +1,135 @@
+package odoo
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+// Format is an output format of Render.
+type Format string
+
+const (
+	FormatTable Format = "table"
+	FormatJSON  Format = "json"
+	FormatCSV   Format = "csv"
+)
+
+// ParseFormat returns the Format with the given name.
+func ParseFormat(name string) (Format, error) {
+	switch f := Format(name); f {
+	case FormatTable, FormatJSON, FormatCSV:
+		return f, nil
+	}
+	return "", fmt.Errorf("unknown format %q, must be one of %s, %s or %s", name, FormatTable, FormatJSON, FormatCSV)
+}
+
+// Total sums up the consumed units of all records with the same sales order, product and unit.
+type Total struct {
+	SalesOrder      string    `json:"sales_order_id"`
+	ProductID       string    `json:"product_id"`
+	UnitID          string    `json:"unit_id"`
+	ConsumedUnits   float64   `json:"consumed_units"`
+	NumberOfRecords int       `json:"number_of_records"`
+	TimeRange       TimeRange `json:"timerange"`
+}
+
+// Totals sums up the records per sales order, product and unit, sorted by sales order and product.
+// The time range of a total spans the time ranges of all its records.
+func Totals(records []OdooMeteredBillingRecord) []Total {
+	type key struct{ salesOrder, productID, unitID string }
+	byKey := map[key]*Total{}
+	for _, r := range records {
+		k := key{r.SalesOrder, r.ProductID, r.UnitID}
+		t, ok := byKey[k]
+		if !ok {
+			t = &Total{SalesOrder: r.SalesOrder, ProductID: r.ProductID, UnitID: r.UnitID, TimeRange: r.TimeRange}
+			byKey[k] = t
+		}
+		t.ConsumedUnits += r.ConsumedUnits
+		t.NumberOfRecords++
+		if r.TimeRange.From.Before(t.TimeRange.From) {
+			t.TimeRange.From = r.TimeRange.From
+		}
+		if r.TimeRange.To.After(t.TimeRange.To) {
+			t.TimeRange.To = r.TimeRange.To
+		}
+	}
+
+	totals := make([]Total, 0, len(byKey))
+	for _, t := range byKey {
+		totals = append(totals, *t)
+	}
+	sort.Slice(totals, func(i, j int) bool {
+		if totals[i].SalesOrder != totals[j].SalesOrder {
+			return totals[i].SalesOrder < totals[j].SalesOrder
+		}
+		if totals[i].ProductID != totals[j].ProductID {
+			return totals[i].ProductID < totals[j].ProductID
+		}
+		return totals[i].UnitID < totals[j].UnitID
+	})
+	return totals
+}
+
+// Render writes the records followed by their totals per sales order and product to out.
+func Render(out io.Writer, format Format, records []OdooMeteredBillingRecord) error {
+	totals := Totals(records)
+	switch format {
+	case FormatJSON:
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(struct {
+			Records []OdooMeteredBillingRecord `json:"records"`
+			Totals  []Total                    `json:"totals"`
+		}{Records: records, Totals: totals})
+	case FormatCSV:
+		return renderCSV(out, records, totals)
+	case FormatTable, "":
+		return renderTable(out, records, totals)
+	}
+	return fmt.Errorf("unknown format %q", format)
+}
+
+func renderTable(out io.Writer, records []OdooMeteredBillingRecord, totals []Total) error {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SALES ORDER\tPRODUCT\tINSTANCE\tCONSUMED UNITS\tUNIT\tFROM\tTO")
+	for _, r := range records {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			r.SalesOrder, r.ProductID, r.InstanceID, formatUnits(r.ConsumedUnits), r.UnitID,
+			r.TimeRange.From.Format(time.RFC3339), r.TimeRange.To.Format(time.RFC3339))
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "SALES ORDER\tPRODUCT\tRECORDS\tCONSUMED UNITS\tUNIT\tFROM\tTO")
+	for _, t := range totals {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\t%s\t%s\n",
+			t.SalesOrder, t.ProductID, t.NumberOfRecords, formatUnits(t.ConsumedUnits), t.UnitID,
+			t.TimeRange.From.Format(time.RFC3339), t.TimeRange.To.Format(time.RFC3339))
+	}
+	return w.Flush()
+}
+
+// renderCSV writes records and totals into the same table, told apart by the first column.
+func renderCSV(out io.Writer, records []OdooMeteredBillingRecord, totals []Total) error {
+	w := csv.NewWriter(out)
+	_ = w.Write([]string{"row", "sales_order_id", "product_id", "instance_id", "item_description", "item_group_description", "unit_id", "consumed_units", "number_of_records", "from", "to"})
+	for _, r := range records {
+		_ = w.Write([]string{"record", r.SalesOrder, r.ProductID, r.InstanceID, r.ItemDescription, r.ItemGroupDescription, r.UnitID,
+			formatUnits(r.ConsumedUnits), "1", r.TimeRange.From.Format(time.RFC3339), r.TimeRange.To.Format(time.RFC3339)})
+	}
+	for _, t := range totals {
+		_ = w.Write([]string{"total", t.SalesOrder, t.ProductID, "", "", "", t.UnitID,
+			formatUnits(t.ConsumedUnits), strconv.Itoa(t.NumberOfRecords), t.TimeRange.From.Format(time.RFC3339), t.TimeRange.To.Format(time.RFC3339)})
+	}
+	w.Flush()
+	return w.Error()
+}
+
+func formatUnits(units float64) string {
+	return strconv.FormatFloat(units, 'f', -1, 64)
+}
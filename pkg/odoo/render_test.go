@@ -0,0 +1,43 @@
+package odoo
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTotals(t *testing.T) {
+	day := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	first := TimeRange{From: day, To: day.Add(time.Hour)}
+	second := TimeRange{From: day.Add(time.Hour), To: day.Add(2 * time.Hour)}
+
+	records := []OdooMeteredBillingRecord{
+		{SalesOrder: "S2", ProductID: "pg", InstanceID: "a", UnitID: "h", ConsumedUnits: 1, TimeRange: first},
+		{SalesOrder: "S1", ProductID: "pg", InstanceID: "b", UnitID: "h", ConsumedUnits: 1, TimeRange: second},
+		{SalesOrder: "S1", ProductID: "pg", InstanceID: "c", UnitID: "h", ConsumedUnits: 1, TimeRange: first},
+		{SalesOrder: "S1", ProductID: "mysql", InstanceID: "d", UnitID: "h", ConsumedUnits: 0.5, TimeRange: first},
+	}
+
+	assert.Equal(t, []Total{
+		{SalesOrder: "S1", ProductID: "mysql", UnitID: "h", ConsumedUnits: 0.5, NumberOfRecords: 1, TimeRange: first},
+		{SalesOrder: "S1", ProductID: "pg", UnitID: "h", ConsumedUnits: 2, NumberOfRecords: 2, TimeRange: TimeRange{From: first.From, To: second.To}},
+		{SalesOrder: "S2", ProductID: "pg", UnitID: "h", ConsumedUnits: 1, NumberOfRecords: 1, TimeRange: first},
+	}, Totals(records))
+}
+
+func TestRender_CSV(t *testing.T) {
+	day := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	records := []OdooMeteredBillingRecord{
+		{SalesOrder: "S1", ProductID: "pg", InstanceID: "a", UnitID: "h", ConsumedUnits: 1, TimeRange: TimeRange{From: day, To: day.Add(time.Hour)}},
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, Render(&buf, FormatCSV, records))
+	assert.Equal(t, `row,sales_order_id,product_id,instance_id,item_description,item_group_description,unit_id,consumed_units,number_of_records,from,to
+record,S1,pg,a,,,h,1,1,2024-03-01T00:00:00Z,2024-03-01T01:00:00Z
+total,S1,pg,,,,h,1,1,2024-03-01T00:00:00Z,2024-03-01T01:00:00Z
+`, buf.String())
+}
@@ -0,0 +1,127 @@
+package odoo
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+)
+
+// UsageReport is the decoded response of the Odoo usage report API.
+type UsageReport struct {
+	// Accepted is the number of records Odoo accepted.
+	Accepted int
+	// Rejected are the records Odoo refused, with the reasons.
+	Rejected []RecordError
+	// Message is an error message concerning the request as a whole, if any.
+	Message string
+}
+
+// RecordError is a record Odoo refused, identified by its product and instance ID.
+type RecordError struct {
+	ProductID  string
+	InstanceID string
+	Reason     string
+}
+
+// rejection returns the reason why Odoo refused the record, if it did.
+func (r *UsageReport) rejection(record OdooMeteredBillingRecord) (string, bool) {
+	if r == nil {
+		return "", false
+	}
+	for _, e := range r.Rejected {
+		if e.ProductID == "" && e.InstanceID == "" {
+			continue
+		}
+		if (e.ProductID == "" || e.ProductID == record.ProductID) && (e.InstanceID == "" || e.InstanceID == record.InstanceID) {
+			return e.Reason, true
+		}
+	}
+	return "", false
+}
+
+// split separates the records Odoo accepted from those it refused.
+func (r *UsageReport) split(records []OdooMeteredBillingRecord) (accepted []OdooMeteredBillingRecord, rejected []RecordFailure) {
+	for _, record := range records {
+		if reason, ok := r.rejection(record); ok {
+			rejected = append(rejected, RecordFailure{Record: record, Reason: reason})
+			continue
+		}
+		accepted = append(accepted, record)
+	}
+	return accepted, rejected
+}
+
+// rawRecordError covers the field names Odoo uses for refused records across versions.
+type rawRecordError struct {
+	ProductID  string `json:"product_id"`
+	InstanceID string `json:"instance_id"`
+	Reason     string `json:"reason"`
+	Message    string `json:"message"`
+	Error      string `json:"error"`
+}
+
+// parseUsageReport decodes a response body of the usage report API.
+// It returns nil if the body is not a JSON object, e.g. an HTML error page of a proxy.
+// If Odoo does not report the accepted count and accepted is true, all records except the rejected ones count as accepted.
+func parseUsageReport(body []byte, numberOfRecords int, accepted bool) *UsageReport {
+	if !bytes.HasPrefix(bytes.TrimSpace(body), []byte("{")) {
+		return nil
+	}
+	var raw struct {
+		Accepted *int             `json:"accepted"`
+		Rejected []rawRecordError `json:"rejected"`
+		Errors   []rawRecordError `json:"errors"`
+		Message  string           `json:"message"`
+		Error    json.RawMessage  `json:"error"`
+	}
+	if err := json.Unmarshal(body, &raw); err != nil {
+		return nil
+	}
+
+	report := &UsageReport{Message: raw.Message}
+	if report.Message == "" {
+		report.Message = errorMessage(raw.Error)
+	}
+	for _, e := range append(raw.Rejected, raw.Errors...) {
+		reason := firstNonEmpty(e.Reason, e.Message, e.Error)
+		report.Rejected = append(report.Rejected, RecordError{ProductID: e.ProductID, InstanceID: e.InstanceID, Reason: reason})
+	}
+
+	switch {
+	case raw.Accepted != nil:
+		report.Accepted = *raw.Accepted
+	case accepted && numberOfRecords >= len(report.Rejected):
+		report.Accepted = numberOfRecords - len(report.Rejected)
+	}
+	return report
+}
+
+// errorMessage returns the message of an error field, which is either a string or an object with a message.
+func errorMessage(raw json.RawMessage) string {
+	if len(raw) == 0 {
+		return ""
+	}
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return s
+	}
+	var obj struct {
+		Message string `json:"message"`
+		Data    struct {
+			Message string `json:"message"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(raw, &obj); err == nil {
+		return firstNonEmpty(obj.Data.Message, obj.Message)
+	}
+	return strings.TrimSpace(string(raw))
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
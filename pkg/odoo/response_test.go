@@ -0,0 +1,111 @@
+package odoo
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseUsageReport(t *testing.T) {
+	tests := map[string]struct {
+		body     string
+		accepted bool
+		expected *UsageReport
+	}{
+		"given counts and rejected records, we should decode them": {
+			body:     `{"accepted": 1, "rejected": [{"product_id": "p", "instance_id": "i", "reason": "unknown sales order"}]}`,
+			accepted: true,
+			expected: &UsageReport{Accepted: 1, Rejected: []RecordError{{ProductID: "p", InstanceID: "i", Reason: "unknown sales order"}}},
+		},
+		"given errors with messages and no count, we should derive the accepted count": {
+			body:     `{"errors": [{"instance_id": "i", "message": "unknown unit"}]}`,
+			accepted: true,
+			expected: &UsageReport{Accepted: 2, Rejected: []RecordError{{InstanceID: "i", Reason: "unknown unit"}}},
+		},
+		"given a JSON-RPC style error, we should take its message": {
+			body:     `{"error": {"code": 200, "message": "Odoo Server Error", "data": {"message": "invalid payload"}}}`,
+			expected: &UsageReport{Message: "invalid payload"},
+		},
+		"given an error string, we should take it as message": {
+			body:     `{"error": "rate limited"}`,
+			expected: &UsageReport{Message: "rate limited"},
+		},
+		"given an HTML page, we should not decode anything": {
+			body: `<html>Bad Gateway</html>`,
+		},
+		"given an empty body, we should not decode anything": {
+			body: ``,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, parseUsageReport([]byte(tc.body), 3, tc.accepted))
+		})
+	}
+}
+
+func TestOdooAPIClient_SendData_RecordErrors(t *testing.T) {
+	from := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	good := OdooMeteredBillingRecord{ProductID: "p", InstanceID: "good", TimeRange: TimeRange{From: from, To: from.Add(time.Hour)}}
+	bad := OdooMeteredBillingRecord{ProductID: "p", InstanceID: "bad", TimeRange: TimeRange{From: from, To: from.Add(time.Hour)}}
+
+	tests := map[string]struct {
+		status           int
+		body             string
+		expectedAccepted []OdooMeteredBillingRecord
+		expectedFailures []RecordFailure
+	}{
+		"given Odoo refuses a single record, we should report only that record": {
+			status:           http.StatusOK,
+			body:             `{"accepted": 1, "rejected": [{"product_id": "p", "instance_id": "bad", "reason": "no such sales order"}]}`,
+			expectedAccepted: []OdooMeteredBillingRecord{good},
+			expectedFailures: []RecordFailure{{Record: bad, Reason: "no such sales order"}},
+		},
+		"given Odoo refuses the request naming one record, we should report all records": {
+			status: http.StatusBadRequest,
+			body:   `{"message": "validation failed", "rejected": [{"instance_id": "bad", "reason": "unit missing"}]}`,
+			expectedFailures: []RecordFailure{
+				{Record: good, Reason: "validation failed"},
+				{Record: bad, Reason: "unit missing"},
+			},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			mux := http.NewServeMux()
+			mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				_, _ = w.Write([]byte(`{"access_token":"token","token_type":"bearer","expires_in":3600}`))
+			})
+			mux.HandleFunc("/usage", func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tc.status)
+				_, _ = w.Write([]byte(tc.body))
+			})
+			srv := httptest.NewServer(mux)
+			defer srv.Close()
+
+			dir := t.TempDir()
+			ledger, err := OpenLedger(dir + "/ledger")
+			require.NoError(t, err)
+			defer ledger.Close()
+
+			client := NewOdooAPIClient(context.Background(), srv.URL+"/usage", srv.URL+"/token", "id", "secret", logr.Discard(), newTestMetrics(),
+				WithRetry(testRetryConfig), WithLedger(ledger))
+			result, err := client.SendData(context.Background(), []OdooMeteredBillingRecord{good, bad})
+			assert.Error(t, err)
+			assert.Equal(t, tc.expectedAccepted, result.Accepted())
+			assert.Equal(t, tc.expectedFailures, result.Failures())
+
+			assert.Equal(t, len(tc.expectedAccepted) > 0, ledger.Contains(good), "only accepted records belong in the ledger")
+			assert.False(t, ledger.Contains(bad), "refused records must not be in the ledger")
+		})
+	}
+}
@@ -0,0 +1,142 @@
+package odoo
+
+import (
+	"errors"
+	"fmt"
+)
+
+// WithBatchSize limits the number of records sent to Odoo in a single request.
+// Zero or a negative size sends all records in one request.
+func WithBatchSize(size int) OdooAPIClientOpt {
+	return func(c *OdooAPIClient) {
+		c.batchSize = size
+	}
+}
+
+// SendResult reports the outcome of sending records to Odoo, chunk by chunk.
+type SendResult struct {
+	Chunks []ChunkResult
+	// Suppressed contains the records which were not sent because Odoo had already accepted them before.
+	Suppressed []OdooMeteredBillingRecord
+	// Quarantined contains the records which were not sent because they failed validation.
+	Quarantined []QuarantinedRecord
+}
+
+// ChunkResult is the outcome of a single request to Odoo.
+type ChunkResult struct {
+	// Index is the position of the chunk, starting at 0.
+	Index   int
+	Records []OdooMeteredBillingRecord
+	// Err is nil if Odoo accepted the chunk. Odoo may still have refused single records, see Report.
+	Err error
+	// Report is what Odoo responded, or nil if it could not be reached or did not respond with a usage report.
+	Report *UsageReport
+}
+
+// RecordFailure is a record Odoo did not accept, with the reason.
+type RecordFailure struct {
+	Record OdooMeteredBillingRecord
+	Reason string
+}
+
+// accepted returns the records Odoo accepted.
+func (c ChunkResult) accepted() []OdooMeteredBillingRecord {
+	if c.Err != nil {
+		return nil
+	}
+	accepted, _ := c.Report.split(c.Records)
+	return accepted
+}
+
+// failures returns the records Odoo did not accept. Records of a failed chunk which Odoo did not name
+// are reported with the reason the whole chunk failed.
+func (c ChunkResult) failures() []RecordFailure {
+	if c.Err == nil {
+		_, rejected := c.Report.split(c.Records)
+		return rejected
+	}
+	chunkReason := c.Err.Error()
+	if c.Report != nil && c.Report.Message != "" {
+		chunkReason = c.Report.Message
+	}
+	failures := make([]RecordFailure, 0, len(c.Records))
+	for _, record := range c.Records {
+		reason, ok := c.Report.rejection(record)
+		if !ok {
+			reason = chunkReason
+		}
+		failures = append(failures, RecordFailure{Record: record, Reason: reason})
+	}
+	return failures
+}
+
+// Accepted returns all records Odoo accepted.
+func (r *SendResult) Accepted() []OdooMeteredBillingRecord {
+	if r == nil {
+		return nil
+	}
+	var records []OdooMeteredBillingRecord
+	for _, chunk := range r.Chunks {
+		records = append(records, chunk.accepted()...)
+	}
+	return records
+}
+
+// Rejected returns all records Odoo did not accept. They can be passed to SendData again.
+func (r *SendResult) Rejected() []OdooMeteredBillingRecord {
+	var records []OdooMeteredBillingRecord
+	for _, failure := range r.Failures() {
+		records = append(records, failure.Record)
+	}
+	return records
+}
+
+// Failures returns all records Odoo did not accept, with the reasons.
+func (r *SendResult) Failures() []RecordFailure {
+	if r == nil {
+		return nil
+	}
+	var failures []RecordFailure
+	for _, chunk := range r.Chunks {
+		failures = append(failures, chunk.failures()...)
+	}
+	return failures
+}
+
+// Err joins the errors of all failed chunks and of records Odoo refused in accepted chunks,
+// or returns nil if all records were accepted.
+func (r *SendResult) Err() error {
+	if r == nil {
+		return nil
+	}
+	var errs []error
+	for _, chunk := range r.Chunks {
+		if chunk.Err != nil {
+			errs = append(errs, fmt.Errorf("chunk %d (%d records): %w", chunk.Index+1, len(chunk.Records), chunk.Err))
+			continue
+		}
+		if rejected := chunk.failures(); len(rejected) > 0 {
+			errs = append(errs, fmt.Errorf("chunk %d (%d records): Odoo refused %d records", chunk.Index+1, len(chunk.Records), len(rejected)))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// splitChunks splits the records into chunks of at most size records. A size of 0 or less returns a single chunk.
+func splitChunks(records []OdooMeteredBillingRecord, size int) [][]OdooMeteredBillingRecord {
+	if len(records) == 0 {
+		return nil
+	}
+	if size <= 0 || len(records) <= size {
+		return [][]OdooMeteredBillingRecord{records}
+	}
+	chunks := make([][]OdooMeteredBillingRecord, 0, (len(records)+size-1)/size)
+	for start := 0; start < len(records); start += size {
+		end := start + size
+		if end > len(records) {
+			end = len(records)
+		}
+		chunks = append(chunks, records[start:end])
+	}
+	return chunks
+}
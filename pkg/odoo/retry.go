@@ -0,0 +1,142 @@
+package odoo
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// RetryConfig configures how the client retries requests Odoo did not accept.
+type RetryConfig struct {
+	// MaxRetries is the number of retries after the first attempt, 0 disables retries.
+	MaxRetries int
+	// InitialBackoff is the wait time before the first retry, it is doubled for every further retry.
+	InitialBackoff time.Duration
+	// MaxBackoff caps the exponential backoff. A Retry-After header sent by Odoo is honored regardless.
+	MaxBackoff time.Duration
+}
+
+// DefaultRetryConfig is used if the client is not configured otherwise.
+var DefaultRetryConfig = RetryConfig{
+	MaxRetries:     3,
+	InitialBackoff: time.Second,
+	MaxBackoff:     time.Minute,
+}
+
+// WithRetry configures retries for requests to Odoo.
+func WithRetry(cfg RetryConfig) OdooAPIClientOpt {
+	return func(c *OdooAPIClient) {
+		c.retry = cfg
+	}
+}
+
+// APIError is returned if the Odoo API responds with a status other than 200.
+type APIError struct {
+	StatusCode int
+	Body       string
+	// RetryAfter is the wait time Odoo asked for with the Retry-After header, if any.
+	RetryAfter time.Duration
+	// Report is the decoded body, or nil if it is not a usage report.
+	Report *UsageReport
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("API error when sending records to Odoo (status %d):\n%s", e.StatusCode, e.Body)
+}
+
+// Temporary reports whether the request may succeed if it is sent again.
+// Rate limits and server errors are temporary, any other client error is permanent.
+func (e *APIError) Temporary() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500
+}
+
+// AuthError is returned if no OAuth token could be obtained to authenticate with Odoo.
+type AuthError struct {
+	Err error
+}
+
+func (e *AuthError) Error() string {
+	return fmt.Sprintf("cannot authenticate with Odoo: %v", e.Err)
+}
+
+func (e *AuthError) Unwrap() error {
+	return e.Err
+}
+
+// Temporary reports whether fetching a token may succeed if it is tried again.
+// Rejected client credentials are permanent, unreachable or failing token endpoints are not.
+func (e *AuthError) Temporary() bool {
+	var retrieveErr *oauth2.RetrieveError
+	if errors.As(e.Err, &retrieveErr) && retrieveErr.Response != nil {
+		code := retrieveErr.Response.StatusCode
+		return code == http.StatusTooManyRequests || code >= 500
+	}
+	return true
+}
+
+// authTokenSource wraps every error of the underlying token source in an AuthError,
+// so that token errors can be told apart from API errors after they went through the http.Client.
+type authTokenSource struct {
+	source oauth2.TokenSource
+}
+
+func (s authTokenSource) Token() (*oauth2.Token, error) {
+	token, err := s.source.Token()
+	if err != nil {
+		return nil, &AuthError{Err: err}
+	}
+	return token, nil
+}
+
+// isPermanent reports whether err will not go away by sending the same payload again.
+func isPermanent(err error) bool {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return !apiErr.Temporary()
+	}
+	var authErr *AuthError
+	if errors.As(err, &authErr) {
+		return !authErr.Temporary()
+	}
+	return false
+}
+
+// backoff returns the wait time before the given retry (starting at 0), with the upper half being random jitter.
+func (cfg RetryConfig) backoff(retry int) time.Duration {
+	d := cfg.InitialBackoff
+	for i := 0; i < retry && d < cfg.MaxBackoff; i++ {
+		d *= 2
+	}
+	if cfg.MaxBackoff > 0 && d > cfg.MaxBackoff {
+		d = cfg.MaxBackoff
+	}
+	if d <= 0 {
+		return 0
+	}
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// parseRetryAfter parses the value of a Retry-After header, which is either a number of seconds or an HTTP date.
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		if d := time.Until(date); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
@@ -0,0 +1,248 @@
+package odoo
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// Sink receives the billing records produced by a collector.
+// The OdooAPIClient is the Sink used in production; the others are meant for local runs and archiving.
+type Sink interface {
+	SendData(ctx context.Context, records []OdooMeteredBillingRecord) (*SendResult, error)
+}
+
+// Flusher is implemented by sinks which hold back records they could not deliver, like the OdooAPIClient with an outbox.
+type Flusher interface {
+	// FlushOutbox tries to deliver the records held back.
+	FlushOutbox(ctx context.Context) error
+}
+
+// MultiSink sends the records to every sink in turn.
+// The results of the sinks are merged record by record, see mergeResults, and the errors of all sinks are joined.
+type MultiSink []Sink
+
+func (m MultiSink) SendData(ctx context.Context, records []OdooMeteredBillingRecord) (*SendResult, error) {
+	results := make([]*SendResult, len(m))
+	errs := make([]error, len(m))
+	for i, sink := range m {
+		res, err := sink.SendData(ctx, records)
+		results[i] = res
+		if err != nil {
+			errs[i] = fmt.Errorf("sink %d: %w", i+1, err)
+		}
+	}
+	return mergeResults(records, results, errs), errors.Join(errs...)
+}
+
+// outcome is what became of a record in a sink, from best to worst.
+type outcome int
+
+const (
+	outcomeAccepted outcome = iota
+	outcomeSuppressed
+	outcomeRejected
+	outcomeFailed
+	outcomeQuarantined
+)
+
+// mergeResults merges the results of the sinks, taking the worst outcome of every record across the sinks:
+// a record counts as accepted only if every sink accepted it. A record a sink did not report on counts as failed
+// if the sink returned an error. The reasons are prefixed with the number of the sink.
+func mergeResults(records []OdooMeteredBillingRecord, results []*SendResult, errs []error) *SendResult {
+	type merged struct {
+		outcome     outcome
+		reason      string
+		quarantined QuarantinedRecord
+	}
+	outcomes := map[string]*merged{}
+	for _, record := range records {
+		outcomes[Fingerprint(record)] = &merged{}
+	}
+	worse := func(record OdooMeteredBillingRecord, o outcome, reason string) *merged {
+		m, ok := outcomes[Fingerprint(record)]
+		if ok && o > m.outcome {
+			m.outcome, m.reason = o, reason
+		}
+		return m
+	}
+
+	var chunkErrs []error
+	for i, result := range results {
+		reported := map[string]bool{}
+		report := func(record OdooMeteredBillingRecord, o outcome, reason string) *merged {
+			reported[Fingerprint(record)] = true
+			if reason != "" {
+				reason = fmt.Sprintf("sink %d: %s", i+1, reason)
+			}
+			return worse(record, o, reason)
+		}
+		if result != nil {
+			for _, chunk := range result.Chunks {
+				if chunk.Err != nil {
+					chunkErrs = append(chunkErrs, fmt.Errorf("sink %d: %w", i+1, chunk.Err))
+				}
+				for _, record := range chunk.accepted() {
+					report(record, outcomeAccepted, "")
+				}
+				o := outcomeRejected
+				if chunk.Err != nil {
+					o = outcomeFailed
+				}
+				for _, failure := range chunk.failures() {
+					report(failure.Record, o, failure.Reason)
+				}
+			}
+			for _, record := range result.Suppressed {
+				report(record, outcomeSuppressed, "")
+			}
+			for _, q := range result.Quarantined {
+				if m := report(q.Record, outcomeQuarantined, ""); m != nil && m.outcome == outcomeQuarantined {
+					m.quarantined = q
+				}
+			}
+		}
+		if errs[i] == nil {
+			continue
+		}
+		for _, record := range records {
+			if !reported[Fingerprint(record)] {
+				worse(record, outcomeFailed, errs[i].Error())
+			}
+		}
+	}
+
+	result := &SendResult{}
+	var accepted, rejected, failed []OdooMeteredBillingRecord
+	var rejections, failures []RecordError
+	quarantined := map[string]bool{}
+	for _, record := range records {
+		m := outcomes[Fingerprint(record)]
+		recordErr := RecordError{ProductID: record.ProductID, InstanceID: record.InstanceID, Reason: m.reason}
+		switch m.outcome {
+		case outcomeAccepted:
+			accepted = append(accepted, record)
+		case outcomeSuppressed:
+			result.Suppressed = append(result.Suppressed, record)
+		case outcomeRejected:
+			rejected = append(rejected, record)
+			rejections = append(rejections, recordErr)
+		case outcomeFailed:
+			failed = append(failed, record)
+			failures = append(failures, recordErr)
+		case outcomeQuarantined:
+			if !quarantined[Fingerprint(record)] {
+				quarantined[Fingerprint(record)] = true
+				result.Quarantined = append(result.Quarantined, m.quarantined)
+			}
+		}
+	}
+	if len(accepted) > 0 {
+		result.Chunks = append(result.Chunks, ChunkResult{Index: len(result.Chunks), Records: accepted})
+	}
+	if len(rejected) > 0 {
+		result.Chunks = append(result.Chunks, ChunkResult{Index: len(result.Chunks), Records: rejected, Report: &UsageReport{Rejected: rejections}})
+	}
+	if len(failed) > 0 {
+		chunkErr := errors.Join(chunkErrs...)
+		if chunkErr == nil {
+			chunkErr = errors.Join(errs...)
+		}
+		result.Chunks = append(result.Chunks, ChunkResult{Index: len(result.Chunks), Records: failed, Err: chunkErr, Report: &UsageReport{Rejected: failures}})
+	}
+	return result
+}
+
+// FlushOutbox flushes every sink which is a Flusher.
+func (m MultiSink) FlushOutbox(ctx context.Context) error {
+	var errs []error
+	for i, sink := range m {
+		if f, ok := sink.(Flusher); ok {
+			if err := f.FlushOutbox(ctx); err != nil {
+				errs = append(errs, fmt.Errorf("sink %d: %w", i+1, err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// FileSink appends every record as a line of JSON to a file.
+type FileSink struct {
+	mu   sync.Mutex
+	path string
+}
+
+// NewFileSink creates a FileSink writing to the file at path. The file is created on the first write if it does not exist.
+func NewFileSink(path string) *FileSink {
+	return &FileSink{path: path}
+}
+
+func (s *FileSink) SendData(_ context.Context, records []OdooMeteredBillingRecord) (*SendResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.write(records)
+	return &SendResult{Chunks: []ChunkResult{{Records: records, Err: err}}}, err
+}
+
+func (s *FileSink) write(records []OdooMeteredBillingRecord) error {
+	file, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return fmt.Errorf("cannot open sink file %s: %w", s.path, err)
+	}
+	defer file.Close()
+
+	enc := json.NewEncoder(file)
+	for _, r := range records {
+		if err := enc.Encode(r); err != nil {
+			return fmt.Errorf("cannot write record to sink file %s: %w", s.path, err)
+		}
+	}
+	return file.Sync()
+}
+
+// ReadRecords reads records written by a FileSink, one JSON object per line.
+func ReadRecords(r io.Reader) ([]OdooMeteredBillingRecord, error) {
+	var records []OdooMeteredBillingRecord
+	dec := json.NewDecoder(r)
+	for {
+		var record OdooMeteredBillingRecord
+		err := dec.Decode(&record)
+		if errors.Is(err, io.EOF) {
+			return records, nil
+		}
+		if err != nil {
+			return records, fmt.Errorf("cannot read record %d: %w", len(records)+1, err)
+		}
+		records = append(records, record)
+	}
+}
+
+// WriterSink renders the records in the given format, e.g. for dry runs.
+type WriterSink struct {
+	mu     sync.Mutex
+	out    io.Writer
+	format Format
+}
+
+// NewStdoutSink creates a WriterSink printing the records as a table to stdout.
+func NewStdoutSink() *WriterSink {
+	return NewWriterSink(os.Stdout, FormatTable)
+}
+
+// NewWriterSink creates a WriterSink rendering to out in the given format.
+func NewWriterSink(out io.Writer, format Format) *WriterSink {
+	return &WriterSink{out: out, format: format}
+}
+
+func (s *WriterSink) SendData(_ context.Context, records []OdooMeteredBillingRecord) (*SendResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := Render(s.out, s.format, records)
+	return &SendResult{Chunks: []ChunkResult{{Records: records, Err: err}}}, err
+}
@@ -0,0 +1,100 @@
+package odoo
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// resultSink returns the result the function gives for the records.
+type resultSink func(records []OdooMeteredBillingRecord) (*SendResult, error)
+
+func (s resultSink) SendData(_ context.Context, records []OdooMeteredBillingRecord) (*SendResult, error) {
+	return s(records)
+}
+
+func TestMultiSink_SendData(t *testing.T) {
+	from := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	first := OdooMeteredBillingRecord{ProductID: "p", InstanceID: "first", TimeRange: TimeRange{From: from, To: from.Add(time.Hour)}}
+	second := first
+	second.InstanceID = "second"
+	records := []OdooMeteredBillingRecord{first, second}
+
+	rejectingSecond := resultSink(func(records []OdooMeteredBillingRecord) (*SendResult, error) {
+		result := &SendResult{Chunks: []ChunkResult{{Records: records, Report: &UsageReport{Accepted: 1,
+			Rejected: []RecordError{{ProductID: "p", InstanceID: "second", Reason: "unknown sales order"}}}}}}
+		return result, result.Err()
+	})
+
+	tests := map[string]struct {
+		second             Sink
+		expectedAccepted   []OdooMeteredBillingRecord
+		expectedFailures   []RecordFailure
+		expectedSuppressed []OdooMeteredBillingRecord
+		expectedChunkErr   bool
+		expectedError      string
+	}{
+		"given both sinks accepting all records, we should get them accepted": {
+			second:           &recordingSink{},
+			expectedAccepted: records,
+		},
+		"given a second sink rejecting a record, we should get it rejected": {
+			second:           rejectingSecond,
+			expectedAccepted: []OdooMeteredBillingRecord{first},
+			expectedFailures: []RecordFailure{{Record: second, Reason: "sink 2: unknown sales order"}},
+			expectedError:    "sink 2: chunk 1 (2 records): Odoo refused 1 records",
+		},
+		"given a second sink failing, we should get all records failed": {
+			second: resultSink(func(records []OdooMeteredBillingRecord) (*SendResult, error) {
+				err := errors.New("service unavailable")
+				return &SendResult{Chunks: []ChunkResult{{Records: records, Err: err}}}, err
+			}),
+			expectedFailures: []RecordFailure{
+				{Record: first, Reason: "sink 2: service unavailable"},
+				{Record: second, Reason: "sink 2: service unavailable"},
+			},
+			expectedChunkErr: true,
+			expectedError:    "sink 2: service unavailable",
+		},
+		"given a second sink failing without result, we should get all records failed": {
+			second: resultSink(func([]OdooMeteredBillingRecord) (*SendResult, error) {
+				return nil, errors.New("cannot get token")
+			}),
+			expectedFailures: []RecordFailure{
+				{Record: first, Reason: "sink 2: cannot get token"},
+				{Record: second, Reason: "sink 2: cannot get token"},
+			},
+			expectedChunkErr: true,
+			expectedError:    "sink 2: cannot get token",
+		},
+		"given a second sink suppressing a record, we should get it suppressed": {
+			second: resultSink(func(records []OdooMeteredBillingRecord) (*SendResult, error) {
+				return &SendResult{Chunks: []ChunkResult{{Records: records[:1]}}, Suppressed: records[1:]}, nil
+			}),
+			expectedAccepted:   []OdooMeteredBillingRecord{first},
+			expectedSuppressed: []OdooMeteredBillingRecord{second},
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			result, err := MultiSink{&recordingSink{}, tc.second}.SendData(context.Background(), records)
+			if tc.expectedError != "" {
+				assert.EqualError(t, err, tc.expectedError)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tc.expectedAccepted, result.Accepted())
+			assert.Equal(t, tc.expectedFailures, result.Failures())
+			assert.Equal(t, tc.expectedSuppressed, result.Suppressed)
+
+			chunkFailed := false
+			for _, chunk := range result.Chunks {
+				chunkFailed = chunkFailed || chunk.Err != nil
+			}
+			assert.Equal(t, tc.expectedChunkErr, chunkFailed)
+		})
+	}
+}
@@ -0,0 +1,172 @@
+package odoo
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// timeLayouts are the ISO 8601 date-time representations accepted in time ranges, tried in order.
+// Layouts without a zone offset are interpreted as UTC, which is what Odoo uses internally.
+var timeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05.999999999Z0700",
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02 15:04:05.999999999Z0700",
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02T15:04",
+	"2006-01-02",
+}
+
+// parseTimeRange parses an ISO 8601 time interval.
+// Besides the "from/to" format produced by MarshalJSON, it accepts "--" as separator, other date-time
+// representations (see timeLayouts) and a duration instead of either end, as in "from/PT1H" or "P1D/to".
+func parseTimeRange(s string) (TimeRange, error) {
+	from, to, ok := strings.Cut(s, "/")
+	if !ok {
+		from, to, ok = strings.Cut(s, "--")
+	}
+	if !ok {
+		return TimeRange{}, fmt.Errorf("invalid time range %q: expected format from/to", s)
+	}
+	from, to = strings.TrimSpace(from), strings.TrimSpace(to)
+
+	fromIsDuration := strings.HasPrefix(from, "P")
+	toIsDuration := strings.HasPrefix(to, "P")
+	switch {
+	case fromIsDuration && toIsDuration:
+		return TimeRange{}, fmt.Errorf("invalid time range %q: at most one end can be a duration", s)
+	case toIsDuration:
+		fromTime, err := parseTime(from)
+		if err != nil {
+			return TimeRange{}, fmt.Errorf("invalid time range %q: %w", s, err)
+		}
+		d, err := parseDuration(to)
+		if err != nil {
+			return TimeRange{}, fmt.Errorf("invalid time range %q: %w", s, err)
+		}
+		return TimeRange{From: fromTime, To: d.addTo(fromTime, 1)}, nil
+	case fromIsDuration:
+		toTime, err := parseTime(to)
+		if err != nil {
+			return TimeRange{}, fmt.Errorf("invalid time range %q: %w", s, err)
+		}
+		d, err := parseDuration(from)
+		if err != nil {
+			return TimeRange{}, fmt.Errorf("invalid time range %q: %w", s, err)
+		}
+		return TimeRange{From: d.addTo(toTime, -1), To: toTime}, nil
+	}
+
+	fromTime, err := parseTime(from)
+	if err != nil {
+		return TimeRange{}, fmt.Errorf("invalid time range %q: %w", s, err)
+	}
+	toTime, err := parseTime(to)
+	if err != nil {
+		return TimeRange{}, fmt.Errorf("invalid time range %q: %w", s, err)
+	}
+	return TimeRange{From: fromTime, To: toTime}, nil
+}
+
+func parseTime(s string) (time.Time, error) {
+	for _, layout := range timeLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("cannot parse %q as ISO 8601 date-time", s)
+}
+
+// isoDuration is an ISO 8601 duration. Years, months and days are kept apart,
+// because their length depends on the point in time they are added to.
+type isoDuration struct {
+	years, months, days int
+	clock               time.Duration
+}
+
+func (d isoDuration) addTo(t time.Time, sign int) time.Time {
+	return t.AddDate(sign*d.years, sign*d.months, sign*d.days).Add(time.Duration(sign) * d.clock)
+}
+
+// parseDuration parses durations like "PT1H", "P1D", "P1Y2M3DT4H5M6.5S" or "P2W".
+func parseDuration(s string) (isoDuration, error) {
+	var d isoDuration
+	rest, ok := strings.CutPrefix(s, "P")
+	if !ok || rest == "" {
+		return d, fmt.Errorf("cannot parse %q as ISO 8601 duration", s)
+	}
+
+	datePart, timePart, hasTime := strings.Cut(rest, "T")
+	if hasTime && timePart == "" {
+		return d, fmt.Errorf("cannot parse %q as ISO 8601 duration: empty time part", s)
+	}
+
+	err := scanDurationParts(datePart, func(value float64, unit byte) error {
+		if value != float64(int(value)) {
+			return fmt.Errorf("fractional %c is not supported", unit)
+		}
+		switch unit {
+		case 'Y':
+			d.years = int(value)
+		case 'M':
+			d.months = int(value)
+		case 'W':
+			d.days += 7 * int(value)
+		case 'D':
+			d.days += int(value)
+		default:
+			return fmt.Errorf("unknown unit %c", unit)
+		}
+		return nil
+	})
+	if err != nil {
+		return d, fmt.Errorf("cannot parse %q as ISO 8601 duration: %w", s, err)
+	}
+
+	err = scanDurationParts(timePart, func(value float64, unit byte) error {
+		switch unit {
+		case 'H':
+			d.clock += time.Duration(value * float64(time.Hour))
+		case 'M':
+			d.clock += time.Duration(value * float64(time.Minute))
+		case 'S':
+			d.clock += time.Duration(value * float64(time.Second))
+		default:
+			return fmt.Errorf("unknown unit %c", unit)
+		}
+		return nil
+	})
+	if err != nil {
+		return d, fmt.Errorf("cannot parse %q as ISO 8601 duration: %w", s, err)
+	}
+	return d, nil
+}
+
+// scanDurationParts calls fn for every number-unit pair in s, e.g. twice for "1Y2M".
+func scanDurationParts(s string, fn func(value float64, unit byte) error) error {
+	start := 0
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if (c >= '0' && c <= '9') || c == '.' || c == ',' {
+			continue
+		}
+		if i == start {
+			return fmt.Errorf("missing number before %c", c)
+		}
+		value, err := strconv.ParseFloat(strings.ReplaceAll(s[start:i], ",", "."), 64)
+		if err != nil {
+			return err
+		}
+		if err := fn(value, c); err != nil {
+			return err
+		}
+		start = i + 1
+	}
+	if start != len(s) {
+		return fmt.Errorf("missing unit after %s", s[start:])
+	}
+	return nil
+}
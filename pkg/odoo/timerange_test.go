@@ -0,0 +1,161 @@
+package odoo
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"math/rand"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTimeRange_UnmarshalJSON(t *testing.T) {
+	from := time.Date(2024, 3, 30, 23, 0, 0, 0, time.UTC)
+	to := time.Date(2024, 3, 31, 22, 0, 0, 0, time.UTC)
+
+	tests := map[string]struct {
+		input     string
+		expected  TimeRange
+		expectErr bool
+	}{
+		"given the format we marshal, we should get the same instants": {
+			input:    `"2024-03-30T23:00:00Z/2024-03-31T22:00:00Z"`,
+			expected: TimeRange{From: from, To: to},
+		},
+		"given zone offsets, we should get the same instants": {
+			input:    `"2024-03-31T00:00:00+01:00/2024-04-01T00:00:00+02:00"`,
+			expected: TimeRange{From: from, To: to},
+		},
+		"given offsets without colon and fractional seconds, we should get the same instants": {
+			input:    `"2024-03-31T00:00:00.000+0100/2024-04-01T00:00:00.000+0200"`,
+			expected: TimeRange{From: from, To: to},
+		},
+		"given the Odoo date-time format without zone, we should assume UTC": {
+			input:    `"2024-03-30 23:00:00/2024-03-31 22:00:00"`,
+			expected: TimeRange{From: from, To: to},
+		},
+		"given a double hyphen as separator, we should parse both ends": {
+			input:    `"2024-03-30T23:00:00Z--2024-03-31T22:00:00Z"`,
+			expected: TimeRange{From: from, To: to},
+		},
+		"given a start and a duration, we should compute the end": {
+			input:    `"2024-03-30T23:00:00Z/PT23H"`,
+			expected: TimeRange{From: from, To: to},
+		},
+		"given a negative duration, we should fail": {
+			input:     `"P1DT-1H/2024-03-31T22:00:00Z"`,
+			expectErr: true,
+		},
+		"given a duration and an end, we should compute the start": {
+			input:    `"P1D/2024-03-31T22:00:00Z"`,
+			expected: TimeRange{From: time.Date(2024, 3, 30, 22, 0, 0, 0, time.UTC), To: to},
+		},
+		"given a calendar duration and an end, we should compute the start": {
+			input:    `"P1M/2024-03-15T22:00:00Z"`,
+			expected: TimeRange{From: time.Date(2024, 2, 15, 22, 0, 0, 0, time.UTC), To: time.Date(2024, 3, 15, 22, 0, 0, 0, time.UTC)},
+		},
+		"given dates only, we should get midnight UTC": {
+			input:    `"2024-03-30/P1W"`,
+			expected: TimeRange{From: time.Date(2024, 3, 30, 0, 0, 0, 0, time.UTC), To: time.Date(2024, 4, 6, 0, 0, 0, 0, time.UTC)},
+		},
+		"given no separator, we should fail": {
+			input:     `"2024-03-30T23:00:00Z"`,
+			expectErr: true,
+		},
+		"given two durations, we should fail": {
+			input:     `"PT1H/PT1H"`,
+			expectErr: true,
+		},
+		"given a number, we should fail": {
+			input:     `12`,
+			expectErr: true,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var tr TimeRange
+			err := json.Unmarshal([]byte(tc.input), &tr)
+			if tc.expectErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.True(t, tc.expected.From.Equal(tr.From), "from: expected %s, got %s", tc.expected.From, tr.From)
+			assert.True(t, tc.expected.To.Equal(tr.To), "to: expected %s, got %s", tc.expected.To, tr.To)
+		})
+	}
+}
+
+// TestOdooMeteredBillingRecord_RoundTrip checks for many random records that unmarshalling a marshalled
+// record yields the same record, and marshalling it again yields the same JSON.
+func TestOdooMeteredBillingRecord_RoundTrip(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	zones := []*time.Location{time.UTC, time.FixedZone("", 3600), time.FixedZone("", -9*3600-1800)}
+	randomString := func() string {
+		const chars = "abcXYZ019 -/_:äö\"\\\n"
+		b := make([]rune, rnd.Intn(12))
+		runes := []rune(chars)
+		for i := range b {
+			b[i] = runes[rnd.Intn(len(runes))]
+		}
+		return string(b)
+	}
+	randomTime := func() time.Time {
+		return time.Unix(rnd.Int63n(4e9), rnd.Int63n(1e9)*int64(rnd.Intn(2))).In(zones[rnd.Intn(len(zones))])
+	}
+
+	for i := 0; i < 1000; i++ {
+		record := OdooMeteredBillingRecord{
+			ProductID:            randomString(),
+			InstanceID:           randomString(),
+			ItemDescription:      randomString(),
+			ItemGroupDescription: randomString(),
+			SalesOrder:           randomString(),
+			UnitID:               randomString(),
+			ConsumedUnits:        math.Float64frombits(rnd.Uint64()&^(0x7ff<<52)) * float64(rnd.Intn(1e6)),
+			TimeRange:            TimeRange{From: randomTime(), To: randomTime()},
+		}
+
+		data, err := json.Marshal(record)
+		require.NoError(t, err)
+		var decoded OdooMeteredBillingRecord
+		require.NoError(t, json.Unmarshal(data, &decoded), "record %d: %s", i, data)
+
+		again, err := json.Marshal(decoded)
+		require.NoError(t, err)
+		assert.JSONEq(t, string(data), string(again), "record %d", i)
+
+		// the location of the decoded times is a fixed zone with the same offset, so compare the instants separately
+		assert.True(t, record.TimeRange.From.Equal(decoded.TimeRange.From), "record %d: from differs", i)
+		assert.True(t, record.TimeRange.To.Equal(decoded.TimeRange.To), "record %d: to differs", i)
+		decoded.TimeRange = record.TimeRange
+		assert.Equal(t, record, decoded, "record %d", i)
+	}
+}
+
+func TestFileSink_RoundTrip(t *testing.T) {
+	path := t.TempDir() + "/records.jsonl"
+	from := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	records := []OdooMeteredBillingRecord{
+		{ProductID: "p1", InstanceID: "i1", SalesOrder: "S1", UnitID: "u", ConsumedUnits: 1.5, TimeRange: TimeRange{From: from, To: from.AddDate(0, 0, 1)}},
+		{ProductID: "p2", InstanceID: "i2", SalesOrder: "S1", UnitID: "u", ConsumedUnits: 3, TimeRange: TimeRange{From: from, To: from.Add(time.Hour)}},
+	}
+
+	sink := NewFileSink(path)
+	_, err := sink.SendData(context.Background(), records[:1])
+	require.NoError(t, err)
+	_, err = sink.SendData(context.Background(), records[1:])
+	require.NoError(t, err)
+
+	file, err := os.Open(path)
+	require.NoError(t, err)
+	defer file.Close()
+	read, err := ReadRecords(file)
+	require.NoError(t, err)
+	assert.Equal(t, records, read)
+}
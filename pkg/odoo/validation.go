@@ -0,0 +1,189 @@
+package odoo
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var quarantinedRecords = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "billing_cloud_collector_records_quarantined_total",
+	Help: "Total number of billing records which were not sent because they violate a validation rule, by rule",
+}, []string{"rule"})
+
+// Rule checks a single property of a record.
+type Rule struct {
+	Name string
+	// Check returns the reason why the record violates the rule, or an empty string if it does not.
+	Check func(OdooMeteredBillingRecord) string
+}
+
+// DefaultRules are the rules every record must satisfy before it is sent to Odoo.
+var DefaultRules = []Rule{
+	{Name: "product-id", Check: func(r OdooMeteredBillingRecord) string {
+		return requireNonEmpty("product ID", r.ProductID)
+	}},
+	{Name: "instance-id", Check: func(r OdooMeteredBillingRecord) string {
+		return requireNonEmpty("instance ID", r.InstanceID)
+	}},
+	{Name: "sales-order", Check: func(r OdooMeteredBillingRecord) string {
+		return requireNonEmpty("sales order", r.SalesOrder)
+	}},
+	{Name: "unit-id", Check: func(r OdooMeteredBillingRecord) string {
+		return requireNonEmpty("unit ID", r.UnitID)
+	}},
+	{Name: "consumed-units", Check: func(r OdooMeteredBillingRecord) string {
+		switch {
+		case math.IsNaN(r.ConsumedUnits):
+			return "consumed units is NaN"
+		case math.IsInf(r.ConsumedUnits, 0):
+			return "consumed units is infinite"
+		case r.ConsumedUnits < 0:
+			return fmt.Sprintf("consumed units is negative (%g)", r.ConsumedUnits)
+		}
+		return ""
+	}},
+	{Name: "time-range", Check: func(r OdooMeteredBillingRecord) string {
+		switch {
+		case r.TimeRange.From.IsZero() || r.TimeRange.To.IsZero():
+			return "time range is not set"
+		case !r.TimeRange.From.Before(r.TimeRange.To):
+			return fmt.Sprintf("time range starts at %s, which is not before its end %s", r.TimeRange.From.Format(time.RFC3339), r.TimeRange.To.Format(time.RFC3339))
+		}
+		return ""
+	}},
+}
+
+func requireNonEmpty(field, value string) string {
+	if value == "" {
+		return field + " is empty"
+	}
+	return ""
+}
+
+// Violation is a rule a record violates, with the reason why.
+type Violation struct {
+	Rule   string `json:"rule"`
+	Reason string `json:"reason"`
+}
+
+// QuarantinedRecord is a record which was not sent because it violates at least one rule.
+type QuarantinedRecord struct {
+	Record     OdooMeteredBillingRecord `json:"record"`
+	Violations []Violation              `json:"violations"`
+}
+
+// Validate checks every record against the rules and splits them into valid and quarantined records.
+func Validate(records []OdooMeteredBillingRecord, rules []Rule) (valid []OdooMeteredBillingRecord, quarantined []QuarantinedRecord) {
+	for _, r := range records {
+		var violations []Violation
+		for _, rule := range rules {
+			if reason := rule.Check(r); reason != "" {
+				violations = append(violations, Violation{Rule: rule.Name, Reason: reason})
+			}
+		}
+		if len(violations) > 0 {
+			quarantined = append(quarantined, QuarantinedRecord{Record: r, Violations: violations})
+			continue
+		}
+		valid = append(valid, r)
+	}
+	return valid, quarantined
+}
+
+// Quarantine appends quarantined records as lines of JSON to a file, so they can be inspected and corrected.
+type Quarantine struct {
+	mu   sync.Mutex
+	path string
+}
+
+// NewQuarantine creates a Quarantine writing to the file at path. The file is created on the first write if it does not exist.
+func NewQuarantine(path string) *Quarantine {
+	return &Quarantine{path: path}
+}
+
+// Add appends the records to the quarantine file.
+func (q *Quarantine) Add(records []QuarantinedRecord) error {
+	if q == nil || len(records) == 0 {
+		return nil
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	file, err := os.OpenFile(q.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return fmt.Errorf("cannot open quarantine file %s: %w", q.path, err)
+	}
+	defer file.Close()
+
+	enc := json.NewEncoder(file)
+	now := time.Now().UTC()
+	for _, r := range records {
+		entry := struct {
+			QuarantinedAt time.Time `json:"quarantined_at"`
+			QuarantinedRecord
+		}{QuarantinedAt: now, QuarantinedRecord: r}
+		if err := enc.Encode(entry); err != nil {
+			return fmt.Errorf("cannot write quarantine file %s: %w", q.path, err)
+		}
+	}
+	return file.Sync()
+}
+
+// ValidatingSink validates every record before passing it on to the wrapped Sink.
+// Records which violate a rule are logged with their reasons, counted, added to the quarantine and never sent.
+type ValidatingSink struct {
+	sink       Sink
+	rules      []Rule
+	quarantine *Quarantine
+	logger     logr.Logger
+}
+
+// NewValidatingSink wraps sink with validation against the rules, or the DefaultRules if none are given.
+// The quarantine may be nil, in which case invalid records are only logged.
+func NewValidatingSink(sink Sink, quarantine *Quarantine, logger logr.Logger, rules ...Rule) *ValidatingSink {
+	if len(rules) == 0 {
+		rules = DefaultRules
+	}
+	return &ValidatingSink{sink: sink, rules: rules, quarantine: quarantine, logger: logger}
+}
+
+// FlushOutbox flushes the wrapped sink if it is a Flusher.
+func (s *ValidatingSink) FlushOutbox(ctx context.Context) error {
+	if f, ok := s.sink.(Flusher); ok {
+		return f.FlushOutbox(ctx)
+	}
+	return nil
+}
+
+func (s *ValidatingSink) SendData(ctx context.Context, records []OdooMeteredBillingRecord) (*SendResult, error) {
+	valid, quarantined := Validate(records, s.rules)
+	for _, q := range quarantined {
+		for _, v := range q.Violations {
+			quarantinedRecords.WithLabelValues(v.Rule).Inc()
+		}
+		s.logger.Info("Quarantining invalid record", "instance", q.Record.InstanceID, "product", q.Record.ProductID, "salesOrder", q.Record.SalesOrder, "violations", q.Violations)
+	}
+	if err := s.quarantine.Add(quarantined); err != nil {
+		s.logger.Error(err, "cannot persist quarantined records")
+	}
+
+	result := &SendResult{}
+	var err error
+	if len(valid) > 0 {
+		result, err = s.sink.SendData(ctx, valid)
+		if result == nil {
+			result = &SendResult{}
+		}
+	}
+	result.Quarantined = quarantined
+	return result, err
+}
@@ -0,0 +1,128 @@
+package odoo
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidate(t *testing.T) {
+	from := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	valid := OdooMeteredBillingRecord{
+		ProductID:     "appcat-exoscale-pg",
+		InstanceID:    "db",
+		SalesOrder:    "SO123",
+		UnitID:        "uom_uom_68_b1811ca1",
+		ConsumedUnits: 1,
+		TimeRange:     TimeRange{From: from, To: from.Add(time.Hour)},
+	}
+
+	tests := map[string]struct {
+		modify        func(r *OdooMeteredBillingRecord)
+		expectedRules []string
+	}{
+		"given a valid record, we should not find violations": {
+			modify: func(r *OdooMeteredBillingRecord) {},
+		},
+		"given zero consumed units, we should not find violations": {
+			modify: func(r *OdooMeteredBillingRecord) { r.ConsumedUnits = 0 },
+		},
+		"given an empty unit ID, we should report it": {
+			modify:        func(r *OdooMeteredBillingRecord) { r.UnitID = "" },
+			expectedRules: []string{"unit-id"},
+		},
+		"given an empty sales order, we should report it": {
+			modify:        func(r *OdooMeteredBillingRecord) { r.SalesOrder = "" },
+			expectedRules: []string{"sales-order"},
+		},
+		"given negative consumed units, we should report them": {
+			modify:        func(r *OdooMeteredBillingRecord) { r.ConsumedUnits = -1 },
+			expectedRules: []string{"consumed-units"},
+		},
+		"given NaN consumed units, we should report them": {
+			modify:        func(r *OdooMeteredBillingRecord) { r.ConsumedUnits = math.NaN() },
+			expectedRules: []string{"consumed-units"},
+		},
+		"given an empty time range, we should report it": {
+			modify:        func(r *OdooMeteredBillingRecord) { r.TimeRange.To = r.TimeRange.From },
+			expectedRules: []string{"time-range"},
+		},
+		"given a time range ending before its start, we should report it": {
+			modify:        func(r *OdooMeteredBillingRecord) { r.TimeRange.From, r.TimeRange.To = r.TimeRange.To, r.TimeRange.From },
+			expectedRules: []string{"time-range"},
+		},
+		"given several problems, we should report all of them": {
+			modify: func(r *OdooMeteredBillingRecord) {
+				r.UnitID = ""
+				r.SalesOrder = ""
+				r.TimeRange = TimeRange{}
+			},
+			expectedRules: []string{"sales-order", "unit-id", "time-range"},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			record := valid
+			tc.modify(&record)
+
+			ok, quarantined := Validate([]OdooMeteredBillingRecord{record}, DefaultRules)
+			if len(tc.expectedRules) == 0 {
+				assert.Len(t, ok, 1)
+				assert.Empty(t, quarantined)
+				return
+			}
+			assert.Empty(t, ok)
+			require.Len(t, quarantined, 1)
+			var rules []string
+			for _, v := range quarantined[0].Violations {
+				rules = append(rules, v.Rule)
+				assert.NotEmpty(t, v.Reason)
+			}
+			assert.Equal(t, tc.expectedRules, rules)
+		})
+	}
+}
+
+func TestValidatingSink_SendData(t *testing.T) {
+	path := t.TempDir() + "/quarantine.jsonl"
+	from := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	good := OdooMeteredBillingRecord{ProductID: "p", InstanceID: "good", SalesOrder: "S1", UnitID: "u", ConsumedUnits: 1, TimeRange: TimeRange{From: from, To: from.Add(time.Hour)}}
+	bad := good
+	bad.InstanceID = "bad"
+	bad.UnitID = ""
+
+	next := &recordingSink{}
+	sink := NewValidatingSink(next, NewQuarantine(path), logr.Discard())
+	result, err := sink.SendData(context.Background(), []OdooMeteredBillingRecord{good, bad})
+	require.NoError(t, err)
+
+	assert.Equal(t, []OdooMeteredBillingRecord{good}, next.records, "invalid records must never be sent")
+	require.Len(t, result.Quarantined, 1)
+	assert.Equal(t, bad, result.Quarantined[0].Record)
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	require.Len(t, lines, 1)
+	var entry QuarantinedRecord
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &entry))
+	assert.Equal(t, result.Quarantined[0], entry)
+}
+
+type recordingSink struct {
+	records []OdooMeteredBillingRecord
+}
+
+func (s *recordingSink) SendData(_ context.Context, records []OdooMeteredBillingRecord) (*SendResult, error) {
+	s.records = append(s.records, records...)
+	return &SendResult{Chunks: []ChunkResult{{Records: records}}}, nil
+}
@@ -0,0 +1,164 @@
+// Package salesorder resolves the sales order a namespace is billed to. Rules can bill namespaces, selected by name, glob or labels,
+// or organizations to a specific sales order or not at all. Without a matching rule, the sales order of the cluster is used if set,
+// else the one the APPUiO Cloud Control API knows for the organization.
+package salesorder
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+
+	"github.com/vshn/billing-collector-cloudservices/pkg/controlAPI"
+	"github.com/vshn/billing-collector-cloudservices/pkg/kubernetes"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/yaml"
+)
+
+// Rule bills the namespaces it matches to SalesOrder, or not at all if Billable is false.
+// A rule matches if all of its Namespace, NamespaceLabels and Organization match.
+type Rule struct {
+	// Namespace is the name of the namespace or a glob like "vshn-*".
+	Namespace string `json:"namespace,omitempty"`
+	// NamespaceLabels must all be set on the namespace with the given values.
+	NamespaceLabels map[string]string `json:"namespaceLabels,omitempty"`
+	// Organization is the organization the namespace belongs to.
+	Organization string `json:"organization,omitempty"`
+
+	SalesOrder string `json:"salesOrder,omitempty"`
+	Billable   *bool  `json:"billable,omitempty"`
+}
+
+type document struct {
+	Rules []Rule `json:"rules"`
+}
+
+// Load reads the rules from the YAML or JSON file at the path, none if the path is empty.
+func Load(path string) ([]Rule, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read sales order rules: %w", err)
+	}
+	rules, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("sales order rules %s: %w", path, err)
+	}
+	return rules, nil
+}
+
+// Parse parses rules from YAML or JSON. Every rule must match on something,
+// and either give a sales order or mark the namespaces as not billable.
+func Parse(data []byte) ([]Rule, error) {
+	doc := document{}
+	if err := yaml.UnmarshalStrict(data, &doc); err != nil {
+		return nil, err
+	}
+	for i, r := range doc.Rules {
+		if r.Namespace == "" && len(r.NamespaceLabels) == 0 && r.Organization == "" {
+			return nil, fmt.Errorf("rules[%d]: one of namespace, namespaceLabels or organization is required", i)
+		}
+		if _, err := path.Match(r.Namespace, ""); err != nil {
+			return nil, fmt.Errorf("rules[%d]: namespace %q: %w", i, r.Namespace, err)
+		}
+		billable := r.Billable == nil || *r.Billable
+		if billable == (r.SalesOrder == "") {
+			return nil, fmt.Errorf("rules[%d]: exactly one of salesOrder or billable: false is required", i)
+		}
+	}
+	return doc.Rules, nil
+}
+
+func (r Rule) matches(namespace string, labels map[string]string, organization string) bool {
+	if r.Namespace != "" {
+		if ok, _ := path.Match(r.Namespace, namespace); !ok {
+			return false
+		}
+	}
+	for k, v := range r.NamespaceLabels {
+		if value, ok := labels[k]; !ok || value != v {
+			return false
+		}
+	}
+	return r.Organization == "" || r.Organization == organization
+}
+
+// Resolver resolves the sales orders of namespaces with the rules, in order, falling back to the sales order of the cluster
+// or the Control API.
+type Resolver struct {
+	rules            []Rule
+	salesOrder       string
+	k8sClient        client.Client
+	controlApiClient client.Client
+}
+
+// NewResolver returns a resolver for the rules. The salesOrder is the one of APPUiO Managed clusters, empty for APPUiO Cloud.
+// The k8sClient is only used to list the namespace labels if a rule matches labels.
+func NewResolver(rules []Rule, salesOrder string, k8sClient client.Client, controlApiClient client.Client) *Resolver {
+	return &Resolver{
+		rules:            rules,
+		salesOrder:       salesOrder,
+		k8sClient:        k8sClient,
+		controlApiClient: controlApiClient,
+	}
+}
+
+// Managed reports whether the cluster is billed to one sales order, i.e. is an APPUiO Managed cluster.
+func (r *Resolver) Managed() bool {
+	return r.salesOrder != ""
+}
+
+// NeedsOrganizations reports whether resolving needs the organizations of the namespaces.
+func (r *Resolver) NeedsOrganizations() bool {
+	if !r.Managed() {
+		return true
+	}
+	for _, rule := range r.rules {
+		if rule.Organization != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// Lookup resolves the sales orders of one collection run.
+type Lookup struct {
+	*Resolver
+	labels map[string]map[string]string
+}
+
+// Lookup prepares resolving the sales orders of one collection run. If a rule matches labels, the namespace labels are listed once here.
+func (r *Resolver) Lookup(ctx context.Context) (*Lookup, error) {
+	l := &Lookup{Resolver: r}
+	for _, rule := range r.rules {
+		if len(rule.NamespaceLabels) == 0 {
+			continue
+		}
+		labels, err := kubernetes.FetchNamespaceLabels(ctx, r.k8sClient)
+		if err != nil {
+			return nil, err
+		}
+		l.labels = labels
+		break
+	}
+	return l, nil
+}
+
+// SalesOrder returns the sales order to bill the namespace to, or false if the namespace must not be billed.
+func (l *Lookup) SalesOrder(ctx context.Context, namespace, organization string) (string, bool, error) {
+	for _, rule := range l.rules {
+		if rule.matches(namespace, l.labels[namespace], organization) {
+			return rule.SalesOrder, rule.SalesOrder != "", nil
+		}
+	}
+	if l.salesOrder != "" {
+		return l.salesOrder, true, nil
+	}
+	salesOrder, err := controlAPI.GetSalesOrder(ctx, l.controlApiClient, organization)
+	if err != nil {
+		return "", false, err
+	}
+	return salesOrder, true, nil
+}
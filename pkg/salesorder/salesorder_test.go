@@ -0,0 +1,136 @@
+package salesorder
+
+import (
+	"context"
+	"testing"
+
+	orgv1 "github.com/appuio/control-api/apis/organization/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestParse(t *testing.T) {
+	tests := map[string]struct {
+		rules         string
+		expectedError string
+	}{
+		"given rules for namespaces, labels and organizations, we should get them": {
+			rules: `
+rules:
+  - namespace: vshn-*
+    salesOrder: S10000
+  - namespaceLabels:
+      billing.vshn.ch/trial: "true"
+    billable: false
+  - organization: acme
+    salesOrder: S12345
+`,
+		},
+		"given a rule without match, we should get an error": {
+			rules:         `{"rules": [{"salesOrder": "S10000"}]}`,
+			expectedError: "rules[0]: one of namespace, namespaceLabels or organization is required",
+		},
+		"given a rule with a bad glob, we should get an error": {
+			rules:         `{"rules": [{"namespace": "vshn-[", "salesOrder": "S10000"}]}`,
+			expectedError: `rules[0]: namespace "vshn-[": syntax error in pattern`,
+		},
+		"given a rule with a sales order which is not billable, we should get an error": {
+			rules:         `{"rules": [{"namespace": "vshn", "salesOrder": "S10000", "billable": false}]}`,
+			expectedError: "rules[0]: exactly one of salesOrder or billable: false is required",
+		},
+		"given a rule without sales order, we should get an error": {
+			rules:         `{"rules": [{"namespace": "vshn", "billable": true}]}`,
+			expectedError: "rules[0]: exactly one of salesOrder or billable: false is required",
+		},
+		"given an unknown field, we should get an error": {
+			rules:         `{"rules": [{"namespaces": "vshn", "salesOrder": "S10000"}]}`,
+			expectedError: `error unmarshaling JSON: while decoding JSON: json: unknown field "namespaces"`,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := Parse([]byte(tc.rules))
+			if tc.expectedError != "" {
+				assert.EqualError(t, err, tc.expectedError)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestLookup_SalesOrder(t *testing.T) {
+	scheme := runtime.NewScheme()
+	require.NoError(t, corev1.AddToScheme(scheme))
+	require.NoError(t, orgv1.AddToScheme(scheme))
+	k8sClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "trial", Labels: map[string]string{"billing.vshn.ch/trial": "true"}}},
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "customer"}},
+	).Build()
+	controlApiClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(
+		&orgv1.Organization{ObjectMeta: metav1.ObjectMeta{Name: "acme"}, Status: orgv1.OrganizationStatus{SalesOrderName: "S20000"}},
+	).Build()
+
+	rules, err := Parse([]byte(`
+rules:
+  - namespace: vshn-*
+    salesOrder: S10000
+  - namespaceLabels:
+      billing.vshn.ch/trial: "true"
+    billable: false
+  - namespace: split
+    organization: acme
+    salesOrder: S12345
+`))
+	require.NoError(t, err)
+
+	tests := map[string]struct {
+		salesOrder    string
+		namespace     string
+		organization  string
+		expected      string
+		notBillable   bool
+		expectedError string
+	}{
+		"given a namespace matching a glob, we should get the sales order of the rule": {
+			namespace: "vshn-monitoring", organization: "vshn", expected: "S10000",
+		},
+		"given a namespace with the labels of a rule, we should not bill it": {
+			namespace: "trial", organization: "acme", notBillable: true,
+		},
+		"given a namespace matching namespace and organization, we should get the sales order of the rule": {
+			namespace: "split", organization: "acme", expected: "S12345",
+		},
+		"given a namespace matching no rule, we should get the sales order of the organization": {
+			namespace: "customer", organization: "acme", expected: "S20000",
+		},
+		"given a namespace matching no rule on a managed cluster, we should get the sales order of the cluster": {
+			salesOrder: "S30000", namespace: "customer", organization: "acme", expected: "S30000",
+		},
+		"given a managed cluster, rules should still take precedence": {
+			salesOrder: "S30000", namespace: "trial", organization: "acme", notBillable: true,
+		},
+		"given an unknown organization, we should get an error": {
+			namespace: "customer", organization: "unknown", expectedError: "cannot get Organization object 'unknown'",
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			lookup, err := NewResolver(rules, tc.salesOrder, k8sClient, controlApiClient).Lookup(context.Background())
+			require.NoError(t, err)
+
+			salesOrder, billable, err := lookup.SalesOrder(context.Background(), tc.namespace, tc.organization)
+			if tc.expectedError != "" {
+				assert.ErrorContains(t, err, tc.expectedError)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, salesOrder)
+			assert.Equal(t, !tc.notBillable, billable)
+		})
+	}
+}
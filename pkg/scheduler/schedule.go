@@ -0,0 +1,79 @@
+package scheduler
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+// Schedule tells when a job runs next.
+type Schedule interface {
+	// Next returns the first activation strictly after t.
+	Next(t time.Time) time.Time
+}
+
+// Parse parses a schedule in the given time zone. Supported are
+//
+//   - cron expressions with five fields or descriptors like "@daily", e.g. "0 6 * * *"
+//   - "every <duration>" and "every <duration> after HH:MM", e.g. "every 6h after 06:00" or "every 15m"
+//
+// The latter runs at HH:MM (midnight if omitted) and then every duration until the end of the day,
+// so "every 6h after 06:00" runs at 06:00, 12:00 and 18:00, and "every 23h after 06:00" once a day at 06:00.
+func Parse(spec string, loc *time.Location) (Schedule, error) {
+	spec = strings.TrimSpace(spec)
+	if rest, ok := strings.CutPrefix(spec, "every "); ok {
+		return parseEvery(rest, loc)
+	}
+
+	sched, err := cron.ParseStandard(spec)
+	if err != nil {
+		return nil, fmt.Errorf("invalid schedule %q: %w", spec, err)
+	}
+	if s, ok := sched.(*cron.SpecSchedule); ok && !strings.HasPrefix(spec, "CRON_TZ=") && !strings.HasPrefix(spec, "TZ=") {
+		s.Location = loc
+	}
+	return sched, nil
+}
+
+func parseEvery(spec string, loc *time.Location) (Schedule, error) {
+	durationSpec, after, hasAfter := strings.Cut(spec, " after ")
+	interval, err := time.ParseDuration(strings.TrimSpace(durationSpec))
+	if err != nil {
+		return nil, fmt.Errorf("invalid schedule %q: %w", "every "+spec, err)
+	}
+	if interval < time.Minute {
+		return nil, fmt.Errorf("invalid schedule %q: interval must be at least one minute", "every "+spec)
+	}
+
+	var start time.Duration
+	if hasAfter {
+		t, err := time.Parse("15:04", strings.TrimSpace(after))
+		if err != nil {
+			return nil, fmt.Errorf("invalid schedule %q: expected time of day as HH:MM", "every "+spec)
+		}
+		start = time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	}
+	return EveryAfter{Interval: interval, Start: start, Location: loc}, nil
+}
+
+// EveryAfter runs at Start after midnight and then every Interval until the end of the day, in Location.
+type EveryAfter struct {
+	Interval time.Duration
+	Start    time.Duration
+	Location *time.Location
+}
+
+func (e EveryAfter) Next(t time.Time) time.Time {
+	t = t.In(e.Location)
+	for day := t.Day(); ; day++ {
+		// wall clock times, so that 06:00 stays 06:00 on days with a DST switch
+		for offset := e.Start; offset < 24*time.Hour; offset += e.Interval {
+			next := time.Date(t.Year(), t.Month(), day, int(offset/time.Hour), int(offset%time.Hour/time.Minute), int(offset%time.Minute/time.Second), 0, e.Location)
+			if next.After(t) {
+				return next
+			}
+		}
+	}
+}
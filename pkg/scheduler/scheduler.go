@@ -0,0 +1,216 @@
+// Package scheduler runs the collectors' jobs on cron-like schedules.
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	lastRun = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "billing_cloud_collector_job_last_run_timestamp_seconds",
+		Help: "Time the job last started, in seconds since the epoch",
+	}, []string{"job"})
+	nextRun = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "billing_cloud_collector_job_next_run_timestamp_seconds",
+		Help: "Time the job runs next, in seconds since the epoch",
+	}, []string{"job"})
+	failedRuns = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "billing_cloud_collector_job_failures_total",
+		Help: "Total number of job runs which failed, by job",
+	}, []string{"job"})
+)
+
+// JobFunc does the work of a job.
+// An error marked with Fatal stops the scheduler, any other error is logged and the job runs again at its next activation.
+type JobFunc func(ctx context.Context) error
+
+type fatalError struct {
+	err error
+}
+
+func (e *fatalError) Error() string { return e.err.Error() }
+func (e *fatalError) Unwrap() error { return e.err }
+
+// Fatal marks an error which stops the scheduler, e.g. because retrying cannot help.
+func Fatal(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &fatalError{err: err}
+}
+
+// IsFatal reports whether the error was marked with Fatal.
+func IsFatal(err error) bool {
+	var fatal *fatalError
+	return errors.As(err, &fatal)
+}
+
+// Status tells when a job ran last and when it runs next. LastRun is zero if the job has not run yet.
+type Status struct {
+	Name     string
+	Schedule Schedule
+	LastRun  time.Time
+	NextRun  time.Time
+}
+
+type job struct {
+	schedule Schedule
+	run      JobFunc
+	lastRun  time.Time
+	nextRun  time.Time
+}
+
+// Scheduler runs registered jobs on their schedules. A job never runs concurrently with itself;
+// activations missed while it was still running are skipped.
+type Scheduler struct {
+	logger      logr.Logger
+	now         func() time.Time
+	gracePeriod time.Duration
+
+	mu   sync.Mutex
+	jobs map[string]*job
+}
+
+// Option configures a Scheduler.
+type Option func(*Scheduler)
+
+// WithGracePeriod lets running jobs finish for up to the given time once the scheduler is stopped,
+// before their context is cancelled as well. Without a grace period, running jobs are cancelled right away.
+func WithGracePeriod(gracePeriod time.Duration) Option {
+	return func(s *Scheduler) {
+		s.gracePeriod = gracePeriod
+	}
+}
+
+// New creates an empty Scheduler.
+func New(logger logr.Logger, opts ...Option) *Scheduler {
+	s := &Scheduler{logger: logger, now: time.Now, jobs: map[string]*job{}}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// Register adds a job under a unique name.
+func (s *Scheduler) Register(name string, schedule Schedule, run JobFunc) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.jobs[name]; ok {
+		return fmt.Errorf("job %s is already registered", name)
+	}
+	s.jobs[name] = &job{schedule: schedule, run: run, nextRun: schedule.Next(s.now())}
+	return nil
+}
+
+// Status returns the last and next run times of all jobs, sorted by name.
+func (s *Scheduler) Status() []Status {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status := make([]Status, 0, len(s.jobs))
+	for name, j := range s.jobs {
+		status = append(status, Status{Name: name, Schedule: j.schedule, LastRun: j.lastRun, NextRun: j.nextRun})
+	}
+	sort.Slice(status, func(i, j int) bool { return status[i].Name < status[j].Name })
+	return status
+}
+
+// Run runs the jobs until the context is cancelled or a job fails fatally.
+// Once stopped, it waits for running jobs, which get the grace period to finish before their context is cancelled.
+// It returns the first fatal error, or nil once the context is cancelled.
+func (s *Scheduler) Run(ctx context.Context) error {
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	// jobs get a context of their own, so that they can finish in-flight work after the scheduler was stopped
+	jobCtx, cancelJobs := context.WithCancel(context.WithoutCancel(ctx))
+	defer cancelJobs()
+	go func() {
+		select {
+		case <-jobCtx.Done():
+			return
+		case <-ctx.Done():
+		}
+		if s.gracePeriod > 0 {
+			timer := time.NewTimer(s.gracePeriod)
+			defer timer.Stop()
+			select {
+			case <-jobCtx.Done():
+			case <-timer.C:
+				s.logger.Info("Grace period is over, cancelling running jobs", "gracePeriod", s.gracePeriod)
+			}
+		}
+		cancelJobs()
+	}()
+
+	s.mu.Lock()
+	names := make([]string, 0, len(s.jobs))
+	for name := range s.jobs {
+		names = append(names, name)
+	}
+	s.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, name := range names {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			if err := s.loop(ctx, jobCtx, name); err != nil {
+				cancel(fmt.Errorf("job %s: %w", name, err))
+			}
+		}(name)
+	}
+	wg.Wait()
+
+	if err := context.Cause(ctx); err != nil && !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded) {
+		return err
+	}
+	return nil
+}
+
+func (s *Scheduler) loop(ctx, jobCtx context.Context, name string) error {
+	for {
+		s.mu.Lock()
+		j := s.jobs[name]
+		next := j.schedule.Next(s.now())
+		j.nextRun = next
+		s.mu.Unlock()
+		nextRun.WithLabelValues(name).Set(float64(next.Unix()))
+		s.logger.Info("Scheduled job", "job", name, "nextRun", next)
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil
+		case <-timer.C:
+		}
+
+		started := s.now()
+		s.mu.Lock()
+		j.lastRun = started
+		s.mu.Unlock()
+		lastRun.WithLabelValues(name).Set(float64(started.Unix()))
+
+		s.logger.Info("Running job", "job", name)
+		if err := j.run(jobCtx); err != nil {
+			failedRuns.WithLabelValues(name).Inc()
+			if IsFatal(err) {
+				return err
+			}
+			s.logger.Error(err, "Job failed, will run again at the next activation", "job", name)
+		}
+		if ctx.Err() != nil {
+			s.logger.Info("Scheduler stopped, job is done", "job", name)
+			return nil
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	zurich, err := time.LoadLocation("Europe/Zurich")
+	require.NoError(t, err)
+
+	tests := map[string]struct {
+		spec      string
+		now       time.Time
+		expected  []time.Time
+		expectErr bool
+	}{
+		"given every 6h after 06:00 before 06:00, we should run at 06:00, 12:00 and 18:00": {
+			spec:     "every 6h after 06:00",
+			now:      time.Date(2024, 3, 1, 5, 0, 0, 0, zurich),
+			expected: []time.Time{time.Date(2024, 3, 1, 6, 0, 0, 0, zurich), time.Date(2024, 3, 1, 12, 0, 0, 0, zurich), time.Date(2024, 3, 1, 18, 0, 0, 0, zurich), time.Date(2024, 3, 2, 6, 0, 0, 0, zurich)},
+		},
+		"given every 23h after 06:00, we should run once a day": {
+			spec:     "every 23h after 06:00",
+			now:      time.Date(2024, 3, 1, 6, 0, 0, 0, zurich),
+			expected: []time.Time{time.Date(2024, 3, 2, 6, 0, 0, 0, zurich), time.Date(2024, 3, 3, 6, 0, 0, 0, zurich)},
+		},
+		"given every 15m, we should run at quarter hours": {
+			spec:     "every 15m",
+			now:      time.Date(2024, 3, 1, 23, 40, 0, 0, zurich),
+			expected: []time.Time{time.Date(2024, 3, 1, 23, 45, 0, 0, zurich), time.Date(2024, 3, 2, 0, 0, 0, 0, zurich)},
+		},
+		"given the spring DST switch, we should keep the wall clock time": {
+			spec:     "every 24h after 06:00",
+			now:      time.Date(2024, 3, 30, 7, 0, 0, 0, zurich),
+			expected: []time.Time{time.Date(2024, 3, 31, 6, 0, 0, 0, zurich), time.Date(2024, 4, 1, 6, 0, 0, 0, zurich)},
+		},
+		"given a cron expression, we should evaluate it in the time zone": {
+			spec:     "30 6 * * *",
+			now:      time.Date(2024, 3, 1, 5, 0, 0, 0, time.UTC),
+			expected: []time.Time{time.Date(2024, 3, 1, 6, 30, 0, 0, zurich), time.Date(2024, 3, 2, 6, 30, 0, 0, zurich)},
+		},
+		"given a descriptor, we should evaluate it in the time zone": {
+			spec:     "@daily",
+			now:      time.Date(2024, 3, 1, 12, 0, 0, 0, zurich),
+			expected: []time.Time{time.Date(2024, 3, 2, 0, 0, 0, 0, zurich)},
+		},
+		"given an invalid time of day, we should fail": {
+			spec:      "every 1h after 25:00",
+			expectErr: true,
+		},
+		"given a too short interval, we should fail": {
+			spec:      "every 1s",
+			expectErr: true,
+		},
+		"given an invalid cron expression, we should fail": {
+			spec:      "61 * * * *",
+			expectErr: true,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			sched, err := Parse(tc.spec, zurich)
+			if tc.expectErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			now := tc.now
+			for _, expected := range tc.expected {
+				now = sched.Next(now)
+				assert.True(t, expected.Equal(now), "expected %s, got %s", expected, now)
+			}
+		})
+	}
+}
+
+// every is a schedule for tests which runs at fixed short intervals.
+type every time.Duration
+
+func (e every) Next(t time.Time) time.Time {
+	return t.Add(time.Duration(e))
+}
+
+func TestScheduler_Run(t *testing.T) {
+	s := New(logr.Discard())
+	runs := make(chan struct{}, 10)
+	require.NoError(t, s.Register("job", every(time.Millisecond), func(ctx context.Context) error {
+		runs <- struct{}{}
+		return nil
+	}))
+	assert.Error(t, s.Register("job", every(time.Millisecond), nil), "names must be unique")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- s.Run(ctx) }()
+	<-runs
+	<-runs
+	cancel()
+	assert.NoError(t, <-done)
+
+	status := s.Status()
+	require.Len(t, status, 1)
+	assert.Equal(t, "job", status[0].Name)
+	assert.False(t, status[0].LastRun.IsZero())
+	assert.True(t, status[0].NextRun.After(status[0].LastRun))
+}
+
+func TestScheduler_Run_JobError(t *testing.T) {
+	s := New(logr.Discard())
+	errFatal := errors.New("fatal")
+	runs := 0
+	require.NoError(t, s.Register("failing", every(time.Millisecond), func(ctx context.Context) error {
+		runs++
+		if runs < 3 {
+			return errors.New("transient")
+		}
+		return Fatal(errFatal)
+	}))
+	require.NoError(t, s.Register("waiting", every(time.Hour), func(ctx context.Context) error {
+		return nil
+	}))
+
+	err := s.Run(context.Background())
+	assert.ErrorIs(t, err, errFatal, "a fatal error should stop the scheduler")
+	assert.True(t, IsFatal(err))
+	assert.Equal(t, 3, runs, "transient errors should not stop the scheduler")
+}
+
+func TestScheduler_Run_GracePeriod(t *testing.T) {
+	tests := map[string]struct {
+		gracePeriod    time.Duration
+		jobDuration    time.Duration
+		expectFinished bool
+	}{
+		"given a job finishing within the grace period, we should let it finish": {
+			gracePeriod:    time.Second,
+			jobDuration:    20 * time.Millisecond,
+			expectFinished: true,
+		},
+		"given a job exceeding the grace period, we should cancel it": {
+			gracePeriod: 20 * time.Millisecond,
+			jobDuration: time.Minute,
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			s := New(logr.Discard(), WithGracePeriod(tc.gracePeriod))
+			started := make(chan struct{})
+			finished := false
+			require.NoError(t, s.Register("job", every(time.Millisecond), func(ctx context.Context) error {
+				close(started)
+				select {
+				case <-time.After(tc.jobDuration):
+					finished = true
+				case <-ctx.Done():
+				}
+				return nil
+			}))
+
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan error)
+			go func() { done <- s.Run(ctx) }()
+			<-started
+			cancel()
+			assert.NoError(t, <-done)
+			assert.Equal(t, tc.expectFinished, finished)
+		})
+	}
+}
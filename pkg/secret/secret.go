@@ -0,0 +1,163 @@
+// Package secret provides credentials given directly or read from files, e.g. mounted Secret volumes or files written by the Vault agent.
+// A file is re-read when it changes, and the clients built from its secret are rebuilt, so that rotated credentials need no restart.
+package secret
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var reloads = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "billing_cloud_collector_secret_reloads_total",
+	Help: "Total number of reloads of secret files after they changed, by secret and result (success or failure)",
+}, []string{"secret", "result"})
+
+// Secret is a credential. It is safe for concurrent use.
+type Secret struct {
+	name    string
+	path    string
+	current atomic.Pointer[string]
+
+	mu       sync.Mutex
+	onChange []func()
+}
+
+// Value returns a secret which never changes, e.g. one given with a flag. The name identifies the secret in logs and metrics.
+func Value(name, value string) *Secret {
+	s := &Secret{name: name}
+	s.current.Store(&value)
+	return s
+}
+
+// FromFile reads the secret from the file at the path. Leading and trailing white space, like the final newline, is ignored.
+func FromFile(name, path string) (*Secret, error) {
+	s := &Secret{name: name, path: path}
+	value, err := s.read()
+	if err != nil {
+		return nil, err
+	}
+	s.current.Store(&value)
+	return s, nil
+}
+
+// Get returns the current value of the secret.
+func (s *Secret) Get() string {
+	return *s.current.Load()
+}
+
+// OnChange registers a function which is called after the secret changed.
+func (s *Secret) OnChange(f func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onChange = append(s.onChange, f)
+}
+
+// Watch re-reads the file of the secret every interval until the context is done, and calls the functions registered with OnChange if it changed.
+// An unreadable or empty file is logged and the previous value is kept. Secrets which aren't read from a file return immediately.
+func (s *Secret) Watch(ctx context.Context, logger logr.Logger, interval time.Duration) {
+	if s.path == "" {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var failed bool
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		value, err := s.read()
+		if err != nil {
+			if !failed {
+				// log once until the file can be read again, e.g. while it is being replaced
+				logger.Error(err, "Cannot reload secret, keeping the previous value", "secret", s.name)
+			}
+			failed = true
+			reloads.WithLabelValues(s.name, "failure").Inc()
+			continue
+		}
+		failed = false
+		if value == s.Get() {
+			continue
+		}
+		s.current.Store(&value)
+		reloads.WithLabelValues(s.name, "success").Inc()
+		logger.Info("Reloaded secret", "secret", s.name, "file", s.path)
+
+		s.mu.Lock()
+		onChange := s.onChange
+		s.mu.Unlock()
+		for _, f := range onChange {
+			f()
+		}
+	}
+}
+
+func (s *Secret) read() (string, error) {
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return "", fmt.Errorf("read %s: %w", s.name, err)
+	}
+	value := string(bytes.TrimSpace(data))
+	if value == "" {
+		return "", fmt.Errorf("read %s: file %s is empty", s.name, s.path)
+	}
+	return value, nil
+}
+
+// Client is a client built from secrets, which is rebuilt when one of them changes. It is safe for concurrent use.
+type Client[T any] struct {
+	current atomic.Pointer[T]
+}
+
+// NewClient builds the client with the build function, which gets the secrets it needs with Get, and builds it again whenever one of the secrets changes.
+// A rebuild which fails is logged and the previous client is kept.
+func NewClient[T any](logger logr.Logger, build func() (*T, error), secrets ...*Secret) (*Client[T], error) {
+	client, err := build()
+	if err != nil {
+		return nil, err
+	}
+	c := &Client[T]{}
+	c.current.Store(client)
+
+	// rebuilds are serialized, so that a slow rebuild can't replace the client built from newer secrets
+	var mu sync.Mutex
+	rebuild := func() {
+		mu.Lock()
+		defer mu.Unlock()
+		client, err := build()
+		if err != nil {
+			logger.Error(err, "Cannot rebuild client with the changed secret, keeping the previous one")
+			return
+		}
+		c.current.Store(client)
+		logger.Info("Rebuilt client with the changed secret")
+	}
+	for _, s := range secrets {
+		s.OnChange(rebuild)
+	}
+	return c, nil
+}
+
+// Fixed returns a client which is never rebuilt.
+func Fixed[T any](client *T) *Client[T] {
+	c := &Client[T]{}
+	c.current.Store(client)
+	return c
+}
+
+// Get returns the current client.
+func (c *Client[T]) Get() *T {
+	return c.current.Load()
+}
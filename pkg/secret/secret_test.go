@@ -0,0 +1,111 @@
+package secret
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFromFile(t *testing.T) {
+	tests := map[string]struct {
+		content       *string
+		expected      string
+		expectedError string
+	}{
+		"given a file, we should get its content": {
+			content:  ptr("s3cr3t"),
+			expected: "s3cr3t",
+		},
+		"given a file with a final newline, we should ignore the newline": {
+			content:  ptr("s3cr3t\n"),
+			expected: "s3cr3t",
+		},
+		"given an empty file, we should get an error": {
+			content:       ptr("\n"),
+			expectedError: "is empty",
+		},
+		"given a missing file, we should get an error": {
+			expectedError: "read token",
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "token")
+			if tc.content != nil {
+				require.NoError(t, os.WriteFile(path, []byte(*tc.content), 0o600))
+			}
+			s, err := FromFile("token", path)
+			if tc.expectedError != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tc.expectedError)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, s.Get())
+		})
+	}
+}
+
+func TestSecret_Watch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token")
+	write := func(content string) {
+		require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	}
+	write("first")
+
+	s, err := FromFile("token", path)
+	require.NoError(t, err)
+
+	type client struct{ token string }
+	c, err := NewClient(logr.Discard(), func() (*client, error) {
+		if s.Get() == "invalid" {
+			return nil, fmt.Errorf("invalid token")
+		}
+		return &client{token: s.Get()}, nil
+	}, s)
+	require.NoError(t, err)
+	assert.Equal(t, "first", c.Get().token)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.Watch(ctx, logr.Discard(), 10*time.Millisecond)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	write("second\n")
+	require.Eventually(t, func() bool { return c.Get().token == "second" }, time.Second, 10*time.Millisecond,
+		"the client should be rebuilt with the rotated secret")
+
+	write("")
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, "second", s.Get(), "an empty file should be ignored")
+
+	write("invalid")
+	require.Eventually(t, func() bool { return s.Get() == "invalid" }, time.Second, 10*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, "second", c.Get().token, "a client which cannot be rebuilt should be kept")
+}
+
+func TestValue(t *testing.T) {
+	s := Value("token", "s3cr3t")
+	assert.Equal(t, "s3cr3t", s.Get())
+
+	// returns immediately, as there is no file to watch
+	s.Watch(context.Background(), logr.Discard(), time.Millisecond)
+}
+
+func ptr(s string) *string {
+	return &s
+}
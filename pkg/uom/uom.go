@@ -0,0 +1,203 @@
+// Package uom maps the units of measure the collectors bill in, like GBDay, to the IDs of the units in Odoo.
+// The mapping comes from JSON, e.g. the UOM flag, a file or a ConfigMap, and is reloaded when the file or ConfigMap changes.
+package uom
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/vshn/billing-collector-cloudservices/pkg/odoo"
+	corev1 "k8s.io/api/core/v1"
+	k8s "sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/yaml"
+)
+
+var (
+	reloads = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "billing_cloud_collector_uom_reloads_total",
+		Help: "Total number of reloads of the UOM mapping after it changed, by result (success or failure)",
+	}, []string{"result"})
+	unusedKeys = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "billing_cloud_collector_uom_unused_keys",
+		Help: "Number of keys of the UOM mapping which no enabled collector uses",
+	})
+)
+
+// Source loads the mapping.
+type Source interface {
+	Load(ctx context.Context) (map[string]string, error)
+}
+
+// JSONSource is a mapping given as JSON object, e.g. in the UOM flag. It never changes.
+type JSONSource string
+
+func (s JSONSource) Load(_ context.Context) (map[string]string, error) {
+	return odoo.LoadUOM(string(s))
+}
+
+// FileSource reads the mapping from a file with a JSON or YAML object, e.g. a mounted ConfigMap.
+type FileSource struct {
+	path string
+}
+
+// NewFileSource creates a FileSource for the file at the path.
+func NewFileSource(path string) *FileSource {
+	return &FileSource{path: path}
+}
+
+func (s *FileSource) Load(_ context.Context) (map[string]string, error) {
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return nil, fmt.Errorf("read uom mapping: %w", err)
+	}
+	mapping := map[string]string{}
+	if err := yaml.UnmarshalStrict(data, &mapping); err != nil {
+		return nil, fmt.Errorf("read uom mapping from %s: %w", s.path, err)
+	}
+	if len(mapping) == 0 {
+		return nil, fmt.Errorf("no unit of measure found in %s", s.path)
+	}
+	return mapping, nil
+}
+
+// ConfigMapSource reads the mapping from the data of a ConfigMap, one key per unit.
+type ConfigMapSource struct {
+	client    k8s.Client
+	namespace string
+	name      string
+}
+
+// NewConfigMapSource creates a ConfigMapSource for the ConfigMap with the given namespace and name.
+func NewConfigMapSource(client k8s.Client, namespace, name string) *ConfigMapSource {
+	return &ConfigMapSource{client: client, namespace: namespace, name: name}
+}
+
+func (s *ConfigMapSource) Load(ctx context.Context) (map[string]string, error) {
+	cm := &corev1.ConfigMap{}
+	if err := s.client.Get(ctx, k8s.ObjectKey{Namespace: s.namespace, Name: s.name}, cm); err != nil {
+		return nil, fmt.Errorf("get uom configmap %s/%s: %w", s.namespace, s.name, err)
+	}
+	if len(cm.Data) == 0 {
+		return nil, fmt.Errorf("no unit of measure found in configmap %s/%s", s.namespace, s.name)
+	}
+	return cm.Data, nil
+}
+
+// Mapping is the current mapping of a source. It is safe for concurrent use.
+type Mapping struct {
+	source  Source
+	units   []string
+	current atomic.Pointer[map[string]string]
+}
+
+// Load loads the mapping from the source and checks that it maps all the units the collectors need.
+// Keys which are none of the units are logged as unused.
+func Load(ctx context.Context, logger logr.Logger, source Source, units ...string) (*Mapping, error) {
+	mapping, err := source.Load(ctx)
+	if err != nil {
+		return nil, err
+	}
+	m := &Mapping{source: source, units: units}
+	if err := m.set(logger, mapping); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Fixed returns a mapping which is never reloaded.
+func Fixed(mapping map[string]string) *Mapping {
+	m := &Mapping{}
+	m.current.Store(&mapping)
+	return m
+}
+
+// UnitID returns the ID of the unit in Odoo, empty if the unit is not mapped.
+func (m *Mapping) UnitID(unit string) string {
+	return (*m.current.Load())[unit]
+}
+
+// Watch reloads the mapping from the source every interval until the context is done.
+// A changed mapping which lacks one of the units is rejected and the previous one is kept.
+func (m *Mapping) Watch(ctx context.Context, logger logr.Logger, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var rejected map[string]string
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		mapping, err := m.source.Load(ctx)
+		if err == nil && (maps.Equal(mapping, *m.current.Load()) || maps.Equal(mapping, rejected)) {
+			// unchanged, or rejected already
+			continue
+		}
+		if err == nil {
+			if err = m.set(logger, mapping); err != nil {
+				rejected = mapping
+			}
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			reloads.WithLabelValues("failure").Inc()
+			logger.Error(err, "Cannot reload UOM mapping, keeping the previous one")
+			continue
+		}
+		rejected = nil
+		reloads.WithLabelValues("success").Inc()
+		logger.Info("Reloaded UOM mapping")
+	}
+}
+
+func (m *Mapping) set(logger logr.Logger, mapping map[string]string) error {
+	if err := Check(mapping, m.units...); err != nil {
+		return err
+	}
+	unused := Unused(mapping, m.units...)
+	unusedKeys.Set(float64(len(unused)))
+	if len(unused) > 0 {
+		logger.Info("UOM mapping has keys no collector uses", "keys", unused)
+	}
+	m.current.Store(&mapping)
+	return nil
+}
+
+// Check returns an error listing the units the mapping lacks.
+func Check(mapping map[string]string, units ...string) error {
+	var missing []string
+	for _, unit := range units {
+		if mapping[unit] == "" && !slices.Contains(missing, unit) {
+			missing = append(missing, unit)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("missing UOM mapping %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// Unused returns the keys of the mapping which are none of the units, sorted.
+func Unused(mapping map[string]string, units ...string) []string {
+	var unused []string
+	for key := range mapping {
+		if !slices.Contains(units, key) {
+			unused = append(unused, key)
+		}
+	}
+	sort.Strings(unused)
+	return unused
+}
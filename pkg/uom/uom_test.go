@@ -0,0 +1,153 @@
+package uom
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestSource(t *testing.T) {
+	expected := map[string]string{"GBDay": "uom_1", "KReq": "uom_2"}
+
+	scheme := runtime.NewScheme()
+	require.NoError(t, corev1.AddToScheme(scheme))
+
+	writeFile := func(t *testing.T, content string) string {
+		path := filepath.Join(t.TempDir(), "uom")
+		require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+		return path
+	}
+
+	tests := map[string]struct {
+		source        func(t *testing.T) Source
+		expectedError string
+	}{
+		"given JSON, we should get the mapping": {
+			source: func(t *testing.T) Source { return JSONSource(`{"GBDay": "uom_1", "KReq": "uom_2"}`) },
+		},
+		"given a JSON file, we should get the mapping": {
+			source: func(t *testing.T) Source {
+				return NewFileSource(writeFile(t, `{"GBDay": "uom_1", "KReq": "uom_2"}`))
+			},
+		},
+		"given a YAML file, we should get the mapping": {
+			source: func(t *testing.T) Source { return NewFileSource(writeFile(t, "GBDay: uom_1\nKReq: uom_2\n")) },
+		},
+		"given an empty file, we should get an error": {
+			source:        func(t *testing.T) Source { return NewFileSource(writeFile(t, "")) },
+			expectedError: "no unit of measure found",
+		},
+		"given a missing file, we should get an error": {
+			source:        func(t *testing.T) Source { return NewFileSource(filepath.Join(t.TempDir(), "missing")) },
+			expectedError: "read uom mapping",
+		},
+		"given a ConfigMap, we should get its data": {
+			source: func(t *testing.T) Source {
+				client := fake.NewClientBuilder().WithScheme(scheme).WithObjects(&corev1.ConfigMap{
+					ObjectMeta: metav1.ObjectMeta{Namespace: "billing", Name: "uom"},
+					Data:       expected,
+				}).Build()
+				return NewConfigMapSource(client, "billing", "uom")
+			},
+		},
+		"given a missing ConfigMap, we should get an error": {
+			source: func(t *testing.T) Source {
+				return NewConfigMapSource(fake.NewClientBuilder().WithScheme(scheme).Build(), "billing", "uom")
+			},
+			expectedError: "get uom configmap billing/uom",
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			mapping, err := tc.source(t).Load(context.Background())
+			if tc.expectedError != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tc.expectedError)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, expected, mapping)
+		})
+	}
+}
+
+func TestLoad(t *testing.T) {
+	tests := map[string]struct {
+		mapping        string
+		units          []string
+		expectedError  string
+		expectedUnused []string
+	}{
+		"given all units, we should get the mapping": {
+			mapping: `{"GB": "uom_1", "GBDay": "uom_2"}`,
+			units:   []string{"GB", "GBDay"},
+		},
+		"given missing units, we should get all of them": {
+			mapping:       `{"GB": "uom_1"}`,
+			units:         []string{"GB", "GBDay", "KReq", "GBDay"},
+			expectedError: "missing UOM mapping GBDay, KReq",
+		},
+		"given keys no collector uses, we should report them": {
+			mapping:        `{"GB": "uom_1", "InstanceHour": "uom_2", "Foo": "uom_3"}`,
+			units:          []string{"GB"},
+			expectedUnused: []string{"Foo", "InstanceHour"},
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			m, err := Load(context.Background(), logr.Discard(), JSONSource(tc.mapping), tc.units...)
+			if tc.expectedError != "" {
+				require.Error(t, err)
+				assert.Equal(t, tc.expectedError, err.Error())
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, "uom_1", m.UnitID("GB"))
+			assert.Equal(t, tc.expectedUnused, Unused(*m.current.Load(), tc.units...))
+		})
+	}
+}
+
+func TestMapping_Watch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "uom.json")
+	write := func(content string) {
+		require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	}
+	write(`{"GBDay": "uom_1"}`)
+
+	m, err := Load(context.Background(), logr.Discard(), NewFileSource(path), "GBDay")
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		m.Watch(ctx, logr.Discard(), 10*time.Millisecond)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	write(`{"GBDay": "uom_2"}`)
+	require.Eventually(t, func() bool { return m.UnitID("GBDay") == "uom_2" }, time.Second, 10*time.Millisecond,
+		"the changed mapping should be loaded")
+
+	write(`{"GB": "uom_3"}`)
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, "uom_2", m.UnitID("GBDay"), "a mapping lacking a unit should be rejected")
+
+	write(`not json`)
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, "uom_2", m.UnitID("GBDay"), "an unreadable mapping should be rejected")
+}
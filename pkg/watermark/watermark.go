@@ -0,0 +1,209 @@
+// Package watermark persists the end of the last period each collector billed, so that periods missed while
+// a collector was down can be billed once it is back.
+package watermark
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/client-go/util/retry"
+	k8s "sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// AnnotationPrefix is the prefix of the ConfigMap annotations holding the watermarks, followed by the collector name.
+const AnnotationPrefix = "watermark.billing.vshn.ch/"
+
+// Store persists a watermark per collector.
+type Store interface {
+	// Load returns the watermark of the collector, or the zero time if it has none yet.
+	Load(ctx context.Context, collector string) (time.Time, error)
+	// Save moves the watermark of the collector forward to t. A watermark is never moved backward.
+	Save(ctx context.Context, collector string, t time.Time) error
+	// Delete removes the watermark of the collector, so that it has none again.
+	Delete(ctx context.Context, collector string) error
+}
+
+// FileStore keeps the watermarks of all collectors as a JSON object in a local file.
+type FileStore struct {
+	path string
+	mu   sync.Mutex
+}
+
+// NewFileStore creates a FileStore. The file is created with the first watermark saved.
+func NewFileStore(path string) *FileStore {
+	return &FileStore{path: path}
+}
+
+func (s *FileStore) Load(_ context.Context, collector string) (time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	watermarks, err := s.read()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return watermarks[collector], nil
+}
+
+func (s *FileStore) Save(_ context.Context, collector string, t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	watermarks, err := s.read()
+	if err != nil {
+		return err
+	}
+	if !t.After(watermarks[collector]) {
+		return nil
+	}
+	watermarks[collector] = t.UTC()
+	return s.write(watermarks)
+}
+
+func (s *FileStore) Delete(_ context.Context, collector string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	watermarks, err := s.read()
+	if err != nil {
+		return err
+	}
+	if _, ok := watermarks[collector]; !ok {
+		return nil
+	}
+	delete(watermarks, collector)
+	return s.write(watermarks)
+}
+
+func (s *FileStore) write(watermarks map[string]time.Time) error {
+	data, err := json.MarshalIndent(watermarks, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encode watermarks: %w", err)
+	}
+	// write to a temporary file first, so that a crash never leaves a truncated file behind
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return fmt.Errorf("write watermarks: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write watermarks: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("write watermarks: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return fmt.Errorf("write watermarks: %w", err)
+	}
+	return nil
+}
+
+func (s *FileStore) read() (map[string]time.Time, error) {
+	watermarks := map[string]time.Time{}
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return watermarks, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read watermarks: %w", err)
+	}
+	if err := json.Unmarshal(data, &watermarks); err != nil {
+		return nil, fmt.Errorf("read watermarks from %s: %w", s.path, err)
+	}
+	return watermarks, nil
+}
+
+// ConfigMapStore keeps the watermarks as annotations of a ConfigMap, one per collector.
+// The ConfigMap is created with the first watermark saved.
+type ConfigMapStore struct {
+	client    k8s.Client
+	namespace string
+	name      string
+}
+
+// NewConfigMapStore creates a ConfigMapStore for the ConfigMap with the given namespace and name.
+func NewConfigMapStore(client k8s.Client, namespace, name string) *ConfigMapStore {
+	return &ConfigMapStore{client: client, namespace: namespace, name: name}
+}
+
+func (s *ConfigMapStore) Load(ctx context.Context, collector string) (time.Time, error) {
+	cm := &corev1.ConfigMap{}
+	err := s.client.Get(ctx, k8s.ObjectKey{Namespace: s.namespace, Name: s.name}, cm)
+	if apierrors.IsNotFound(err) {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, fmt.Errorf("get watermark configmap %s/%s: %w", s.namespace, s.name, err)
+	}
+	return parseAnnotation(cm, collector)
+}
+
+func (s *ConfigMapStore) Save(ctx context.Context, collector string, t time.Time) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		cm := &corev1.ConfigMap{}
+		err := s.client.Get(ctx, k8s.ObjectKey{Namespace: s.namespace, Name: s.name}, cm)
+		if apierrors.IsNotFound(err) {
+			cm.Namespace = s.namespace
+			cm.Name = s.name
+			cm.Annotations = map[string]string{AnnotationPrefix + collector: t.UTC().Format(time.RFC3339)}
+			err := s.client.Create(ctx, cm)
+			if apierrors.IsAlreadyExists(err) {
+				// created concurrently, retry as update
+				return apierrors.NewConflict(corev1.Resource("configmaps"), s.name, err)
+			}
+			return err
+		}
+		if err != nil {
+			return fmt.Errorf("get watermark configmap %s/%s: %w", s.namespace, s.name, err)
+		}
+
+		current, err := parseAnnotation(cm, collector)
+		if err != nil {
+			return err
+		}
+		if !t.After(current) {
+			return nil
+		}
+		if cm.Annotations == nil {
+			cm.Annotations = map[string]string{}
+		}
+		cm.Annotations[AnnotationPrefix+collector] = t.UTC().Format(time.RFC3339)
+		return s.client.Update(ctx, cm)
+	})
+}
+
+func (s *ConfigMapStore) Delete(ctx context.Context, collector string) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		cm := &corev1.ConfigMap{}
+		err := s.client.Get(ctx, k8s.ObjectKey{Namespace: s.namespace, Name: s.name}, cm)
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("get watermark configmap %s/%s: %w", s.namespace, s.name, err)
+		}
+		if _, ok := cm.Annotations[AnnotationPrefix+collector]; !ok {
+			return nil
+		}
+		delete(cm.Annotations, AnnotationPrefix+collector)
+		return s.client.Update(ctx, cm)
+	})
+}
+
+func parseAnnotation(cm *corev1.ConfigMap, collector string) (time.Time, error) {
+	value, ok := cm.Annotations[AnnotationPrefix+collector]
+	if !ok {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("annotation %s of configmap %s/%s: %w", AnnotationPrefix+collector, cm.Namespace, cm.Name, err)
+	}
+	return t, nil
+}
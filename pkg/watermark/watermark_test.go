@@ -0,0 +1,97 @@
+package watermark
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestStore(t *testing.T) {
+	t1 := time.Date(2024, 3, 1, 13, 0, 0, 0, time.UTC)
+	t2 := t1.Add(time.Hour)
+
+	scheme := runtime.NewScheme()
+	require.NoError(t, corev1.AddToScheme(scheme))
+
+	stores := map[string]func(t *testing.T) Store{
+		"file": func(t *testing.T) Store {
+			return NewFileStore(filepath.Join(t.TempDir(), "watermarks.json"))
+		},
+		"configmap": func(t *testing.T) Store {
+			return NewConfigMapStore(fake.NewClientBuilder().WithScheme(scheme).Build(), "billing", "watermarks")
+		},
+	}
+
+	tests := map[string]struct {
+		saves    map[string][]time.Time
+		deletes  []string
+		expected map[string]time.Time
+	}{
+		"given no watermark, we should get the zero time": {
+			expected: map[string]time.Time{"exoscale-dbaas": {}},
+		},
+		"given a saved watermark, we should get it back": {
+			saves:    map[string][]time.Time{"exoscale-dbaas": {t1}},
+			expected: map[string]time.Time{"exoscale-dbaas": t1},
+		},
+		"given an earlier watermark saved after a later one, we should keep the later one": {
+			saves:    map[string][]time.Time{"exoscale-dbaas": {t2, t1}},
+			expected: map[string]time.Time{"exoscale-dbaas": t2},
+		},
+		"given watermarks of several collectors, we should keep them apart": {
+			saves:    map[string][]time.Time{"exoscale-dbaas": {t1, t2}, "spks": {t1}},
+			expected: map[string]time.Time{"exoscale-dbaas": t2, "spks": t1, "cloudscale-objectstorage": {}},
+		},
+		"given a deleted watermark, we should get the zero time and keep the others": {
+			saves:    map[string][]time.Time{"exoscale-dbaas.ch-gva-2": {t2}, "exoscale-dbaas": {t2}},
+			deletes:  []string{"exoscale-dbaas.ch-gva-2", "spks"},
+			expected: map[string]time.Time{"exoscale-dbaas.ch-gva-2": {}, "exoscale-dbaas": t2, "spks": {}},
+		},
+	}
+	for storeName, newStore := range stores {
+		for name, tc := range tests {
+			t.Run(storeName+"/"+name, func(t *testing.T) {
+				ctx := context.Background()
+				store := newStore(t)
+				for collector, saves := range tc.saves {
+					for _, s := range saves {
+						require.NoError(t, store.Save(ctx, collector, s))
+					}
+				}
+				for _, collector := range tc.deletes {
+					require.NoError(t, store.Delete(ctx, collector))
+				}
+				for collector, expected := range tc.expected {
+					actual, err := store.Load(ctx, collector)
+					require.NoError(t, err)
+					assert.True(t, expected.Equal(actual), "collector %s: expected %s, got %s", collector, expected, actual)
+				}
+			})
+		}
+	}
+}
+
+func TestConfigMapStore_existingConfigMap(t *testing.T) {
+	scheme := runtime.NewScheme()
+	require.NoError(t, corev1.AddToScheme(scheme))
+	cm := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: "billing", Name: "watermarks",
+		Annotations: map[string]string{"other": "annotation", AnnotationPrefix + "spks": "2024-03-01T00:00:00Z"}}}
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(cm).Build()
+	store := NewConfigMapStore(c, "billing", "watermarks")
+
+	ctx := context.Background()
+	require.NoError(t, store.Save(ctx, "spks", time.Date(2024, 3, 2, 0, 0, 0, 0, time.UTC)))
+
+	actual := &corev1.ConfigMap{}
+	require.NoError(t, c.Get(ctx, types.NamespacedName{Namespace: "billing", Name: "watermarks"}, actual))
+	assert.Equal(t, map[string]string{"other": "annotation", AnnotationPrefix + "spks": "2024-03-02T00:00:00Z"}, actual.Annotations)
+}